@@ -0,0 +1,301 @@
+package h2csmuggler
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// RequestBody is a reusable request body. Each request gets its own reader, so a single body can
+// be sent to many targets. File bodies are read as they're sent, so large bodies are streamed over
+// the tunnel's flow control rather than held in memory
+type RequestBody struct {
+	// ContentType is sent if the request doesn't already have a Content-Type
+	ContentType string
+	// Length is the Content-Length. If -1, the length is unknown and the body is streamed
+	// without one
+	Length int64
+
+	open func() (io.ReadCloser, error)
+}
+
+// NewRequestBody will call open for the body of each request. length may be -1 if unknown
+func NewRequestBody(open func() (io.ReadCloser, error), length int64, contentType string) *RequestBody {
+	return &RequestBody{
+		ContentType: contentType,
+		Length:      length,
+		open:        open,
+	}
+}
+
+// BodyBytes will send b. The content type is detected from b. See DetectBodyContentType
+func BodyBytes(b []byte) *RequestBody {
+	return &RequestBody{
+		ContentType: DetectBodyContentType(b),
+		Length:      int64(len(b)),
+		open: func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(b)), nil
+		},
+	}
+}
+
+// BodyString will send s. The content type is detected from s. See DetectBodyContentType
+func BodyString(s string) *RequestBody {
+	return BodyBytes([]byte(s))
+}
+
+// BodyReader will read r in full, so it can be sent more than once. This is used for stdin
+func BodyReader(r io.Reader) (*RequestBody, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read body")
+	}
+	return BodyBytes(b), nil
+}
+
+// BodyFile will stream the file for each request. The content type is taken from the file
+// extension, or detected from its contents
+func BodyFile(filename string) (*RequestBody, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read body")
+	}
+	if info.IsDir() {
+		return nil, errors.Errorf("body %v is a directory", filename)
+	}
+
+	contentType, err := fileContentType(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &RequestBody{
+		ContentType: contentType,
+		Length:      info.Size(),
+		open: func() (io.ReadCloser, error) {
+			return os.Open(filename)
+		},
+	}, nil
+}
+
+// ParseBody will parse a curl style body argument. @filename streams the file, @- reads stdin,
+// and anything else is sent literally
+func ParseBody(arg string) (*RequestBody, error) {
+	switch {
+	case arg == "@-":
+		return BodyReader(os.Stdin)
+	case strings.HasPrefix(arg, "@"):
+		return BodyFile(arg[1:])
+	default:
+		return BodyString(arg), nil
+	}
+}
+
+// Apply will set the body on req, along with its Content-Length and Content-Type. The Content-Type
+// is only set if req doesn't have one. GetBody is also set so the request can be resent
+func (b *RequestBody) Apply(req *http.Request) error {
+	body, err := b.open()
+	if err != nil {
+		return errors.Wrap(err, "failed to open body")
+	}
+	req.Body = body
+	req.GetBody = b.open
+	req.ContentLength = b.Length
+	if b.Length == 0 {
+		body.Close()
+		req.Body = http.NoBody
+	}
+	if b.ContentType != "" && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", b.ContentType)
+	}
+	return nil
+}
+
+// DetectBodyContentType returns the content type of b. Valid json is application/json, and other
+// text is application/x-www-form-urlencoded as curl does. Anything else is sniffed by net/http
+func DetectBodyContentType(b []byte) string {
+	switch {
+	case len(b) == 0:
+		return ""
+	case json.Valid(b):
+		return "application/json"
+	case utf8.Valid(b):
+		return "application/x-www-form-urlencoded"
+	default:
+		return http.DetectContentType(b)
+	}
+}
+
+// fileContentType returns the content type of the file from its extension, falling back to
+// sniffing its contents
+func fileContentType(filename string) (string, error) {
+	if t := mime.TypeByExtension(filepath.Ext(filename)); t != "" {
+		return t, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read body")
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", errors.Wrap(err, "failed to read body")
+	}
+	if n == 0 {
+		return "", nil
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+// MultipartBody builds a multipart/form-data body. Files are streamed when the body is sent
+type MultipartBody struct {
+	boundary string
+	parts    []multipartPart
+}
+
+type multipartPart struct {
+	name  string
+	value string // the field value, or the filename for file parts
+	file  bool
+	size  int64
+}
+
+// NewMultipartBody will return an empty multipart body with a random boundary
+func NewMultipartBody() *MultipartBody {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return &MultipartBody{
+		boundary: "h2csmuggler" + hex.EncodeToString(b),
+	}
+}
+
+// AddField will add a form field
+func (m *MultipartBody) AddField(name, value string) {
+	m.parts = append(m.parts, multipartPart{name: name, value: value})
+}
+
+// AddFile will add the file as a form file. The file is read when the body is sent
+func (m *MultipartBody) AddFile(name, filename string) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return errors.Wrap(err, "failed to read form file")
+	}
+	m.parts = append(m.parts, multipartPart{name: name, value: filename, file: true, size: info.Size()})
+	return nil
+}
+
+// ParseFormField will add a curl style form argument. name=@filename adds the file, and
+// name=value adds a field
+func (m *MultipartBody) ParseFormField(arg string) error {
+	kv := strings.SplitN(arg, "=", 2)
+	if len(kv) != 2 {
+		return errors.Errorf("invalid form field %q. expected name=value or name=@filename", arg)
+	}
+	if strings.HasPrefix(kv[1], "@") {
+		return m.AddFile(kv[0], kv[1][1:])
+	}
+	m.AddField(kv[0], kv[1])
+	return nil
+}
+
+// Body returns the request body. The length is calculated up front from the file sizes, so
+// the body is sent with a Content-Length
+func (m *MultipartBody) Body() (*RequestBody, error) {
+	// copy the parts, so fields added later don't change the length
+	m = &MultipartBody{
+		boundary: m.boundary,
+		parts:    append([]multipartPart(nil), m.parts...),
+	}
+
+	var headers countWriter
+	if err := m.write(&headers, false); err != nil {
+		return nil, err
+	}
+	length := headers.n
+	for _, p := range m.parts {
+		length += p.size
+	}
+
+	return &RequestBody{
+		ContentType: "multipart/form-data; boundary=" + m.boundary,
+		Length:      length,
+		open: func() (io.ReadCloser, error) {
+			pr, pw := io.Pipe()
+			go func() {
+				pw.CloseWithError(m.write(pw, true))
+			}()
+			return pr, nil
+		},
+	}, nil
+}
+
+// write will write the body to w. If files is false, the file contents are skipped
+func (m *MultipartBody) write(w io.Writer, files bool) error {
+	mw := multipart.NewWriter(w)
+	if err := mw.SetBoundary(m.boundary); err != nil {
+		return errors.Wrap(err, "invalid boundary")
+	}
+
+	for _, p := range m.parts {
+		if !p.file {
+			if err := mw.WriteField(p.name, p.value); err != nil {
+				return errors.Wrap(err, "failed to write form field")
+			}
+			continue
+		}
+
+		pw, err := mw.CreateFormFile(p.name, filepath.Base(p.value))
+		if err != nil {
+			return errors.Wrap(err, "failed to write form file")
+		}
+		if !files {
+			continue
+		}
+		if err := copyFile(pw, p.value, p.size); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// copyFile will copy exactly size bytes of the file to w, so the Content-Length stays correct
+func copyFile(w io.Writer, filename string, size int64) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return errors.Wrap(err, "failed to open form file")
+	}
+	defer f.Close()
+
+	n, err := io.Copy(w, io.LimitReader(f, size))
+	if err != nil {
+		return errors.Wrap(err, "failed to write form file")
+	}
+	if n != size {
+		return errors.Errorf("form file %v changed size while sending", filename)
+	}
+	return nil
+}
+
+// countWriter counts the bytes written to it
+type countWriter struct {
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
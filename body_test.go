@@ -0,0 +1,196 @@
+package h2csmuggler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestDetectBodyContentType(t *testing.T) {
+	tests := []struct {
+		name string
+		body []byte
+		want string
+	}{
+		{name: "empty", body: nil, want: ""},
+		{name: "json", body: []byte(`{"user":128457, "role": "admin"}`), want: "application/json"},
+		{name: "form", body: []byte("user=128457&role=admin"), want: "application/x-www-form-urlencoded"},
+		{name: "binary", body: []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0xff}, want: "image/png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectBodyContentType(tt.body); got != tt.want {
+				t.Errorf("DetectBodyContentType() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestBody_Apply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "body")
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "body.json")
+	if err := ioutil.WriteFile(file, []byte(`{"a":1}`), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	tests := []struct {
+		name            string
+		arg             string
+		contentType     string // set on the request before the body is applied
+		wantBody        string
+		wantContentType string
+		wantErr         bool
+	}{
+		{name: "literal", arg: "a=1", wantBody: "a=1", wantContentType: "application/x-www-form-urlencoded"},
+		{name: "file", arg: "@" + file, wantBody: `{"a":1}`, wantContentType: "application/json"},
+		{name: "content type kept", arg: "a=1", contentType: "text/plain", wantBody: "a=1", wantContentType: "text/plain"},
+		{name: "missing file", arg: "@" + filepath.Join(dir, "missing"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := ParseBody(tt.arg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseBody() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			// apply twice to make sure the body can be reused
+			for i := 0; i < 2; i++ {
+				req, _ := http.NewRequest("POST", "http://example.com/", nil)
+				if tt.contentType != "" {
+					req.Header.Set("Content-Type", tt.contentType)
+				}
+				if err := body.Apply(req); err != nil {
+					t.Fatalf("RequestBody.Apply() error = %v", err)
+				}
+				got, _ := ioutil.ReadAll(req.Body)
+				if string(got) != tt.wantBody || req.ContentLength != int64(len(tt.wantBody)) {
+					t.Errorf("RequestBody.Apply() body = %q, length %d, want %q", got, req.ContentLength, tt.wantBody)
+				}
+				if got := req.Header.Get("Content-Type"); got != tt.wantContentType {
+					t.Errorf("RequestBody.Apply() Content-Type = %v, want %v", got, tt.wantContentType)
+				}
+			}
+		})
+	}
+}
+
+func TestMultipartBody(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multipart")
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "upload.bin")
+	content := bytes.Repeat([]byte{0xde, 0xad}, 50000)
+	if err := ioutil.WriteFile(file, content, 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	m := NewMultipartBody()
+	for _, f := range []string{"name=x", "file=@" + file} {
+		if err := m.ParseFormField(f); err != nil {
+			t.Fatalf("ParseFormField() error = %v", err)
+		}
+	}
+	body, err := m.Body()
+	if err != nil {
+		t.Fatalf("MultipartBody.Body() error = %v", err)
+	}
+
+	req, _ := http.NewRequest("POST", "http://example.com/", nil)
+	if err := body.Apply(req); err != nil {
+		t.Fatalf("RequestBody.Apply() error = %v", err)
+	}
+	raw, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if int64(len(raw)) != req.ContentLength {
+		t.Errorf("multipart length = %d, Content-Length = %d", len(raw), req.ContentLength)
+	}
+
+	_, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("ParseMediaType() error = %v", err)
+	}
+	mr := multipart.NewReader(bytes.NewReader(raw), params["boundary"])
+	want := map[string][]byte{"name": []byte("x"), "file": content}
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("NextPart() error = %v", err)
+		}
+		got, _ := ioutil.ReadAll(p)
+		if !bytes.Equal(got, want[p.FormName()]) {
+			t.Errorf("part %v = %d bytes, want %d", p.FormName(), len(got), len(want[p.FormName()]))
+		}
+		delete(want, p.FormName())
+	}
+	if len(want) != 0 {
+		t.Errorf("missing parts %v", want)
+	}
+}
+
+func TestConn_DoBody(t *testing.T) {
+	// the body is larger than the initial flow control window, so it must be streamed
+	content := bytes.Repeat([]byte("h2csmuggler"), 20000)
+	srv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			// x/net's h2c never ends the body of the upgraded request
+			return
+		}
+		h := sha256.New()
+		n, _ := io.Copy(h, r.Body)
+		fmt.Fprintf(w, "%d %x", n, h.Sum(nil))
+	}), &http2.Server{}))
+	defer srv.Close()
+
+	c, err := NewConn(srv.URL)
+	if err != nil {
+		t.Fatalf("NewConn() error = %v", err)
+	}
+	defer c.Close()
+
+	body := BodyBytes(content)
+	want := fmt.Sprintf("%d %x", len(content), sha256.Sum256(content))
+	// the upgrade request is sent without a body, and the body is smuggled on the next stream
+	for _, method := range []string{"GET", "POST"} {
+		req, _ := http.NewRequest(method, srv.URL+"/upload", nil)
+		if method == "POST" {
+			if err := body.Apply(req); err != nil {
+				t.Fatalf("RequestBody.Apply() error = %v", err)
+			}
+		}
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("Conn.Do() error = %v", err)
+		}
+		got, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if method == "POST" && string(got) != want {
+			t.Errorf("Conn.Do() body = %q, want %q", got, want)
+		}
+	}
+}
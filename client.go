@@ -7,8 +7,12 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/textproto"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/minight/h2csmuggler/http2"
@@ -18,23 +22,103 @@ import (
 )
 
 var (
+	// DefaultDialer uses the system resolver. Use ConnectionResolver to override this
 	DefaultDialer = &net.Dialer{
 		Timeout: time.Millisecond * time.Duration(5000),
-		Resolver: &net.Resolver{
-			PreferGo: true,
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				d := net.Dialer{
-					Timeout: time.Millisecond * time.Duration(5000),
-				}
-				return d.DialContext(ctx, "udp", "1.1.1.1:53")
-			},
-		},
 	}
 	DefaultTransport = &http2.Transport{
 		AllowHTTP: true,
 	}
 )
 
+// Mode is how the h2c connection is initialized
+type Mode int
+
+const (
+	// ModeUpgrade will send a HTTP/1.1 request with Upgrade: h2c and switch to http2 on a 101
+	ModeUpgrade Mode = iota
+	// ModePriorKnowledge will send the http2 client preface immediately
+	ModePriorKnowledge
+	// ModeWebSocket will send a HTTP/1.1 request with Upgrade: websocket and then send HTTP/1.1
+	// requests through the tunnel. This is only supported by WebSocketConn
+	ModeWebSocket
+)
+
+var (
+	ErrUnexpectedMode     = errors.New("Unexpected connection mode")
+	ErrAlreadyInitialized = errors.New("h2csmuggler: already initialized")
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeUpgrade:
+		return "upgrade"
+	case ModePriorKnowledge:
+		return "prior-knowledge"
+	case ModeWebSocket:
+		return "websocket"
+	default:
+		return fmt.Sprintf("Mode(%d)", int(m))
+	}
+}
+
+// ParseMode will parse the string representation of a Mode
+func ParseMode(s string) (Mode, error) {
+	switch s {
+	case "upgrade":
+		return ModeUpgrade, nil
+	case "prior-knowledge":
+		return ModePriorKnowledge, nil
+	case "websocket":
+		return ModeWebSocket, nil
+	default:
+		return 0, ErrUnexpectedMode
+	}
+}
+
+// UpgradeResult classifies how the target responded to the h2c upgrade
+type UpgradeResult int
+
+const (
+	// UpgradeUnknown is used when no upgrade response was received e.g. the connection failed
+	UpgradeUnknown UpgradeResult = iota
+	// UpgradeRefused is used when the upgrade response wasn't a 101
+	UpgradeRefused
+	// UpgradeNoH2 is used when the upgrade response was a 101, but the server didn't speak http2
+	UpgradeNoH2
+	// UpgradeConfirmed is used when the server sent its SETTINGS and acknowledged a PING after the 101
+	UpgradeConfirmed
+)
+
+func (r UpgradeResult) String() string {
+	switch r {
+	case UpgradeRefused:
+		return "upgrade-refused"
+	case UpgradeNoH2:
+		return "101-no-h2"
+	case UpgradeConfirmed:
+		return "h2c-confirmed"
+	default:
+		return "unknown"
+	}
+}
+
+// ClassifyUpgrade will return the UpgradeResult for the error returned by an upgrade
+func ClassifyUpgrade(err error) UpgradeResult {
+	var uscErr http2.UnexpectedStatusCodeError
+	var noH2Err http2.NoH2Error
+	switch {
+	case err == nil:
+		return UpgradeConfirmed
+	case errors.As(err, &uscErr):
+		return UpgradeRefused
+	case errors.As(err, &noH2Err):
+		return UpgradeNoH2
+	default:
+		return UpgradeUnknown
+	}
+}
+
 type ConnectionOption func(c *Conn)
 
 func ConnectionTransport(t *http2.Transport) ConnectionOption {
@@ -49,6 +133,75 @@ func ConnectionDialer(t *net.Dialer) ConnectionOption {
 	}
 }
 
+// ConnectionProxy will tunnel the connection through an upstream proxy.
+// http:// (CONNECT) and socks5:// proxies are supported. See ParseProxy
+func ConnectionProxy(p *url.URL) ConnectionOption {
+	return func(c *Conn) {
+		c.proxy = p
+	}
+}
+
+// ConnectionResolver will use the provided resolver for all lookups. See NewResolver
+func ConnectionResolver(r *net.Resolver) ConnectionOption {
+	return func(c *Conn) {
+		c.resolver = r
+	}
+}
+
+// ConnectionResolveOverrides will dial the provided address instead of resolving the target
+// this is keyed by host:port, and behaves like curl's --resolve. The SNI and Host will still
+// use the target hostname. See ParseResolveOverrides
+func ConnectionResolveOverrides(overrides map[string]string) ConnectionOption {
+	return func(c *Conn) {
+		c.resolveOverrides = overrides
+	}
+}
+
+// ConnectionMode will choose how the connection is initialized. See Mode
+func ConnectionMode(m Mode) ConnectionOption {
+	return func(c *Conn) {
+		c.mode = m
+	}
+}
+
+// ConnectionTLSConfig will use the provided tls config for https targets.
+// If ServerName is empty, it will be set to the target hostname. See DefaultTLSConfig
+func ConnectionTLSConfig(cfg *tls.Config) ConnectionOption {
+	return func(c *Conn) {
+		c.tlsConfig = cfg
+	}
+}
+
+// ConnectionWebSocketOptions will apply the websocket options whenever a WebSocketConn is upgraded
+// Options provided directly to WebSocketConn.UpgradeContext are applied after these
+func ConnectionWebSocketOptions(opts ...WebSocketOption) ConnectionOption {
+	return func(c *Conn) {
+		c.wsOpts = append(c.wsOpts, opts...)
+	}
+}
+
+// ConnectionUpgradeOptions will apply the upgrade options whenever the connection is upgraded
+// Options provided directly to DoUpgrade or UpgradeContext are applied after these
+func ConnectionUpgradeOptions(opts ...UpgradeOption) ConnectionOption {
+	return func(c *Conn) {
+		c.upgradeOpts = append(c.upgradeOpts, opts...)
+	}
+}
+
+// ConnectionTimeouts will set the deadline for each phase of the connection. See Timeouts
+func ConnectionTimeouts(t Timeouts) ConnectionOption {
+	return func(c *Conn) {
+		c.timeouts = t
+	}
+}
+
+// ConnectionHAR will record the upgrade exchange and every stream sent on the connection. See HARRecorder
+func ConnectionHAR(h *HARRecorder) ConnectionOption {
+	return func(c *Conn) {
+		c.har = h
+	}
+}
+
 func ConnectionMaxRetries(v int) ConnectionOption {
 	return func(c *Conn) {
 		c.maxRetries = v
@@ -66,6 +219,7 @@ func NewConn(target string, opts ...ConnectionOption) (*Conn, error) {
 	var c Conn = Conn{
 		dialer:    DefaultDialer,
 		transport: DefaultTransport,
+		timeouts:  DefaultTimeouts,
 	}
 
 	c.url, err = url.Parse(target)
@@ -76,26 +230,48 @@ func NewConn(target string, opts ...ConnectionOption) (*Conn, error) {
 	for _, o := range opts {
 		o(&c)
 	}
+
+	// copy the dialer so we don't modify the shared one
+	if c.resolver != nil {
+		d := *c.dialer
+		d.Resolver = c.resolver
+		c.dialer = &d
+	}
 	return &c, nil
 }
 
-// Conn encapsulates all the state needed to perform a request over h2c. Internally, this is
-// a singlethreaded connection. Functions can be called concurrently, however they will block
-// on the same thread. For concurrent connections, multiple Conns should be instantiated
+// Conn encapsulates all the state needed to perform a request over h2c. Conn is safe for
+// concurrent use. Exactly one caller will initialize the connection, and concurrent callers
+// will wait for it to complete before being sent as separate streams on the same http2 connection
 // Initialization of the connection is lazily performed to allow for the caller to customise
 // the request used to upgrade the connection
 // Instantiating a Conn should be done via Client
 type Conn struct {
-	url        *url.URL
-	dialer     *net.Dialer
-	transport  *http2.Transport
-	maxRetries int
-
-	conn net.Conn
-	h2c  *http2.ClientConn
-
-	init   bool
-	initmu sync.RWMutex
+	url              *url.URL
+	dialer           *net.Dialer
+	resolver         *net.Resolver
+	resolveOverrides map[string]string
+	proxy            *url.URL
+	tlsConfig        *tls.Config
+	upgradeOpts      []UpgradeOption
+	wsOpts           []WebSocketOption
+	transport        *http2.Transport
+	maxRetries       int
+	mode             Mode
+	timeouts         Timeouts
+	har              *HARRecorder
+
+	conn     net.Conn
+	h2c      *http2.ClientConn
+	tlsState *tls.ConnectionState
+	upgrade  *http2.UpgradeResponse
+	result   UpgradeResult
+	timer    connTimer
+
+	init    bool
+	initing chan struct{} // non-nil while an initialization is in flight. closed when it completes
+	initErr error         // the result of the last initialization attempt
+	initmu  sync.RWMutex
 }
 
 // Initialized will return whether this connection has been initialized already
@@ -105,23 +281,137 @@ func (c *Conn) Initialized() bool {
 	return c.init
 }
 
-func (c *Conn) setInitialized() {
+func (c *Conn) setInitialized(conn net.Conn, cc *http2.ClientConn) {
 	log.WithField("url", c.url).Tracef("setting initialized for conn")
 	c.initmu.Lock()
 	defer c.initmu.Unlock()
+	c.conn = conn
+	c.h2c = cc
 	c.init = true
 	log.WithField("url", c.url).Tracef("initilzied set")
+}
+
+// ConnectionState returns the negotiated tls details of the most recent connection to the target.
+// This is available once the connection has been dialed, even if the upgrade failed.
+// nil is returned for http targets
+func (c *Conn) ConnectionState() *tls.ConnectionState {
+	c.initmu.RLock()
+	defer c.initmu.RUnlock()
+	return c.tlsState
+}
+
+// UpgradeResponse returns the raw response to the most recent upgrade request. This is available
+// once a response has been received, even if it wasn't a 101.
+// nil is returned if no upgrade was attempted, e.g. in ModePriorKnowledge
+func (c *Conn) UpgradeResponse() *http2.UpgradeResponse {
+	c.initmu.RLock()
+	defer c.initmu.RUnlock()
+	return c.upgrade
+}
+
+// UpgradeResult returns the classification of the most recent upgrade attempt. See UpgradeResult
+func (c *Conn) UpgradeResult() UpgradeResult {
+	c.initmu.RLock()
+	defer c.initmu.RUnlock()
+	return c.result
+}
 
+// Timing returns the timing breakdown of the connection. See ConnTiming and WithStreamTiming for
+// the timing of each stream
+func (c *Conn) Timing() ConnTiming {
+	var settings time.Time
+	if cc := c.clientConn(); cc != nil {
+		settings = cc.SettingsReceived()
+	}
+	return c.timer.timing(settings)
+}
+
+// clientConn returns the http2 connection. This is only non-nil once initialized
+func (c *Conn) clientConn() *http2.ClientConn {
+	c.initmu.RLock()
+	defer c.initmu.RUnlock()
+	return c.h2c
+}
+
+// usable reports whether the connection is initialized and can take new streams. This is false
+// once a GOAWAY is received or the connection closes
+func (c *Conn) usable() bool {
+	cc := c.clientConn()
+	return cc != nil && !cc.Closing()
+}
+
+// maxConcurrentStreams returns the server's stream limit. Before initialization, only the stream
+// which initializes the connection can be sent
+func (c *Conn) maxConcurrentStreams() int {
+	cc := c.clientConn()
+	if cc == nil {
+		return 1
+	}
+	return int(cc.MaxConcurrentStreams())
+}
+
+// initialize will run fn if no other initialization is in flight. If another caller is
+// initializing the connection, this will wait for it to complete and return its error.
+// If the connection is already initialized, ErrAlreadyInitialized is returned
+func (c *Conn) initialize(ctx context.Context, fn func() (*http.Response, error)) (*http.Response, error) {
+	c.initmu.Lock()
+	if c.init {
+		c.initmu.Unlock()
+		return nil, ErrAlreadyInitialized
+	}
+	if wait := c.initing; wait != nil {
+		c.initmu.Unlock()
+		log.WithField("url", c.url).Tracef("waiting for initialization")
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		c.initmu.RLock()
+		defer c.initmu.RUnlock()
+		if c.init {
+			return nil, ErrAlreadyInitialized
+		}
+		return nil, c.initErr
+	}
+	wait := make(chan struct{})
+	c.initing = wait
+	c.initmu.Unlock()
+
+	res, err := fn()
+
+	c.initmu.Lock()
+	c.initErr = err
+	c.initing = nil
+	close(wait)
+	c.initmu.Unlock()
+	return res, err
+}
+
+// initError returns the error of the last initialization attempt, or nil if the connection is
+// initialized
+func (c *Conn) initError() error {
+	c.initmu.RLock()
+	defer c.initmu.RUnlock()
+	if c.init {
+		return nil
+	}
+	return c.initErr
 }
 
 // Close will close the underlying connections. After this is called, the struct is no
 // longer safe to use
 func (c *Conn) Close() {
-	if c.h2c != nil {
-		c.h2c.Close()
+	c.initmu.RLock()
+	cc, conn := c.h2c, c.conn
+	c.initmu.RUnlock()
+
+	if cc != nil {
+		cc.Close()
 	}
-	if c.conn != nil {
-		c.conn.Close()
+	if conn != nil {
+		conn.Close()
 	}
 }
 
@@ -144,6 +434,14 @@ type UpgradeOptions struct {
 	ConnectionHeaderDisabled    bool
 	HTTP2SettingsHeaderDisabled bool
 	UpgradeHeaderDisabled       bool
+
+	// Headers, if set, are raw header lines sent in place of the Connection, Upgrade and
+	// HTTP2-Settings headers. These are written verbatim. See UpgradeVariant
+	Headers []string
+
+	// Template, if set, will be sent verbatim as the upgrade request instead of the
+	// provided request. All other header options are ignored. See UpgradeTemplate
+	Template UpgradeTemplate
 }
 
 func DisableHTTP2SettingsHeader(val bool) UpgradeOption {
@@ -182,69 +480,187 @@ func SetConnectionHeader(val string) UpgradeOption {
 	}
 }
 
-var (
-	ErrUnexpectedScheme = errors.New("Unexpected scheme for connection")
-)
+func SetUpgradeHeaders(lines []string) UpgradeOption {
+	return func(o *UpgradeOptions) {
+		o.Headers = lines
+	}
+}
 
-// CreateConn will create a net.Conn from the URL. This will choose between a tls
-// and a normal tcp connection based on the url scheme
-func CreateConn(t *url.URL, dialer *net.Dialer) (ret net.Conn, err error) {
-	switch t.Scheme {
-	case "https":
-		hostport := t.Host
-		if t.Port() == "" {
-			hostport = fmt.Sprintf("%s:%d", t.Host, 443)
-		}
+func SetUpgradeTemplate(tpl UpgradeTemplate) UpgradeOption {
+	return func(o *UpgradeOptions) {
+		o.Template = tpl
+	}
+}
 
-		log.Tracef("establishing tls conn on: %v", hostport)
-		tlsconn, err := tls.DialWithDialer(dialer, "tcp", hostport, &tls.Config{
-			InsecureSkipVerify: true,
-		})
-		if err != nil {
-			return nil, errors.Wrap(err, "Failed to dial tls")
-		}
-		ret = tlsconn
-	case "http":
-		hostport := t.Host
-		if t.Port() == "" {
-			hostport = fmt.Sprintf("%s:%d", t.Host, 80)
-		}
-		log.Tracef("establishing tcp conn on: %v", hostport)
-		ret, err = dialer.Dial("tcp", hostport)
-		if err != nil {
-			return nil, errors.Wrap(err, "Failed to dial tcp")
-		}
-	default:
-		return nil, ErrUnexpectedScheme
+// dial will create the underlying connection to the target
+func (c *Conn) dial(ctx context.Context) (net.Conn, error) {
+	c.timer.dialStart()
+	ctx = httptrace.WithClientTrace(ctx, c.timer.dialTrace())
+	conn, err := CreateConnContext(ctx, c.url, c.dialer,
+		DialProxy(c.proxy),
+		DialResolveOverrides(c.resolveOverrides),
+		DialTimeout(c.timeouts.Dial),
+		DialTLSConfig(c.tlsConfig),
+		DialTLSHandshakeTimeout(c.timeouts.TLSHandshake),
+	)
+	if err != nil {
+		return nil, err
+	}
+	c.timer.dialDone()
+
+	if tlsconn, ok := conn.(*tls.Conn); ok {
+		state := tlsconn.ConnectionState()
+		c.initmu.Lock()
+		c.tlsState = &state
+		c.initmu.Unlock()
 	}
-	return
+	return conn, nil
 }
 
 // doUpgrade will attempt to establish a TCP connection and perform the Upgrade Request
 // This will then recieve the response from the upgraded request and return it to the caller
-// This may fail due to unexpected EOF, hence retries are handled at DoUpgrade
-func (c *Conn) doUpgrade(req *http.Request) (*http.Response, error) {
+// This may fail due to unexpected EOF, hence retries are handled at UpgradeContext
+// raw is the upgrade request written to the connection, and must describe req
+func (c *Conn) doUpgrade(ctx context.Context, req *http.Request, raw []byte) (*http.Response, error) {
 	log.Tracef("starting doUpgrade internal")
-	var err error
 	log.Tracef("establishing tcp conn")
 	log.WithFields(log.Fields{
 		"headers": req.Header,
 	}).Tracef("performing upgrade request")
 
-	c.conn, err = CreateConn(c.url, c.dialer)
+	conn, err := c.dial(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "h2csmuggler: connection failed")
 	}
 
-	cc, res, err := c.transport.H2CUpgradeRequest(req, c.conn)
+	var (
+		cc  *http2.ClientConn
+		res *http.Response
+	)
+	// once the upgrade is accepted, the first stream is bound by the response header timeout
+	// like any other stream
+	var switched int32
+	in := newInterrupter(ctx, conn, c.timeouts.Upgrade)
+	tctx := httptrace.WithClientTrace(req.Context(), c.timer.upgradeTrace())
+	tctx = httptrace.WithClientTrace(tctx, &httptrace.ClientTrace{
+		Got1xxResponse: func(int, textproto.MIMEHeader) error {
+			atomic.StoreInt32(&switched, 1)
+			in.next(c.timeouts.ResponseHeader)
+			return nil
+		},
+	})
+	req = req.WithContext(tctx)
+	c.timer.startUpgrade()
+	cc, res, err = c.transport.H2CUpgradeRawRequest(req, raw, conn)
+	in.stop()
+
+	var (
+		upgrade *http2.UpgradeResponse
+		uscErr  http2.UnexpectedStatusCodeError
+		noH2Err http2.NoH2Error
+	)
+	switch {
+	case cc != nil:
+		upgrade = cc.UpgradeResponse()
+	case errors.As(err, &uscErr):
+		upgrade = uscErr.Response
+	case errors.As(err, &noH2Err):
+		upgrade = noH2Err.Response
+	}
+	if upgrade != nil {
+		c.initmu.Lock()
+		c.upgrade = upgrade
+		c.result = ClassifyUpgrade(err)
+		c.initmu.Unlock()
+
+		if c.har != nil {
+			e := newUpgradeHAREntry(req, raw, upgrade, c.timer.timing(time.Time{}))
+			setHARConn(&e, conn)
+			c.har.Add(e)
+		}
+	}
+
 	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var ne net.Error
+		if upgrade == nil && errors.As(err, &ne) && ne.Timeout() {
+			if atomic.LoadInt32(&switched) == 1 {
+				return nil, ErrResponseHeaderTimeout
+			}
+			return nil, ErrUpgradeTimeout
+		}
 		return nil, errors.Wrap(err, "h2csmuggler: upgrade failed")
 	}
-	c.h2c = cc
-	c.setInitialized()
+	c.setInitialized(conn, cc)
+	return res, nil
+}
+
+// roundTrip will send the request as a new stream on the initialized connection
+// enforcing the response header and body timeouts
+func (c *Conn) roundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	trace, st := c.timer.streamTrace(req.URL.String())
+	ctx = httptrace.WithClientTrace(ctx, trace)
+	var timedOut int32
+	if d := c.timeouts.ResponseHeader; d != 0 {
+		timer := time.AfterFunc(d, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			cancel()
+		})
+		defer timer.Stop()
+	}
+
+	if c.har != nil {
+		req = withSentBody(req)
+	}
+	res, err := c.clientConn().RoundTrip(req.WithContext(ctx))
+	reportStream(ctx, c.timer.stream(st))
+	if err != nil {
+		cancel()
+		if atomic.LoadInt32(&timedOut) == 1 {
+			err = ErrResponseHeaderTimeout
+		}
+		c.recordError(req, err, st)
+		return nil, err
+	}
+	res.Body = newTimeoutBody(res.Body, c.timeouts.ResponseBody, cancel)
+	c.recordStream(req, res, st)
 	return res, nil
 }
 
+// recordStream will add the stream to the HAR once its body has been read, if recording
+func (c *Conn) recordStream(req *http.Request, res *http.Response, st *StreamTiming) {
+	if c.har == nil {
+		return
+	}
+	c.initmu.RLock()
+	conn := c.conn
+	c.initmu.RUnlock()
+
+	res.Body = newHARBody(res.Body, func(body []byte, size int) {
+		e := newHAREntry(TransportH2C, req, res, body, size, c.timer.stream(st), time.Now())
+		setHARConn(&e, conn)
+		c.har.Add(e)
+	})
+}
+
+// recordError will add the stream which failed with err to the HAR, if recording
+func (c *Conn) recordError(req *http.Request, err error, st *StreamTiming) {
+	if c.har == nil {
+		return
+	}
+	c.initmu.RLock()
+	conn := c.conn
+	c.initmu.RUnlock()
+
+	e := newErrorHAREntry(TransportH2C, req, err, c.timer.stream(st), time.Now())
+	setHARConn(&e, conn)
+	c.har.Add(e)
+}
+
 // DoUpgrade will perform the request and upgrade the connection to http2 h2c.
 // DoUpgrade can only be successfully called once. If called a second time, this will raise an error
 // If unsuccessfully called, it can be called again, however its likely the same connection error
@@ -254,11 +670,17 @@ func (c *Conn) doUpgrade(req *http.Request) (*http.Response, error) {
 // HTTP2-Settings: AAMAAABkAARAAAAAAAIAAAAA
 // Connection: Upgrade
 // These can be modified with the upgrade options however this may result in an unsuccessful connection
-// TODO: make this threadsafe.
+// If another caller is already upgrading the connection, this will wait for it to complete
 func (c *Conn) DoUpgrade(req *http.Request, opts ...UpgradeOption) (*http.Response, error) {
+	return c.UpgradeContext(req.Context(), req, opts...)
+}
+
+// UpgradeContext is DoUpgrade with a context. The context bounds the dial, the upgrade and the
+// response headers. Cancelling it after the upgrade completes will cancel the response body
+func (c *Conn) UpgradeContext(ctx context.Context, req *http.Request, opts ...UpgradeOption) (*http.Response, error) {
 	log.Tracef("starting upgrade")
 	if c.Initialized() {
-		return nil, errors.New("h2csmuggler: already initialized")
+		return nil, ErrAlreadyInitialized
 	}
 
 	o := &UpgradeOptions{
@@ -266,12 +688,19 @@ func (c *Conn) DoUpgrade(req *http.Request, opts ...UpgradeOption) (*http.Respon
 		ConnectionHeader:    DefaultConnectionHeader,
 		UpgradeHeader:       DefaultUpgradeHeader,
 	}
+	for _, opt := range c.upgradeOpts {
+		opt(o)
+	}
 	for _, opt := range opts {
 		opt(o)
 	}
 
-	// Clone to avoid corrupting the request after we add our headers
-	req = req.Clone(req.Context())
+	// Clone to avoid corrupting the request after we add our headers.
+	// The stream context lets us enforce the body timeout on the first response
+	streamCtx, cancel := context.WithCancel(ctx)
+	trace, st := c.timer.streamTrace(req.URL.String())
+	streamCtx = httptrace.WithClientTrace(streamCtx, trace)
+	req = req.Clone(streamCtx)
 	if o.UpgradeHeaderDisabled {
 		req.Header.Del("Upgrade")
 	} else {
@@ -279,7 +708,7 @@ func (c *Conn) DoUpgrade(req *http.Request, opts ...UpgradeOption) (*http.Respon
 	}
 
 	if o.ConnectionHeaderDisabled {
-		req.Header.Del("Connnection")
+		req.Header.Del("Connection")
 	} else {
 		req.Header.Add("Connection", o.ConnectionHeader)
 	}
@@ -290,36 +719,132 @@ func (c *Conn) DoUpgrade(req *http.Request, opts ...UpgradeOption) (*http.Respon
 		req.Header.Add("HTTP2-Settings", o.HTTP2SettingsHeader)
 	}
 
-	var (
-		res *http.Response
-		err error
-	)
+	var raw []byte
+	switch {
+	case o.Template != nil:
+		raw = o.Template.Render(req, o.HTTP2SettingsHeader)
+	case o.Headers != nil:
+		var err error
+		raw, err = renderUpgradeHeaders(req, o.Headers, o.HTTP2SettingsHeader)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+	default:
+		var err error
+		raw, err = httputil.DumpRequestOut(req, true)
+		if err != nil {
+			cancel()
+			return nil, errors.Wrap(err, "failed to dump http body")
+		}
+	}
 
-	for i := 0; i < c.maxRetries+1; i++ {
-		log.Tracef("attempt: %d/%d", i, c.maxRetries+1)
-		res, err = c.doUpgrade(req)
-		if err == nil {
-			break
+	res, err := c.initialize(ctx, func() (*http.Response, error) {
+		var (
+			res *http.Response
+			err error
+		)
+
+		for i := 0; i < c.maxRetries+1; i++ {
+			log.Tracef("attempt: %d/%d", i, c.maxRetries+1)
+			res, err = c.doUpgrade(streamCtx, req, raw)
+			if err == nil {
+				break
+			}
+			var noH2Err http2.NoH2Error
+			if err != nil && (!errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &noH2Err)) {
+				log.WithError(err).Tracef("recieved error")
+				return nil, err
+			}
 		}
-		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
-			log.WithError(err).Tracef("recieved error")
+		if err != nil {
 			return nil, err
 		}
-		if c.conn != nil {
-			c.conn.Close()
+
+		return res, nil
+	})
+	reportStream(streamCtx, c.timer.stream(st))
+	if err != nil {
+		cancel()
+		if !errors.Is(err, ErrAlreadyInitialized) {
+			c.recordError(req, err, st)
 		}
+		return nil, err
+	}
+	res.Body = newTimeoutBody(res.Body, c.timeouts.ResponseBody, cancel)
+	c.recordStream(req, res, st)
+	return res, nil
+}
+
+// DoPriorKnowledge will establish the connection and immediately send the http2 client preface
+// without an upgrade request. The provided request is then sent as the first stream.
+// This is used when the edge passes the raw tcp or tls stream straight to a h2c backend.
+// DoPriorKnowledge can only be successfully called once. If called a second time, this will raise an error
+// If another caller is already initializing the connection, this will wait for it to complete
+func (c *Conn) DoPriorKnowledge(req *http.Request) (*http.Response, error) {
+	return c.PriorKnowledgeContext(req.Context(), req)
+}
+
+// PriorKnowledgeContext is DoPriorKnowledge with a context
+func (c *Conn) PriorKnowledgeContext(ctx context.Context, req *http.Request) (*http.Response, error) {
+	log.Tracef("starting prior knowledge")
+	if c.Initialized() {
+		return nil, ErrAlreadyInitialized
 	}
+
+	start := time.Now()
+	_, err := c.initialize(ctx, func() (*http.Response, error) {
+		conn, err := c.dial(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "h2csmuggler: connection failed")
+		}
+
+		cc, err := c.transport.NewClientConn(conn)
+		if err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "h2csmuggler: prior knowledge failed")
+		}
+		c.setInitialized(conn, cc)
+		return nil, nil
+	})
 	if err != nil {
+		if !errors.Is(err, ErrAlreadyInitialized) {
+			c.recordError(req, err, &StreamTiming{URL: req.URL.String(), Start: start})
+		}
 		return nil, err
 	}
 
-	return res, nil
+	// no response is tied to initialization, so waiters can be released before our first stream
+	return c.roundTrip(req.WithContext(ctx))
 }
 
+// Do will perform the request over the h2c connection. The first call will initialize
+// the connection based on the connection mode. Concurrent calls made while the connection
+// is initializing will wait, and then be sent as their own stream
 func (c *Conn) Do(req *http.Request) (*http.Response, error) {
+	return c.DoContext(req.Context(), req)
+}
+
+// DoContext is Do with a context. Cancelling the context will cancel the stream, and the
+// initialization of the connection if it is in flight
+func (c *Conn) DoContext(ctx context.Context, req *http.Request) (*http.Response, error) {
 	if !c.Initialized() {
-		return c.DoUpgrade(req)
+		var (
+			res *http.Response
+			err error
+		)
+		switch c.mode {
+		case ModeUpgrade:
+			res, err = c.UpgradeContext(ctx, req)
+		case ModePriorKnowledge:
+			res, err = c.PriorKnowledgeContext(ctx, req)
+		default:
+			return nil, ErrUnexpectedMode
+		}
+		if !errors.Is(err, ErrAlreadyInitialized) {
+			return res, err
+		}
 	}
 
-	return c.h2c.RoundTrip(req)
+	return c.roundTrip(req.WithContext(ctx))
 }
@@ -0,0 +1,324 @@
+package h2csmuggler
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/minight/h2csmuggler/h2c"
+	h2 "github.com/minight/h2csmuggler/http2"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+)
+
+// newH2CServer will create a h2c backend which counts the number of upgrade requests received
+func newH2CServer(upgrades *int32) *httptest.Server {
+	h := h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Proto, r.URL.Path)
+	}), &http2.Server{})
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "h2c" {
+			atomic.AddInt32(upgrades, 1)
+		}
+		h.ServeHTTP(w, r)
+	}))
+}
+
+func TestConn_DoConcurrent(t *testing.T) {
+	tests := []struct {
+		name         string
+		mode         Mode
+		wantUpgrades int32
+	}{
+		{name: "upgrade", mode: ModeUpgrade, wantUpgrades: 1},
+		{name: "prior knowledge", mode: ModePriorKnowledge, wantUpgrades: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var upgrades int32
+			srv := newH2CServer(&upgrades)
+			defer srv.Close()
+
+			c, err := NewConn(srv.URL, ConnectionMode(tt.mode))
+			if err != nil {
+				t.Fatalf("NewConn() error = %v", err)
+			}
+			defer c.Close()
+
+			var wg sync.WaitGroup
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					path := fmt.Sprintf("/%d", i)
+					req, err := http.NewRequest("GET", srv.URL+path, nil)
+					if err != nil {
+						t.Errorf("NewRequest() error = %v", err)
+						return
+					}
+					res, err := c.Do(req)
+					if err != nil {
+						t.Errorf("Conn.Do() error = %v", err)
+						return
+					}
+					defer res.Body.Close()
+					body, err := ioutil.ReadAll(res.Body)
+					if err != nil {
+						t.Errorf("body read error = %v", err)
+						return
+					}
+					if want := "HTTP/2.0 " + path; string(body) != want {
+						t.Errorf("Conn.Do() body = %q, want %q", body, want)
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			if got := atomic.LoadInt32(&upgrades); got != tt.wantUpgrades {
+				t.Errorf("upgrades = %v, want %v", got, tt.wantUpgrades)
+			}
+		})
+	}
+}
+
+func TestConn_Timeouts(t *testing.T) {
+	// a backend which never responds to anything
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	slow := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(time.Second)
+		}
+	}), &http2.Server{}))
+	defer slow.Close()
+
+	timeouts := MaxTimeouts(time.Millisecond * time.Duration(200))
+	tests := []struct {
+		name    string
+		target  string
+		paths   []string
+		wantErr error
+	}{
+		{name: "upgrade", target: "http://" + silent.Addr().String(), paths: []string{"/"}, wantErr: ErrUpgradeTimeout},
+		{name: "response header", target: slow.URL, paths: []string{"/", "/slow"}, wantErr: ErrResponseHeaderTimeout},
+		{name: "response header on upgrade", target: slow.URL, paths: []string{"/slow"}, wantErr: ErrResponseHeaderTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewConn(tt.target, ConnectionTimeouts(timeouts))
+			if err != nil {
+				t.Fatalf("NewConn() error = %v", err)
+			}
+			defer c.Close()
+
+			for _, p := range tt.paths {
+				req, err := http.NewRequest("GET", tt.target+p, nil)
+				if err != nil {
+					t.Fatalf("NewRequest() error = %v", err)
+				}
+				var res *http.Response
+				res, err = c.Do(req)
+				if err == nil {
+					res.Body.Close()
+					continue
+				}
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Conn.Do() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			t.Errorf("Conn.Do() error = nil, want %v", tt.wantErr)
+		})
+	}
+}
+
+func TestConn_DoContextCancel(t *testing.T) {
+	slow := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	}), &http2.Server{}))
+	defer slow.Close()
+
+	c, err := NewConn(slow.URL)
+	if err != nil {
+		t.Fatalf("NewConn() error = %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(100))
+	defer cancel()
+	req, err := http.NewRequest("GET", slow.URL, nil)
+	if err != nil {
+		t.Fatalf("NewRequest() error = %v", err)
+	}
+	if _, err := c.DoContext(ctx, req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Conn.DoContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestConn_UpgradeResponse(t *testing.T) {
+	var upgrades int32
+	h2cSrv := newH2CServer(&upgrades)
+	defer h2cSrv.Close()
+
+	edgeSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "edge")
+		fmt.Fprint(w, "no upgrade")
+	}))
+	defer edgeSrv.Close()
+
+	tests := []struct {
+		name       string
+		url        string
+		wantStatus int
+		wantHeader [2]string
+		wantBody   string
+		wantErr    bool
+	}{
+		{name: "upgraded", url: h2cSrv.URL, wantStatus: 101, wantHeader: [2]string{"upgrade", "h2c"}},
+		{name: "not upgraded", url: edgeSrv.URL, wantStatus: 200, wantHeader: [2]string{"Server", "edge"}, wantBody: "no upgrade", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewConn(tt.url)
+			if err != nil {
+				t.Fatalf("NewConn() error = %v", err)
+			}
+			defer c.Close()
+
+			req, err := http.NewRequest("GET", tt.url, nil)
+			if err != nil {
+				t.Fatalf("NewRequest() error = %v", err)
+			}
+			res, err := c.Do(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Conn.Do() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if res != nil {
+				res.Body.Close()
+			}
+
+			got := c.UpgradeResponse()
+			if got == nil {
+				t.Fatalf("Conn.UpgradeResponse() = nil")
+			}
+			if tt.wantErr {
+				var uscErr h2.UnexpectedStatusCodeError
+				if !errors.As(err, &uscErr) || uscErr.Response != got {
+					t.Errorf("Conn.Do() error = %v, want UnexpectedStatusCodeError with the upgrade response", err)
+				}
+			}
+			if got.StatusCode != tt.wantStatus {
+				t.Errorf("UpgradeResponse.StatusCode = %v, want %v", got.StatusCode, tt.wantStatus)
+			}
+			if v := got.Header(tt.wantHeader[0]); v != tt.wantHeader[1] {
+				t.Errorf("UpgradeResponse.Header(%q) = %q, want %q", tt.wantHeader[0], v, tt.wantHeader[1])
+			}
+			if got.Body != tt.wantBody {
+				t.Errorf("UpgradeResponse.Body = %q, want %q", got.Body, tt.wantBody)
+			}
+		})
+	}
+}
+
+// newFakeUpgradeServer will accept an upgrade with a 101 and then write after to the connection
+// instead of speaking http2. The connection is held open until the test completes
+func newFakeUpgradeServer(t *testing.T, after string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+		l.Close()
+	})
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(c)); err != nil {
+					return
+				}
+				io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"+after)
+				if after == "" {
+					<-done
+				}
+			}(c)
+		}
+	}()
+	return "http://" + l.Addr().String()
+}
+
+func TestConn_UpgradeResult(t *testing.T) {
+	var upgrades int32
+	h2cSrv := newH2CServer(&upgrades)
+	defer h2cSrv.Close()
+
+	edgeSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer edgeSrv.Close()
+
+	tests := []struct {
+		name string
+		url  string
+		want UpgradeResult
+	}{
+		{name: "confirmed", url: h2cSrv.URL, want: UpgradeConfirmed},
+		{name: "refused", url: edgeSrv.URL, want: UpgradeRefused},
+		{name: "silent after 101", url: newFakeUpgradeServer(t, ""), want: UpgradeNoH2},
+		{name: "http/1.1 after 101", url: newFakeUpgradeServer(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"), want: UpgradeNoH2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timeouts := DefaultTimeouts
+			timeouts.Upgrade = time.Millisecond * time.Duration(500)
+			c, err := NewConn(tt.url, ConnectionTimeouts(timeouts))
+			if err != nil {
+				t.Fatalf("NewConn() error = %v", err)
+			}
+			defer c.Close()
+
+			req, err := http.NewRequest("GET", tt.url, nil)
+			if err != nil {
+				t.Fatalf("NewRequest() error = %v", err)
+			}
+			res, err := c.Do(req)
+			if res != nil {
+				res.Body.Close()
+			}
+			if got := ClassifyUpgrade(err); got != tt.want {
+				t.Errorf("ClassifyUpgrade() = %v, want %v. err = %v", got, tt.want, err)
+			}
+			if got := c.UpgradeResult(); got != tt.want {
+				t.Errorf("Conn.UpgradeResult() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,17 +1,20 @@
 package cmd
 
 import (
-	"bufio"
-	"os"
+	"fmt"
+	"strings"
 
-	"github.com/minight/h2csmuggler/internal/parallel"
+	"github.com/minight/h2csmuggler"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 var (
 	concurrency = 5
 	infile      = ""
+	modes       = []string{}
+	variants    = []string{}
 )
 
 // checkCmd represents the check command
@@ -22,45 +25,59 @@ var checkCmd = &cobra.Command{
 and attempts to upgrade the connection to http2. The request is then replicated
 over http2 and the results are compared
 
+Each target is probed with both the upgrade and prior-knowledge modes by default.
+The mode which reached the backend is reported on each result.
+
+Use --variant to try alternate Connection, Upgrade and HTTP2-Settings header combinations
+in the upgrade mode. "all" will try every variant. Additional variants can be defined
+under the "variants" key of the config file, e.g.
+
+variants:
+  - name: tab-separated
+    headers:
+      - "Upgrade:\th2c"
+      - "HTTP2-Settings: {{settings}}"
+      - "Connection: Upgrade, HTTP2-Settings"
+
 use "-" as first argument to recieve from stdin.
 If infile is specified, then that will override CLI arguments.
-Each target will have a separate connection opened. There is no optimization for batching paths to same host:port combinations`,
+Use --dedupe to skip repeated targets and --ordered to log results in the order of the targets.
+Targets which share a scheme, host and port reuse the same h2c connection once it is upgraded.
+Each upgrade variant has its own connection`,
 	Args: cobra.MinimumNArgs(0),
 	Run: func(cmd *cobra.Command, args []string) {
-		lines := make([]string, 0)
-		if infile != "" {
-			log.WithField("filename", infile).Debugf("loading from infile")
-			file, err := os.Open(infile)
-			if err != nil {
-				log.Fatal(err)
-			}
-			defer file.Close()
+		ctx, cancel := newContext()
+		defer cancel()
+		targets, readErr := readTargets(ctx, args)
 
-			scanner := bufio.NewScanner(file)
-			for scanner.Scan() {
-				lines = append(lines, scanner.Text())
-			}
-			if err := scanner.Err(); err != nil {
-				log.Fatal(err)
+		var err error
+		c := newClient(cmd)
+		defer c.Close()
+		c.MaxParallelHosts = concurrency
+		c.Ordered = ordered
+		for _, m := range modes {
+			mode, err := h2csmuggler.ParseMode(m)
+			if err != nil {
+				log.WithError(err).Fatalf("invalid mode: %v", m)
 			}
-		} else {
-			if len(args) == 0 {
-				log.Fatalf("no infile specified and no arguments provided.")
+			c.Modes = append(c.Modes, mode)
+		}
+		if len(variants) > 0 {
+			known := h2csmuggler.DefaultUpgradeVariants
+			var custom []h2csmuggler.UpgradeVariant
+			if err := viper.UnmarshalKey("variants", &custom); err != nil {
+				log.WithError(err).Fatalf("invalid variants in config")
 			}
-			if args[0] == "-" {
-				scanner := bufio.NewScanner(os.Stdin)
-				for scanner.Scan() {
-					line := scanner.Text()
-					lines = append(lines, line)
-				}
-			} else {
-				lines = args
+			known = append(known[:len(known):len(known)], custom...)
+
+			c.Variants, err = h2csmuggler.FindUpgradeVariants(known, variants)
+			if err != nil {
+				log.WithError(err).Fatalf("invalid variant")
 			}
 		}
-
-		c := parallel.New()
-		c.MaxParallelHosts = concurrency
-		err := c.GetParallelHosts(lines)
+		err = c.GetParallelHostStreamContext(ctx, targets)
+		writeHAR(c)
+		logReadErr(readErr)
 		if err != nil {
 			log.WithError(err).Errorf("failed")
 		}
@@ -80,5 +97,13 @@ func init() {
 	// is called directly, e.g.:
 	checkCmd.Flags().IntVarP(&concurrency, "concurrency", "c", 10, "Number of concurrent threads to use")
 	checkCmd.Flags().StringVarP(&infile, "infile", "i", "", "input file to read from")
-
+	checkCmd.Flags().BoolVar(&dedupe, "dedupe", false, "skip targets which were already read. every target is held in memory to do so")
+	checkCmd.Flags().BoolVar(&ordered, "ordered", false, "log results in the order of the targets, holding results which complete early")
+	checkCmd.Flags().StringSliceVar(&modes, "mode", []string{"upgrade", "prior-knowledge"}, "connection modes to probe. upgrade, prior-knowledge or websocket")
+	variantNames := []string{}
+	for _, v := range h2csmuggler.DefaultUpgradeVariants {
+		variantNames = append(variantNames, v.Name)
+	}
+	checkCmd.Flags().StringSliceVar(&variants, "variant", []string{}, fmt.Sprintf("upgrade header variants to probe. all or any of: %s", strings.Join(variantNames, ", ")))
+	addConnectionFlags(checkCmd)
 }
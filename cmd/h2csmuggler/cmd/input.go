@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"context"
+	"os"
+
+	"github.com/minight/h2csmuggler/internal/parallel"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	dedupe  = false
+	ordered = false
+)
+
+// readTargets streams the targets from the infile, from stdin if the first argument is -, or the
+// arguments themselves. See parallel.LineReader. The returned func reports whether reading failed,
+// once the channel is closed
+func readTargets(ctx context.Context, args []string) (<-chan string, func() error) {
+	var targets <-chan string
+	readErr := func() error { return nil }
+	switch {
+	case infile != "":
+		log.WithField("filename", infile).Debugf("loading from infile")
+		file, err := os.Open(infile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		lines := parallel.ReadLines(ctx, file)
+		targets, readErr = lines.C, func() error {
+			file.Close()
+			return lines.Err()
+		}
+	case len(args) == 0:
+		log.Fatalf("no infile specified and no targets provided.")
+	case args[0] == "-":
+		lines := parallel.ReadLines(ctx, os.Stdin)
+		targets, readErr = lines.C, lines.Err
+	default:
+		targets = parallel.Targets(ctx, args)
+	}
+
+	if dedupe {
+		targets = parallel.Unique(ctx, targets)
+	}
+	return targets, readErr
+}
+
+// logReadErr will log the error from reading the targets, if any
+func logReadErr(readErr func() error) {
+	if err := readErr(); err != nil {
+		log.WithError(err).Errorf("failed to read targets")
+	}
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/minight/h2csmuggler/internal/parallel"
+	"github.com/spf13/cobra"
+)
+
+var (
+	matchers   = map[string]*string{}
+	filters    = map[string]*string{}
+	matchMode  = "or"
+	filterMode = "or"
+
+	autoCalibrate = false
+)
+
+// matchFlags maps the ffuf style flag suffix to the kind of matcher
+var matchFlags = []struct {
+	suffix string
+	kind   string
+	help   string
+}{
+	{suffix: "c", kind: parallel.MatchKindStatus, help: "status codes. e.g. 200-299,301 or all"},
+	{suffix: "s", kind: parallel.MatchKindSize, help: "body sizes in bytes. e.g. 0-100,4242"},
+	{suffix: "w", kind: parallel.MatchKindWords, help: "body word counts. e.g. 10-20"},
+	{suffix: "l", kind: parallel.MatchKindLines, help: "body line counts. e.g. 1,5-10"},
+	{suffix: "r", kind: parallel.MatchKindRegexp, help: "regular expression on the body"},
+	{suffix: "h", kind: parallel.MatchKindHeader, help: "regular expression on each 'Name: value' header"},
+	{suffix: "t", kind: parallel.MatchKindTime, help: "response time in milliseconds or a duration. e.g. >500 or <1s"},
+}
+
+// addMatchFlags will add the matcher and filter flags to the command
+func addMatchFlags(cmd *cobra.Command) {
+	for _, f := range matchFlags {
+		if matchers[f.kind] == nil {
+			matchers[f.kind] = new(string)
+			filters[f.kind] = new(string)
+		}
+		cmd.Flags().StringVar(matchers[f.kind], "m"+f.suffix, "", "only show results matching the "+f.help)
+		cmd.Flags().StringVar(filters[f.kind], "f"+f.suffix, "", "hide results matching the "+f.help)
+	}
+	cmd.Flags().StringVar(&matchMode, "match-mode", "or", "how to combine the matchers. and or or")
+	cmd.Flags().StringVar(&filterMode, "filter-mode", "or", "how to combine the filters. and or or")
+}
+
+// addCalibrateFlags will add the auto calibration flag to the command
+func addCalibrateFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&autoCalibrate, "ac", false, "auto calibrate. once the first response arrives, send random paths through the tunnel and hide results which look like them. not supported with spec, wordlist or compare")
+}
+
+// matchOptions returns the options which apply the matcher, filter and calibration flags
+func matchOptions() ([]parallel.ParallelOption, error) {
+	match, err := combineMatchers(matchers, matchMode)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := combineMatchers(filters, filterMode)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []parallel.ParallelOption{}
+	if autoCalibrate {
+		opts = append(opts, parallel.AutoCalibrate())
+	}
+	if match != nil {
+		opts = append(opts, parallel.ResultMatcher(match))
+	}
+	if filter != nil {
+		opts = append(opts, parallel.ResultFilter(filter))
+	}
+	return opts, nil
+}
+
+// combineMatchers will parse the flags which were set, and combine them with mode.
+// nil is returned if none were set
+func combineMatchers(flags map[string]*string, mode string) (parallel.Matcher, error) {
+	ms := []parallel.Matcher{}
+	for _, f := range matchFlags {
+		if *flags[f.kind] == "" {
+			continue
+		}
+		m, err := parallel.ParseMatcher(f.kind, *flags[f.kind])
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	if len(ms) == 0 {
+		return nil, nil
+	}
+
+	switch mode {
+	case "or":
+		return parallel.Or(ms...), nil
+	case "and":
+		return parallel.And(ms...), nil
+	}
+	return nil, fmt.Errorf("invalid mode %q. expected and or or", mode)
+}
@@ -1,12 +1,10 @@
 package cmd
 
 import (
-	"bufio"
+	"context"
 	"fmt"
-	"os"
 
 	"github.com/minight/h2csmuggler/internal/paths"
-	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
@@ -22,45 +20,17 @@ var appendCmd = &cobra.Command{
 and return full URLs. e.g. http://base.com + foo, bar, baz ->
 http://base.com/foo http://base.com/bar http://base.com/baz
 
-You can use '-' as the second argument to pipe from stdin
+You can use '-' as the first argument to pipe from stdin
 you can use infile flag to specify a file to take in as the paths`,
 	Run: func(cmd *cobra.Command, args []string) {
-		domains := make([]string, 0)
-		if infile != "" {
-			log.WithField("filename", infile).Debugf("loading from infile")
-			file, err := os.Open(infile)
-			if err != nil {
-				log.Fatal(err)
+		domains, readErr := readTargets(context.Background(), args)
+		for d := range domains {
+			fmt.Println(d)
+			for _, l := range paths.Prefix([]string{d}, prefix) {
+				fmt.Println(l)
 			}
-			defer file.Close()
-
-			scanner := bufio.NewScanner(file)
-			for scanner.Scan() {
-				domains = append(domains, scanner.Text())
-			}
-			if err := scanner.Err(); err != nil {
-				log.Fatal(err)
-			}
-		} else {
-			if len(args) < 1 {
-				log.Fatalf("no infile specified and no targets provided.")
-			}
-			if args[0] == "-" {
-				scanner := bufio.NewScanner(os.Stdin)
-				for scanner.Scan() {
-					domain := scanner.Text()
-					domains = append(domains, domain)
-				}
-			} else {
-				domains = args[0:]
-			}
-		}
-
-		domains = append(domains, paths.Prefix(domains, prefix)...)
-		for _, l := range domains {
-			fmt.Println(l)
 		}
-
+		logReadErr(readErr)
 	},
 }
 
@@ -77,5 +47,6 @@ func init() {
 	// is called directly, e.g.:
 	// appendCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 	appendCmd.Flags().StringVarP(&infile, "infile", "i", "", "input file to read from")
+	appendCmd.Flags().BoolVar(&dedupe, "dedupe", false, "skip inputs which were already read. every input is held in memory to do so")
 	appendCmd.Flags().StringSliceVarP(&prefix, "prefix", "p", []string{}, "prefix for all the paths. Specifying multiple will cross multiply the results")
 }
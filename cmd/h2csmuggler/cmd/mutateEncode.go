@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/minight/h2csmuggler/internal/paths"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	mutationNames = []string{}
+	extensions    = paths.Extensions
+)
+
+// encodeCmd represents the encode command
+var encodeCmd = &cobra.Command{
+	Use:   "encode <paths>...",
+	Short: "will generate variants of your paths to bypass path based ACLs",
+	Long: `encode will print each path followed by its variants. Paths can also be full URLs,
+in which case only the path is mutated. e.g. /admin ->
+/admin /%61dmin /%2561dmin //admin /admin;x /ADMIN /admin.json ...
+
+The mutations are:
+  encode         percent-encode the first character of each segment, the last segment or the slashes
+  double-encode  the same, percent-encoded twice
+  overlong       the same, as overlong UTF-8. e.g. / -> %C0%AF
+  normalize      doubled slashes, /./, a leading /..;/, ;x on each segment and a trailing dot
+  case           upper case, capitalized segments and each letter of the last segment swapped
+  extensions     each of the extensions appended
+
+You can use '-' as the first argument to pipe from stdin
+you can use infile flag to specify a file to take in as the paths`,
+	Run: func(cmd *cobra.Command, args []string) {
+		muts, err := parseMutations(mutationNames)
+		if err != nil {
+			log.WithError(err).Fatalf("invalid mutation")
+		}
+		lines, readErr := readTargets(context.Background(), args)
+		for l := range lines {
+			variants, err := paths.MutateURL(l, muts...)
+			if err != nil {
+				log.WithField("input", l).WithError(err).Errorf("failed to mutate")
+				continue
+			}
+			fmt.Println(l)
+			for _, v := range variants {
+				fmt.Println(v)
+			}
+		}
+		logReadErr(readErr)
+	},
+}
+
+// parseMutations returns the named mutations, appending the extensions from the extension flag
+func parseMutations(names []string) ([]paths.Mutation, error) {
+	paths.Extensions = extensions
+	return paths.ParseMutations(names)
+}
+
+func init() {
+	mutateCmd.AddCommand(encodeCmd)
+
+	encodeCmd.Flags().StringVarP(&infile, "infile", "i", "", "input file to read from")
+	encodeCmd.Flags().BoolVar(&dedupe, "dedupe", false, "skip inputs which were already read. every input is held in memory to do so")
+	encodeCmd.Flags().StringSliceVarP(&mutationNames, "mutation", "m", []string{"all"}, "mutations to apply. "+strings.Join(paths.MutationNames, ", ")+" or all")
+	encodeCmd.Flags().StringSliceVarP(&extensions, "extension", "e", paths.Extensions, "extensions to append with the extensions mutation")
+}
@@ -1,9 +1,8 @@
 package cmd
 
 import (
-	"bufio"
+	"context"
 	"fmt"
-	"os"
 
 	"github.com/minight/h2csmuggler/internal/paths"
 	log "github.com/sirupsen/logrus"
@@ -22,46 +21,17 @@ You can use '-' as the second argument to pipe from stdin
 you can use infile flag to specify a file to take in as the paths`,
 	Run: func(cmd *cobra.Command, args []string) {
 		base := args[0]
-		lines := make([]string, 0)
-		if infile != "" {
-			log.WithField("filename", infile).Debugf("loading from infile")
-			file, err := os.Open(infile)
+		lines, readErr := readTargets(context.Background(), args[1:])
+		for l := range lines {
+			res, err := paths.Pitchfork(base, append([]string{l}, paths.Prefix(prefix, []string{l})...))
 			if err != nil {
-				log.Fatal(err)
+				log.WithError(err).Fatalf("failed to mutate")
 			}
-			defer file.Close()
-
-			scanner := bufio.NewScanner(file)
-			for scanner.Scan() {
-				lines = append(lines, scanner.Text())
-			}
-			if err := scanner.Err(); err != nil {
-				log.Fatal(err)
-			}
-		} else {
-			if len(args) < 2 {
-				log.Fatalf("no infile specified and no targets provided.")
-			}
-			if args[1] == "-" {
-				scanner := bufio.NewScanner(os.Stdin)
-				for scanner.Scan() {
-					line := scanner.Text()
-					lines = append(lines, line)
-				}
-			} else {
-				lines = args[1:]
+			for _, r := range res {
+				fmt.Println(r)
 			}
 		}
-
-		lines = append(lines, paths.Prefix(prefix, lines)...)
-		res, err := paths.Pitchfork(base, lines)
-		if err != nil {
-			log.WithError(err).Fatalf("failed to mutate")
-		}
-		for _, l := range res {
-			fmt.Println(l)
-		}
-
+		logReadErr(readErr)
 	},
 }
 
@@ -78,5 +48,6 @@ func init() {
 	// is called directly, e.g.:
 	// pitchforkCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 	pitchforkCmd.Flags().StringVarP(&infile, "infile", "i", "", "input file to read from")
+	pitchforkCmd.Flags().BoolVar(&dedupe, "dedupe", false, "skip inputs which were already read. every input is held in memory to do so")
 	pitchforkCmd.Flags().StringSliceVarP(&prefix, "prefix", "p", []string{}, "prefix for all the paths. Specifying multiple will cross multiply the results")
 }
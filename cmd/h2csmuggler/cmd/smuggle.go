@@ -1,11 +1,13 @@
 package cmd
 
 import (
-	"bufio"
+	"fmt"
 	"os"
 	"strings"
 
+	"github.com/minight/h2csmuggler"
 	"github.com/minight/h2csmuggler/internal/parallel"
+	"github.com/minight/h2csmuggler/internal/paths"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -14,6 +16,21 @@ var (
 	headers = []string{}
 	method  = "GET"
 	compare = false
+	mode    = "upgrade"
+
+	maxReconnects  = 0
+	streamWindow   = 0
+	recursionDepth = 0
+	pathMutations  = []string{}
+
+	data = ""
+	form = []string{}
+
+	specFile    = ""
+	resultsFile = ""
+
+	fuzzWordlists = []string{}
+	fuzzMode      = parallel.FuzzClusterBomb
 )
 
 // smuggleCmd represents the smuggle command
@@ -25,63 +42,271 @@ and attempts to upgrade the connection to http2. The request is then replicated
 over http2 and the results are compared
 
 if '-' is the second argument, the smuggled targets will be piped in from stdin
-if infile is specified as an argument, `,
+if infile is specified as an argument, the targets are read from it instead
+
+if spec is specified, each line of the file is a JSON request spec to smuggle. e.g.
+{"id": "admin", "method": "POST", "url": "/admin", ":authority": "internal", "headers": {"X-Role": "admin"}, "body": "a=1", "expect_status": [200]}
+url may be a path, which is resolved against the host. The other flags apply to every spec,
+and the spec takes precedence. A JSON result is written to results for each spec with its id
+
+if wordlist is specified, the second argument is a template. Keywords from the wordlists
+(e.g. -w paths.txt -w hosts.txt:HOST) are replaced anywhere in the url, headers or body, and
+each request is written to results as a spec would be, with the words it was sent with. e.g.
+smuggle https://host/ 'https://host/FUZZ' -H 'Host: HOST' -w paths.txt -w hosts.txt:HOST`,
 	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		base := args[0]
-		lines := make([]string, 0)
-		if infile != "" {
-			log.WithField("filename", infile).Debugf("loading from infile")
-			file, err := os.Open(infile)
-			if err != nil {
-				log.Fatal(err)
-			}
-			defer file.Close()
+		if specFile != "" {
+			smuggleSpecs(cmd, base)
+			return
+		}
+		if len(fuzzWordlists) > 0 {
+			smuggleFuzz(cmd, args)
+			return
+		}
 
-			scanner := bufio.NewScanner(file)
-			for scanner.Scan() {
-				lines = append(lines, scanner.Text())
-			}
-			if err := scanner.Err(); err != nil {
-				log.Fatal(err)
-			}
-		} else {
-			if len(args) < 2 {
-				log.Fatalf("no infile specified and no targets provided.")
-			}
-			if args[1] == "-" {
-				scanner := bufio.NewScanner(os.Stdin)
-				for scanner.Scan() {
-					line := scanner.Text()
-					lines = append(lines, line)
-				}
-			} else {
-				lines = args[1:]
-			}
+		if data == "@-" && len(args) > 1 && args[1] == "-" {
+			log.Fatalf("can't read both the targets and the body from stdin")
+		}
+		if compare {
+			rejectPathOnlyFlags("compare")
 		}
+		opts := smuggleOptions(cmd)
 
-		c := parallel.New()
-		c.MaxConnPerHost = concurrency
+		ctx, cancel := newContext()
+		defer cancel()
+		targets, readErr := readTargets(ctx, args[1:])
 
-		hs := parseHeaders(headers)
-		opts := []parallel.ParallelOption{}
-		for _, h := range hs {
-			opts = append(opts, parallel.RequestHeader(h.key, h.value))
-		}
-		opts = append(opts, parallel.RequestMethod(method))
+		c := newSmuggleClient(cmd)
+		defer c.Close()
 
 		var err error
 		if !compare {
-			err = c.GetPathsOnHost(base, lines, opts...)
+			err = c.GetPathStreamOnHostContext(ctx, base, targets, opts...)
 		} else {
-			err = c.GetPathDiffOnHost(base, lines, opts...)
+			err = c.GetPathDiffStreamOnHostContext(ctx, base, targets, opts...)
 		}
+		writeHAR(c)
+		logReadErr(readErr)
 		if err != nil {
 			log.WithError(err).Errorf("failed")
 		}
 	},
 }
 
+// smuggleSpecs will smuggle the requests in the spec file to base, writing the results to the results file
+func smuggleSpecs(cmd *cobra.Command, base string) {
+	if compare {
+		log.Fatalf("compare can't be used with a spec file")
+	}
+	rejectPathOnlyFlags("a spec file")
+
+	in := os.Stdin
+	if specFile != "-" {
+		f, err := os.Open(specFile)
+		if err != nil {
+			log.WithError(err).Fatalf("failed to open spec file")
+		}
+		defer f.Close()
+		in = f
+	} else if data == "@-" {
+		log.Fatalf("can't read both the specs and the body from stdin")
+	}
+
+	out, closeResults := openResults()
+	defer closeResults()
+
+	ctx, cancel := newContext()
+	defer cancel()
+
+	// specs are sent as they're read, so an invalid spec only ends the run once the specs
+	// before it are done
+	specs := parallel.ReadRequestSpecs(ctx, in)
+	c := newSmuggleClient(cmd)
+	defer c.Close()
+	err := c.GetSpecStreamOnHostContext(ctx, base, specs.C, out, smuggleOptions(cmd)...)
+	writeHAR(c)
+	if err := specs.Err(); err != nil {
+		log.WithError(err).Errorf("invalid spec file")
+	}
+	if err != nil {
+		log.WithError(err).Errorf("failed")
+	}
+}
+
+// smuggleFuzz will smuggle the requests generated from the template in args[1] and the
+// wordlists to args[0], writing the results to the results file
+func smuggleFuzz(cmd *cobra.Command, args []string) {
+	switch {
+	case compare:
+		log.Fatalf("compare can't be used with a wordlist")
+	case len(args) != 2:
+		log.Fatalf("expected a single template to fuzz")
+	case len(form) > 0:
+		log.Fatalf("form can't be used with a wordlist. use data instead")
+	}
+	rejectPathOnlyFlags("a wordlist")
+	// the template carries the request, so only the matchers and filters apply to the run
+	mopts, err := matchOptions()
+	if err != nil {
+		log.WithError(err).Fatalf("invalid matcher")
+	}
+
+	t := parallel.RequestSpec{URL: args[1], Headers: map[string]string{}}
+	for _, h := range parseHeaders(headers) {
+		t.Headers[h.key] = h.value
+	}
+	switch {
+	case data == "@-":
+		log.Fatalf("can't fuzz a body from stdin")
+	case strings.HasPrefix(data, "@"):
+		t.BodyFile = data[1:]
+	default:
+		t.Body = data
+	}
+	if cmd.Flags().Changed("method") {
+		t.Method = method
+	} else if data != "" {
+		// send bodies as a POST by default, as curl does
+		t.Method = "POST"
+	}
+
+	f := &parallel.Fuzzer{Template: t, Mode: fuzzMode}
+	for _, arg := range fuzzWordlists {
+		wl, err := parallel.ReadFuzzWordlist(arg)
+		if err != nil {
+			log.WithError(err).Fatalf("invalid wordlist")
+		}
+		f.Wordlists = append(f.Wordlists, wl)
+	}
+
+	ctx, cancel := newContext()
+	defer cancel()
+
+	specs, err := f.Specs(ctx)
+	if err != nil {
+		log.WithError(err).Fatalf("invalid template")
+	}
+	log.WithField("requests", f.Count()).Debugf("fuzzing")
+
+	out, closeResults := openResults()
+	defer closeResults()
+
+	c := newSmuggleClient(cmd)
+	defer c.Close()
+	err = c.GetSpecStreamOnHostContext(ctx, args[0], specs, out, mopts...)
+	writeHAR(c)
+	if err != nil {
+		log.WithError(err).Errorf("failed")
+	}
+}
+
+// rejectPathOnlyFlags will exit if a flag which only applies to plain targets is set, since it
+// would be ignored when smuggling with the other input, e.g. a spec file
+func rejectPathOnlyFlags(with string) {
+	if autoCalibrate {
+		log.Fatalf("ac can't be used with %s", with)
+	}
+	if recursionDepth > 0 {
+		log.Fatalf("recursion-depth can't be used with %s", with)
+	}
+	if len(pathMutations) > 0 {
+		log.Fatalf("mutation can't be used with %s", with)
+	}
+}
+
+// openResults returns the file to write spec results to, and a func to close it. This is
+// stdout if results isn't set
+func openResults() (*os.File, func()) {
+	if resultsFile == "" {
+		return os.Stdout, func() {}
+	}
+	f, err := os.Create(resultsFile)
+	if err != nil {
+		log.WithError(err).Fatalf("failed to create output")
+	}
+	return f, func() { f.Close() }
+}
+
+// newSmuggleClient returns the client configured from the smuggle flags
+func newSmuggleClient(cmd *cobra.Command) *parallel.Client {
+	c := newClient(cmd)
+	c.MaxConnPerHost = concurrency
+	c.MaxReconnects = maxReconnects
+	c.StreamWindow = streamWindow
+	c.Ordered = ordered
+	m, err := h2csmuggler.ParseMode(mode)
+	if err != nil {
+		log.WithError(err).Fatalf("invalid mode: %v", mode)
+	}
+	c.Modes = []h2csmuggler.Mode{m}
+	return c
+}
+
+// smuggleOptions returns the request options from the header, method and body flags, followed by
+// the run options
+func smuggleOptions(cmd *cobra.Command) []parallel.ParallelOption {
+	body, err := newBody()
+	if err != nil {
+		log.WithError(err).Fatalf("invalid body")
+	}
+	// send bodies as a POST by default, as curl does
+	if body != nil && !cmd.Flags().Changed("method") {
+		method = "POST"
+	}
+
+	hs := parseHeaders(headers)
+	opts := []parallel.ParallelOption{}
+	for _, h := range hs {
+		opts = append(opts, parallel.RequestHeader(h.key, h.value))
+	}
+	opts = append(opts, parallel.RequestMethod(method))
+	if body != nil {
+		opts = append(opts, parallel.RequestBody(body))
+	}
+	return append(opts, runOptions()...)
+}
+
+// runOptions returns the options from the recursion, mutation and matcher flags
+func runOptions() []parallel.ParallelOption {
+	opts := []parallel.ParallelOption{}
+	if recursionDepth > 0 {
+		opts = append(opts, parallel.Recurse(recursionDepth))
+	}
+	if len(pathMutations) > 0 {
+		muts, err := parseMutations(pathMutations)
+		if err != nil {
+			log.WithError(err).Fatalf("invalid mutation")
+		}
+		opts = append(opts, parallel.MutatePaths(muts...))
+	}
+
+	mopts, err := matchOptions()
+	if err != nil {
+		log.WithError(err).Fatalf("invalid matcher")
+	}
+	return append(opts, mopts...)
+}
+
+// newBody will create the request body from the data or form flags. nil is returned if neither is set
+func newBody() (*h2csmuggler.RequestBody, error) {
+	switch {
+	case data != "" && len(form) > 0:
+		return nil, fmt.Errorf("data and form can't be used together")
+	case data != "":
+		return h2csmuggler.ParseBody(data)
+	case len(form) > 0:
+		m := h2csmuggler.NewMultipartBody()
+		for _, f := range form {
+			if err := m.ParseFormField(f); err != nil {
+				return nil, err
+			}
+		}
+		return m.Body()
+	}
+	return nil, nil
+}
+
 type header struct {
 	key   string
 	value string
@@ -112,8 +337,26 @@ func init() {
 
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
+	smuggleCmd.Flags().StringVar(&mode, "mode", "upgrade", "connection mode to smuggle through. upgrade, prior-knowledge or websocket")
 	smuggleCmd.Flags().BoolVarP(&compare, "compare", "C", false, "Compare the results from h2c with a basic http2 request. log any differences")
 	smuggleCmd.Flags().StringSliceVarP(&headers, "header", "H", []string{}, "Headers to send in each request. These will clobber existing headers. Expected in normal formatting: e.g. `Host: foobar.com`")
 	smuggleCmd.Flags().StringVarP(&method, "method", "X", "GET", "Method to send in the smuggled request. This will affect the initial request as well")
+	smuggleCmd.Flags().StringVarP(&data, "data", "d", "", "body to send in each request. @filename streams the file and @- reads stdin. The method defaults to POST")
+	smuggleCmd.Flags().StringSliceVarP(&form, "form", "F", []string{}, "multipart form field to send in each request. name=value or name=@filename. The method defaults to POST")
+	smuggleCmd.Flags().StringVar(&specFile, "spec", "", "JSONL file of request specs to smuggle instead of targets. - reads stdin")
+	smuggleCmd.Flags().StringVar(&resultsFile, "results", "", "file to write the spec results to as JSONL. defaults to stdout")
+	smuggleCmd.Flags().StringSliceVarP(&fuzzWordlists, "wordlist", "w", []string{}, "wordlist to fuzz the template with, as filename:KEYWORD. The keyword defaults to FUZZ. - reads stdin")
+	smuggleCmd.Flags().StringVar(&fuzzMode, "fuzz-mode", parallel.FuzzClusterBomb, "how to combine the wordlists. clusterbomb sends every combination, pitchfork sends the nth word of each together")
+	smuggleCmd.Flags().StringVarP(&infile, "infile", "i", "", "input file to read the targets from")
+	smuggleCmd.Flags().BoolVar(&dedupe, "dedupe", false, "skip targets which were already read. every target is held in memory to do so")
+	smuggleCmd.Flags().BoolVar(&ordered, "ordered", false, "log results in the order of the targets, holding results which complete early")
 	smuggleCmd.Flags().IntVarP(&concurrency, "concurrency", "c", 10, "Number of concurrent threads to use")
+	smuggleCmd.Flags().IntVar(&streamWindow, "stream-window", 0, "streams to keep in flight on each tunnel. concurrency is then the number of tunnels")
+	smuggleCmd.Flags().IntVar(&maxReconnects, "max-reconnects", parallel.DefaultMaxReconnects, "times to re-establish a dead tunnel or resend an unprocessed target before giving up on it. -1 to disable")
+	smuggleCmd.Flags().IntVar(&recursionDepth, "recursion-depth", 0, "explore directories found (redirects to a trailing slash, forbidden prefixes, index pages) with the same paths, up to this many levels deep. every path and target it schedules is held in memory to do so. not supported with spec, wordlist or compare")
+	smuggleCmd.Flags().StringSliceVar(&pathMutations, "mutation", []string{}, "also send variants of each target's path, as generated by mutate encode. "+strings.Join(paths.MutationNames, ", ")+" or all. not supported with spec, wordlist or compare")
+	smuggleCmd.Flags().StringSliceVar(&extensions, "extension", paths.Extensions, "extensions to append with the extensions mutation")
+	addMatchFlags(smuggleCmd)
+	addCalibrateFlags(smuggleCmd)
+	addConnectionFlags(smuggleCmd)
 }
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"bufio"
+	"net/url"
+	"os"
+
+	"github.com/minight/h2csmuggler/internal/parallel"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	wordlist   = ""
+	noGenerate = false
+)
+
+// vhostCmd represents the vhost command
+var vhostCmd = &cobra.Command{
+	Use:   "vhost <host> [path]",
+	Short: "discover the virtual hosts routed by the backend through the h2c tunnel",
+	Long: `vhost will smuggle the same path to the host once per candidate, sending the
+candidate as the :authority. The tunnel itself is upgraded with the usual host, so the edge
+routes it as normal.
+
+Candidates are generated from the wordlist, or common service names if there isn't one.
+Each word is tried as is, with internal TLDs (e.g. .internal, .svc.cluster.local) and as a
+subdomain of the host's domain. localhost and common internal addresses are always tried.
+Use --no-generate to only try the wordlist.
+
+The responses are compared with baselines for nonsense hosts. Only candidates whose responses
+differ in status, redirect or length are reported`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		base := args[0]
+		target := base
+		if len(args) > 1 {
+			baseurl, err := url.Parse(base)
+			if err != nil {
+				log.WithError(err).Fatalf("invalid host")
+			}
+			ref, err := url.Parse(args[1])
+			if err != nil {
+				log.WithError(err).Fatalf("invalid path")
+			}
+			target = baseurl.ResolveReference(ref).String()
+		}
+
+		words := []string{}
+		if wordlist != "" {
+			in := os.Stdin
+			if wordlist != "-" {
+				log.WithField("filename", wordlist).Debugf("loading wordlist")
+				file, err := os.Open(wordlist)
+				if err != nil {
+					log.Fatal(err)
+				}
+				defer file.Close()
+				in = file
+			}
+
+			scanner := bufio.NewScanner(in)
+			for scanner.Scan() {
+				words = append(words, scanner.Text())
+			}
+			if err := scanner.Err(); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		hosts := words
+		if !noGenerate {
+			hosts = parallel.VhostCandidates(base, words)
+		}
+		if len(hosts) == 0 {
+			log.Fatalf("no candidates to try")
+		}
+
+		ctx, cancel := newContext()
+		defer cancel()
+
+		c := newSmuggleClient(cmd)
+		defer c.Close()
+		_, err := c.GetVhostsOnHostContext(ctx, base, target, hosts, smuggleOptions(cmd)...)
+		writeHAR(c)
+		if err != nil {
+			log.WithError(err).Errorf("failed")
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(vhostCmd)
+
+	vhostCmd.Flags().StringVarP(&wordlist, "wordlist", "w", "", "file of hosts or service names to try. - reads stdin")
+	vhostCmd.Flags().BoolVar(&noGenerate, "no-generate", false, "only try the wordlist, without generating candidates from it")
+	vhostCmd.Flags().StringVar(&mode, "mode", "upgrade", "connection mode to smuggle through. upgrade, prior-knowledge or websocket")
+	vhostCmd.Flags().StringSliceVarP(&headers, "header", "H", []string{}, "Headers to send in each request. Expected in normal formatting: e.g. `X-Forwarded-For: 127.0.0.1`")
+	vhostCmd.Flags().StringVarP(&method, "method", "X", "GET", "Method to send in the smuggled request. This will affect the initial request as well")
+	vhostCmd.Flags().IntVarP(&concurrency, "concurrency", "c", 10, "Number of concurrent threads to use")
+	vhostCmd.Flags().IntVar(&streamWindow, "stream-window", 0, "streams to keep in flight on each tunnel. concurrency is then the number of tunnels")
+	vhostCmd.Flags().IntVar(&maxReconnects, "max-reconnects", parallel.DefaultMaxReconnects, "times to re-establish a dead tunnel or resend an unprocessed target before giving up on it. -1 to disable")
+	addMatchFlags(vhostCmd)
+	addConnectionFlags(vhostCmd)
+}
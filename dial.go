@@ -0,0 +1,173 @@
+package h2csmuggler
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http/httptrace"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrUnexpectedScheme = errors.New("Unexpected scheme for connection")
+)
+
+// DialOption provides manipulation of how the underlying connection is established
+type DialOption func(o *DialOptions)
+
+// DialOptions control how CreateConn reaches the target
+type DialOptions struct {
+	// Proxy, if set, will tunnel the connection through the upstream proxy
+	Proxy *url.URL
+
+	// ResolveOverrides maps host:port to the address that should be dialed instead
+	ResolveOverrides map[string]string
+
+	// Timeout is the maximum time to establish the tcp connection, including any proxy tunnel
+	Timeout time.Duration
+
+	// TLSHandshakeTimeout is the maximum time to complete the tls handshake
+	TLSHandshakeTimeout time.Duration
+
+	// TLSConfig is used for https targets. If nil, DefaultTLSConfig is used.
+	// If ServerName is empty, it will be set to the target hostname
+	TLSConfig *tls.Config
+}
+
+func DialProxy(p *url.URL) DialOption {
+	return func(o *DialOptions) {
+		o.Proxy = p
+	}
+}
+
+func DialResolveOverrides(overrides map[string]string) DialOption {
+	return func(o *DialOptions) {
+		o.ResolveOverrides = overrides
+	}
+}
+
+func DialTimeout(d time.Duration) DialOption {
+	return func(o *DialOptions) {
+		o.Timeout = d
+	}
+}
+
+func DialTLSConfig(cfg *tls.Config) DialOption {
+	return func(o *DialOptions) {
+		o.TLSConfig = cfg
+	}
+}
+
+func DialTLSHandshakeTimeout(d time.Duration) DialOption {
+	return func(o *DialOptions) {
+		o.TLSHandshakeTimeout = d
+	}
+}
+
+// CreateConn will create a net.Conn from the URL. This will choose between a tls
+// and a normal tcp connection based on the url scheme
+// If a proxy is provided, the connection will be tunneled through it and the tls handshake
+// will be performed inside the tunnel
+func CreateConn(t *url.URL, dialer *net.Dialer, opts ...DialOption) (net.Conn, error) {
+	return CreateConnContext(context.Background(), t, dialer, opts...)
+}
+
+// CreateConnContext is CreateConn with a context. If the context is cancelled before the connection
+// is established, the dial and handshake will be interrupted
+func CreateConnContext(ctx context.Context, t *url.URL, dialer *net.Dialer, opts ...DialOption) (ret net.Conn, err error) {
+	o := &DialOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	switch t.Scheme {
+	case "https":
+		hostport := t.Host
+		if t.Port() == "" {
+			hostport = fmt.Sprintf("%s:%d", t.Host, 443)
+		}
+
+		rawconn, err := o.dial(ctx, dialer, hostport)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg := DefaultTLSConfig
+		if o.TLSConfig != nil {
+			cfg = o.TLSConfig
+		}
+		cfg = cfg.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName = t.Hostname()
+		}
+
+		log.Tracef("establishing tls conn on: %v", hostport)
+		trace := httptrace.ContextClientTrace(ctx)
+		if trace != nil && trace.TLSHandshakeStart != nil {
+			trace.TLSHandshakeStart()
+		}
+		tlsconn := tls.Client(rawconn, cfg)
+		stop := interruptAfter(ctx, rawconn, o.TLSHandshakeTimeout)
+		err = tlsconn.Handshake()
+		stop()
+		if trace != nil && trace.TLSHandshakeDone != nil {
+			trace.TLSHandshakeDone(tlsconn.ConnectionState(), err)
+		}
+		if err != nil {
+			rawconn.Close()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, errors.Wrap(err, "Failed to dial tls")
+		}
+		ret = tlsconn
+	case "http":
+		hostport := t.Host
+		if t.Port() == "" {
+			hostport = fmt.Sprintf("%s:%d", t.Host, 80)
+		}
+		ret, err = o.dial(ctx, dialer, hostport)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrUnexpectedScheme
+	}
+	return
+}
+
+// dial will establish the raw tcp connection to hostport, applying any resolve overrides
+// and tunneling through the proxy if provided
+func (o *DialOptions) dial(ctx context.Context, dialer *net.Dialer, hostport string) (net.Conn, error) {
+	addr := hostport
+	if override, ok := o.ResolveOverrides[hostport]; ok {
+		log.Tracef("resolving %v to %v", hostport, override)
+		addr = override
+	}
+
+	if o.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.Timeout)
+		defer cancel()
+	}
+
+	if o.Proxy != nil {
+		conn, err := dialProxy(ctx, o.Proxy, dialer, addr)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to dial proxy")
+		}
+		return conn, nil
+	}
+
+	log.Tracef("establishing tcp conn on: %v", addr)
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to dial tcp")
+	}
+	return conn, nil
+}
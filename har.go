@@ -0,0 +1,610 @@
+package h2csmuggler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/minight/h2csmuggler/http2"
+	"github.com/pkg/errors"
+)
+
+// Transports annotate each HAR entry with how it travelled
+const (
+	// TransportUpgrade is the HTTP/1.1 upgrade exchange which established the tunnel
+	TransportUpgrade = "upgrade"
+	// TransportH2C is a request smuggled over the h2c tunnel
+	TransportH2C = "h2c"
+	// TransportWebSocket is a request smuggled over a websocket tunnel
+	TransportWebSocket = "websocket"
+	// TransportBaseline is a request sent with a normal http2 client, for comparison
+	TransportBaseline = "baseline"
+)
+
+// HAR is a HTTP Archive 1.2 document. See http://www.softwareishard.com/blog/har-12-spec/
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// HAREntry is a single request and response. Transport is a custom field
+// recording whether the entry travelled over the tunnel. See TransportH2C
+type HAREntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Connection      string      `json:"connection,omitempty"`
+	Transport       string      `json:"_transport"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+
+	// Error is the transport error of a request which failed without a response, with Status 0.
+	// This is a custom field
+	Error string `json:"_error,omitempty"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// HARPostData is the request body. Bodies over MaxHARBodySize are truncated
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// HARContent is the response body. Bodies which aren't valid utf8 are base64 encoded.
+// Bodies over MaxHARBodySize are truncated, and Size is the size of the whole body
+type HARContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// HARTimings are in milliseconds. -1 is used for phases which don't apply
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// MaxHARBodySize is the most of each request and response body which is recorded
+const MaxHARBodySize = 1 << 20
+
+const (
+	harHeader = `{
+  "log": {
+    "version": "1.2",
+    "creator": {
+      "name": "h2csmuggler",
+      "version": "1.0"
+    },
+    "entries": [`
+	harTrailer = "\n    ]\n  }\n}\n"
+	harIndent  = "      "
+)
+
+// HARRecorder writes HAR entries as json as they complete, so they aren't held in memory. It is
+// safe for concurrent use, so a single recorder can be shared by every Conn in a run.
+// See ConnectionHAR
+type HARRecorder struct {
+	mu      sync.Mutex
+	w       io.Writer
+	closer  io.Closer
+	entries int
+	closed  bool
+	err     error
+}
+
+// NewHARRecorder returns a recorder which writes the HAR to w. Close must be called once every
+// entry has been added to complete the document
+func NewHARRecorder(w io.Writer) *HARRecorder {
+	return &HARRecorder{w: w}
+}
+
+// CreateHARFile returns a recorder which writes the HAR to filename. Close will also close the file
+func CreateHARFile(filename string) (*HARRecorder, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create har")
+	}
+	h := NewHARRecorder(f)
+	h.closer = f
+	return h, nil
+}
+
+// Add will write the entry. Entries are written in the order they completed. The upgrade exchange
+// completes before the first stream, so it always precedes the streams on its connection.
+// If a write fails, the rest of the entries are dropped and the error is returned by Close
+func (h *HARRecorder) Add(e HAREntry) {
+	raw, err := json.MarshalIndent(e, harIndent, "  ")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.err != nil || h.closed {
+		return
+	}
+	if err != nil {
+		h.err = errors.Wrap(err, "failed to marshal har entry")
+		return
+	}
+	sep := ",\n" + harIndent
+	if h.entries == 0 {
+		sep = harHeader + "\n" + harIndent
+	}
+	if _, err := io.WriteString(h.w, sep); err != nil {
+		h.err = errors.Wrap(err, "failed to write har")
+		return
+	}
+	if _, err := h.w.Write(raw); err != nil {
+		h.err = errors.Wrap(err, "failed to write har")
+		return
+	}
+	h.entries++
+}
+
+// Close will complete the document, returning the first error the recorder encountered.
+// Entries added after Close are dropped
+func (h *HARRecorder) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return h.err
+	}
+	h.closed = true
+	if h.err == nil {
+		end := harTrailer
+		if h.entries == 0 {
+			end = harHeader + end
+		}
+		if _, err := io.WriteString(h.w, end); err != nil {
+			h.err = errors.Wrap(err, "failed to write har")
+		}
+	}
+	if h.closer != nil {
+		if err := h.closer.Close(); err != nil && h.err == nil {
+			h.err = errors.Wrap(err, "failed to close har")
+		}
+	}
+	return h.err
+}
+
+// NewHAREntry will create an entry for the request and response. timing is the stream timing
+// of the request, and done is when the response body was completely read
+func NewHAREntry(transport string, req *http.Request, res *http.Response, body []byte, timing StreamTiming, done time.Time) HAREntry {
+	return newHAREntry(transport, req, res, body, len(body), timing, done)
+}
+
+// newHAREntry is NewHAREntry with the size of the whole body, if body is only its start
+func newHAREntry(transport string, req *http.Request, res *http.Response, body []byte, size int, timing StreamTiming, done time.Time) HAREntry {
+	e := HAREntry{
+		StartedDateTime: timing.Start,
+		Request:         harRequest(req, harHeaders(req.Header)),
+		Timings: HARTimings{
+			Blocked: -1,
+			DNS:     -1,
+			Connect: -1,
+			SSL:     -1,
+			Send:    ms(timing.WroteRequest),
+			Wait:    ms(timing.FirstByte - timing.WroteRequest),
+			Receive: ms(done.Sub(timing.Start) - timing.FirstByte),
+		},
+		Transport: transport,
+	}
+	if res != nil {
+		e.Request.HTTPVersion = res.Proto
+		e.Response = harResponse(res.StatusCode, res.Status, res.Proto, harHeaders(res.Header), res.Header.Get("Content-Type"), body, size)
+	}
+	e.Time = e.Timings.Send + e.Timings.Wait + e.Timings.Receive
+	return e
+}
+
+// newErrorHAREntry will create the entry for a request which failed with err before a response
+// was read. done is when it failed
+func newErrorHAREntry(transport string, req *http.Request, err error, timing StreamTiming, done time.Time) HAREntry {
+	e := newHAREntry(transport, req, nil, nil, 0, timing, done)
+	e.Timings.Wait = ms(done.Sub(timing.Start) - timing.WroteRequest)
+	e.Timings.Receive = 0
+	e.Time = e.Timings.Send + e.Timings.Wait
+	e.Response = HARResponse{
+		Cookies:     []HARNameValue{},
+		Headers:     []HARNameValue{},
+		HeadersSize: -1,
+		BodySize:    -1,
+		Error:       err.Error(),
+	}
+	return e
+}
+
+// newUpgradeHAREntry will create the entry for the HTTP/1.1 upgrade exchange. raw is the upgrade
+// request as it was written, so the headers are recorded verbatim
+func newUpgradeHAREntry(req *http.Request, raw []byte, upgrade *http2.UpgradeResponse, timing ConnTiming) HAREntry {
+	headers := []HARNameValue{}
+	tp := bufio.NewReader(bytes.NewReader(raw))
+	tp.ReadString('\n') // skip the request line
+	for {
+		line, err := tp.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" || err != nil {
+			break
+		}
+		name, value := line, ""
+		if i := strings.IndexByte(line, ':'); i != -1 {
+			name, value = line[:i], strings.TrimLeft(line[i+1:], " \t")
+		}
+		headers = append(headers, HARNameValue{Name: name, Value: value})
+	}
+
+	e := HAREntry{
+		StartedDateTime: timing.Start,
+		Request:         harRequest(req, headers),
+		Timings: HARTimings{
+			Blocked: -1,
+			DNS:     ms(timing.DNS),
+			Connect: ms(timing.Dial - timing.DNS - timing.TLSHandshake),
+			SSL:     ms(timing.TLSHandshake),
+			Send:    ms(timing.UpgradeWrite),
+			Wait:    ms(timing.Upgrade),
+			Receive: 0,
+		},
+		Transport: TransportUpgrade,
+	}
+	if timing.TLSHandshake == 0 {
+		e.Timings.SSL = -1
+	}
+	e.Request.HTTPVersion = "HTTP/1.1"
+	if end := bytes.Index(raw, []byte("\r\n\r\n")); end != -1 {
+		e.Request.HeadersSize = end + 4
+		if body := raw[end+4:]; len(body) > 0 {
+			e.Request.BodySize = len(body)
+			e.Request.PostData = harPostData(req.Header.Get("Content-Type"), body, len(body))
+		}
+	}
+
+	if upgrade != nil {
+		status := ""
+		if parts := strings.SplitN(upgrade.StatusLine, " ", 2); len(parts) == 2 {
+			status = parts[1]
+		}
+		e.Response = harResponse(upgrade.StatusCode, status, upgrade.Proto, upgradeHARHeaders(upgrade.Headers), upgrade.Header("Content-Type"), []byte(upgrade.Body), len(upgrade.Body))
+	}
+	e.Time = e.Timings.DNS + e.Timings.Connect + e.Timings.Send + e.Timings.Wait
+	if e.Timings.SSL > 0 {
+		e.Time += e.Timings.SSL
+	}
+	return e
+}
+
+// setHARConn will record the connection the entry was sent on
+func setHARConn(e *HAREntry, conn net.Conn) {
+	if conn == nil {
+		return
+	}
+	e.Connection = conn.LocalAddr().String()
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		e.ServerIPAddress = host
+	}
+}
+
+func harRequest(req *http.Request, headers []HARNameValue) HARRequest {
+	r := HARRequest{
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		HTTPVersion: "HTTP/2.0",
+		Cookies:     []HARNameValue{},
+		Headers:     headers,
+		QueryString: []HARNameValue{},
+		HeadersSize: -1,
+		BodySize:    0,
+	}
+	for _, c := range req.Cookies() {
+		r.Cookies = append(r.Cookies, HARNameValue{Name: c.Name, Value: c.Value})
+	}
+	for k, vs := range req.URL.Query() {
+		for _, v := range vs {
+			r.QueryString = append(r.QueryString, HARNameValue{Name: k, Value: v})
+		}
+	}
+	sort.SliceStable(r.QueryString, func(i, j int) bool {
+		return r.QueryString[i].Name < r.QueryString[j].Name
+	})
+	if b, ok := req.Body.(*harSentBody); ok {
+		raw, size := b.sent()
+		r.BodySize = size
+		r.PostData = harPostData(req.Header.Get("Content-Type"), raw, size)
+	}
+	return r
+}
+
+// harPostData creates the request body. size is the size of the whole body, which is truncated
+// to MaxHARBodySize
+func harPostData(mimeType string, body []byte, size int) *HARPostData {
+	if len(body) > MaxHARBodySize {
+		body = body[:MaxHARBodySize]
+	}
+	return &HARPostData{
+		MimeType: mimeType,
+		Text:     string(body),
+		Comment:  truncatedComment(len(body), size),
+	}
+}
+
+// truncatedComment returns the comment of a body of size which was truncated to n bytes.
+// This is empty if it wasn't truncated
+func truncatedComment(n int, size int) string {
+	if n >= size {
+		return ""
+	}
+	return "truncated to " + strconv.Itoa(n) + " of " + strconv.Itoa(size) + " bytes"
+}
+
+// harResponse creates the response. status is in the form of http.Response.Status e.g. 200 OK.
+// size is the size of the whole body, which is truncated to MaxHARBodySize
+func harResponse(code int, status string, proto string, headers []HARNameValue, mimeType string, body []byte, size int) HARResponse {
+	if len(body) > MaxHARBodySize {
+		body = body[:MaxHARBodySize]
+	}
+	r := HARResponse{
+		Status:      code,
+		StatusText:  strings.TrimSpace(strings.TrimPrefix(status, strconv.Itoa(code))),
+		HTTPVersion: proto,
+		Cookies:     []HARNameValue{},
+		Headers:     headers,
+		Content: HARContent{
+			Size:     size,
+			MimeType: mimeType,
+			Comment:  truncatedComment(len(body), size),
+		},
+		HeadersSize: -1,
+		BodySize:    size,
+	}
+	if r.StatusText == "" {
+		r.StatusText = http.StatusText(code)
+	}
+	if utf8.Valid(body) {
+		r.Content.Text = string(body)
+	} else {
+		r.Content.Text = base64.StdEncoding.EncodeToString(body)
+		r.Content.Encoding = "base64"
+	}
+	return r
+}
+
+// harHeaders returns the headers sorted by name, since the original order isn't known
+func harHeaders(h http.Header) []HARNameValue {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	ret := []HARNameValue{}
+	for _, k := range keys {
+		for _, v := range h[k] {
+			ret = append(ret, HARNameValue{Name: k, Value: v})
+		}
+	}
+	return ret
+}
+
+func upgradeHARHeaders(headers []http2.UpgradeHeader) []HARNameValue {
+	ret := make([]HARNameValue, 0, len(headers))
+	for _, h := range headers {
+		ret = append(ret, HARNameValue{Name: h.Name, Value: h.Value})
+	}
+	return ret
+}
+
+// ms returns d in fractional milliseconds, as used by HAR
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// harBody records the response body as it's read, up to MaxHARBodySize. done is called with the
+// recorded body and the size of the whole body once it has been completely read or closed
+type harBody struct {
+	io.ReadCloser
+	buf  bytes.Buffer
+	size int
+	once sync.Once
+	done func(body []byte, size int)
+}
+
+func newHARBody(body io.ReadCloser, done func(body []byte, size int)) *harBody {
+	return &harBody{
+		ReadCloser: body,
+		done:       done,
+	}
+}
+
+func (b *harBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	recordHARBody(&b.buf, p[:n])
+	b.size += n
+	if err == io.EOF {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *harBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.finish()
+	return err
+}
+
+func (b *harBody) finish() {
+	b.once.Do(func() {
+		b.done(b.buf.Bytes(), b.size)
+	})
+}
+
+// recordHARBody will append p to buf, up to MaxHARBodySize
+func recordHARBody(buf *bytes.Buffer, p []byte) {
+	if room := MaxHARBodySize - buf.Len(); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		buf.Write(p[:room])
+	}
+}
+
+// harSentBody records the request body as it's sent, up to MaxHARBodySize, so streamed bodies
+// such as files and multipart forms don't need to be read a second time for the HAR.
+// A body rewound with GetBody to retry the request isn't recorded again
+type harSentBody struct {
+	io.ReadCloser
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	size int
+}
+
+// withSentBody will return a shallow copy of req which records its body as it's sent. req is
+// returned as is if it has no body
+func withSentBody(req *http.Request) *http.Request {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req
+	}
+	if _, ok := req.Body.(*harSentBody); ok {
+		return req
+	}
+	r := new(http.Request)
+	*r = *req
+	r.Body = &harSentBody{ReadCloser: req.Body}
+	return r
+}
+
+func (b *harSentBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	recordHARBody(&b.buf, p[:n])
+	b.size += n
+	return n, err
+}
+
+// sent returns the body sent so far and its whole size
+func (b *harSentBody) sent() ([]byte, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...), b.size
+}
+
+// NewHARRoundTripper will record every request sent with rt as an entry annotated with transport.
+// This is used to record the baseline requests. See TransportBaseline
+func NewHARRoundTripper(rt http.RoundTripper, h *HARRecorder, transport string) http.RoundTripper {
+	return &harRoundTripper{
+		rt:        rt,
+		har:       h,
+		transport: transport,
+	}
+}
+
+type harRoundTripper struct {
+	rt        http.RoundTripper
+	har       *HARRecorder
+	transport string
+}
+
+func (h *harRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	var (
+		mu   sync.Mutex
+		conn net.Conn
+	)
+	st := StreamTiming{
+		URL:   req.URL.String(),
+		Start: time.Now(),
+	}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			conn = info.Conn
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			st.WroteRequest = time.Since(st.Start)
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			st.FirstByte = time.Since(st.Start)
+		},
+	}
+
+	req = withSentBody(req)
+	res, err := h.rt.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		mu.Lock()
+		defer mu.Unlock()
+		e := newErrorHAREntry(h.transport, req, err, st, time.Now())
+		setHARConn(&e, conn)
+		h.har.Add(e)
+		return nil, err
+	}
+	res.Body = newHARBody(res.Body, func(body []byte, size int) {
+		mu.Lock()
+		defer mu.Unlock()
+		e := newHAREntry(h.transport, req, res, body, size, st, time.Now())
+		setHARConn(&e, conn)
+		h.har.Add(e)
+	})
+	return res, nil
+}
@@ -0,0 +1,242 @@
+package h2csmuggler
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestConn_HAR(t *testing.T) {
+	var upgrades int32
+	srv := newH2CServer(&upgrades)
+	defer srv.Close()
+
+	tests := []struct {
+		name           string
+		mode           Mode
+		wantTransports []string
+	}{
+		{name: "upgrade", mode: ModeUpgrade, wantTransports: []string{TransportUpgrade, TransportH2C, TransportH2C}},
+		{name: "prior knowledge", mode: ModePriorKnowledge, wantTransports: []string{TransportH2C, TransportH2C}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			h := NewHARRecorder(&buf)
+			c, err := NewConn(srv.URL, ConnectionMode(tt.mode), ConnectionHAR(h))
+			if err != nil {
+				t.Fatalf("NewConn() error = %v", err)
+			}
+			defer c.Close()
+
+			for _, path := range []string{"/a", "/b"} {
+				req, err := http.NewRequest("GET", srv.URL+path, nil)
+				if err != nil {
+					t.Fatalf("NewRequest() error = %v", err)
+				}
+				res, err := c.Do(req)
+				if err != nil {
+					t.Fatalf("Conn.Do() error = %v", err)
+				}
+				ioutil.ReadAll(res.Body)
+				res.Body.Close()
+			}
+
+			if err := h.Close(); err != nil {
+				t.Fatalf("HARRecorder.Close() error = %v", err)
+			}
+			var got HAR
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatalf("json.Unmarshal() error = %v", err)
+			}
+			if got.Log.Version != "1.2" {
+				t.Errorf("HAR version = %v, want 1.2", got.Log.Version)
+			}
+
+			entries := got.Log.Entries
+			if len(entries) != len(tt.wantTransports) {
+				t.Fatalf("HAR entries = %d, want %d", len(entries), len(tt.wantTransports))
+			}
+			for i, e := range entries {
+				if e.Transport != tt.wantTransports[i] {
+					t.Errorf("entries[%d].Transport = %v, want %v", i, e.Transport, tt.wantTransports[i])
+				}
+				if e.Connection == "" || e.ServerIPAddress == "" {
+					t.Errorf("entries[%d] connection = %q, %q", i, e.Connection, e.ServerIPAddress)
+				}
+			}
+
+			if tt.mode == ModeUpgrade {
+				upgrade := entries[0]
+				if upgrade.Request.HTTPVersion != "HTTP/1.1" || upgrade.Response.Status != 101 {
+					t.Errorf("upgrade entry = %v %v, want HTTP/1.1 101", upgrade.Request.HTTPVersion, upgrade.Response.Status)
+				}
+				if !hasHARHeader(upgrade.Request.Headers, "Upgrade", "h2c") {
+					t.Errorf("upgrade entry headers = %v, want Upgrade: h2c", upgrade.Request.Headers)
+				}
+				entries = entries[1:]
+			}
+			for i, e := range entries {
+				path := []string{"/a", "/b"}[i]
+				if e.Request.URL != srv.URL+path {
+					t.Errorf("entries[%d].Request.URL = %v, want %v", i, e.Request.URL, srv.URL+path)
+				}
+				if want := "HTTP/2.0 " + path; e.Response.Content.Text != want {
+					t.Errorf("entries[%d].Response.Content.Text = %q, want %q", i, e.Response.Content.Text, want)
+				}
+				if e.Timings.Wait < 0 || e.Timings.Receive < 0 {
+					t.Errorf("entries[%d].Timings = %+v", i, e.Timings)
+				}
+			}
+		})
+	}
+}
+
+// readHAR will close h and return its entries
+func readHAR(t *testing.T, h *HARRecorder, buf *bytes.Buffer) []HAREntry {
+	if err := h.Close(); err != nil {
+		t.Fatalf("HARRecorder.Close() error = %v", err)
+	}
+	var got HAR
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	return got.Log.Entries
+}
+
+func TestConn_HARRequestBody(t *testing.T) {
+	var upgrades int32
+	srv := newH2CServer(&upgrades)
+	defer srv.Close()
+
+	var buf bytes.Buffer
+	h := NewHARRecorder(&buf)
+	c, err := NewConn(srv.URL, ConnectionMode(ModePriorKnowledge), ConnectionHAR(h))
+	if err != nil {
+		t.Fatalf("NewConn() error = %v", err)
+	}
+	defer c.Close()
+
+	// a streamed body can't be read again with GetBody, so it must be recorded as it's sent
+	body := ioutil.NopCloser(io.MultiReader(strings.NewReader("a=1"), strings.NewReader("&b=2")))
+	req, err := http.NewRequest("POST", srv.URL+"/a", body)
+	if err != nil {
+		t.Fatalf("NewRequest() error = %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("Conn.Do() error = %v", err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	entries := readHAR(t, h, &buf)
+	if len(entries) != 1 {
+		t.Fatalf("HAR entries = %d, want 1", len(entries))
+	}
+	got := entries[0].Request
+	if got.PostData == nil || got.PostData.Text != "a=1&b=2" || got.BodySize != 7 {
+		t.Errorf("Request.PostData = %+v, BodySize = %v, want a=1&b=2", got.PostData, got.BodySize)
+	}
+}
+
+func TestConn_HARError(t *testing.T) {
+	// a closed port, so the dial is refused
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	target := "http://" + l.Addr().String()
+	l.Close()
+
+	for _, mode := range []Mode{ModeUpgrade, ModePriorKnowledge} {
+		t.Run(mode.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			h := NewHARRecorder(&buf)
+			c, err := NewConn(target, ConnectionMode(mode), ConnectionHAR(h))
+			if err != nil {
+				t.Fatalf("NewConn() error = %v", err)
+			}
+			defer c.Close()
+
+			req, err := http.NewRequest("GET", target+"/a", nil)
+			if err != nil {
+				t.Fatalf("NewRequest() error = %v", err)
+			}
+			if _, err := c.Do(req); err == nil {
+				t.Fatalf("Conn.Do() error = nil, want a connection error")
+			}
+
+			entries := readHAR(t, h, &buf)
+			if len(entries) != 1 {
+				t.Fatalf("HAR entries = %d, want 1", len(entries))
+			}
+			e := entries[0]
+			if e.Request.URL != target+"/a" || e.Response.Status != 0 || e.Response.Error == "" {
+				t.Errorf("HAR entry = %v %v %q, want the failed request with its error", e.Request.URL, e.Response.Status, e.Response.Error)
+			}
+		})
+	}
+}
+
+func TestHARRecorder_Close(t *testing.T) {
+	var buf bytes.Buffer
+	h := NewHARRecorder(&buf)
+	if err := h.Close(); err != nil {
+		t.Fatalf("HARRecorder.Close() error = %v", err)
+	}
+	var got HAR
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	if got.Log.Version != "1.2" || len(got.Log.Entries) != 0 {
+		t.Errorf("HAR = %+v, want an empty 1.2 log", got)
+	}
+}
+
+func Test_harBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		size        int
+		wantRecord  int
+		wantComment bool
+	}{
+		{name: "small", size: 10, wantRecord: 10},
+		{name: "at limit", size: MaxHARBodySize, wantRecord: MaxHARBodySize},
+		{name: "truncated", size: MaxHARBodySize + 10, wantRecord: MaxHARBodySize, wantComment: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got HARResponse
+			b := newHARBody(ioutil.NopCloser(bytes.NewReader(make([]byte, tt.size))), func(body []byte, size int) {
+				got = harResponse(200, "200 OK", "HTTP/2.0", nil, "", body, size)
+			})
+			ioutil.ReadAll(b)
+			b.Close()
+			if len(got.Content.Text) != tt.wantRecord {
+				t.Errorf("harBody recorded %d bytes, want %d", len(got.Content.Text), tt.wantRecord)
+			}
+			if got.Content.Size != tt.size || got.BodySize != tt.size {
+				t.Errorf("harBody size = %d, %d, want %d", got.Content.Size, got.BodySize, tt.size)
+			}
+			if (got.Content.Comment != "") != tt.wantComment {
+				t.Errorf("harBody comment = %q, want comment %v", got.Content.Comment, tt.wantComment)
+			}
+		})
+	}
+}
+
+func hasHARHeader(headers []HARNameValue, name string, value string) bool {
+	for _, h := range headers {
+		if h.Name == name && h.Value == value {
+			return true
+		}
+	}
+	return false
+}
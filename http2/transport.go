@@ -224,16 +224,21 @@ func (t *Transport) initConnPool() {
 // ClientConn is the state of a single HTTP/2 client connection to an
 // HTTP/2 server.
 type ClientConn struct {
-	t         *Transport
-	tconn     net.Conn             // usually *tls.Conn, except specialized impls
-	tlsState  *tls.ConnectionState // nil only for specialized impls
-	reused    uint32               // whether conn is being reused; atomic
-	singleUse bool                 // whether being used for a single http.Request
+	t          *Transport
+	tconn      net.Conn             // usually *tls.Conn, except specialized impls
+	tlsState   *tls.ConnectionState // nil only for specialized impls
+	upgrade    *UpgradeResponse     // set if the conn was established with an h2c upgrade
+	settingsc  chan struct{}        // closed once the server's first SETTINGS frame is read
+	settingsAt time.Time            // when the server's first SETTINGS frame was read. valid once settingsc is closed
+	reused     uint32               // whether conn is being reused; atomic
+	singleUse  bool                 // whether being used for a single http.Request
 
 	allowHTTP bool       // set by transport. used to determine whether the first response can be async read
 	frmu      sync.Mutex // guards first read
 	firstRead bool       // whether the first response for a pre-upgrade conn has been read
 
+	firstStream *clientStream // the stream of the upgrade request. the server may finish it before it's read
+
 	// readLoop goroutine fields:
 	readerDone chan struct{} // closed on error
 	readerErr  error         // set before readerDone is closed
@@ -556,6 +561,18 @@ func shouldRetryRequest(req *http.Request, err error, afterBodyWrite bool) (*htt
 	return nil, fmt.Errorf("http2: Transport: cannot retry err [%v] after Request.Body was written; define Request.GetBody to avoid this error", err)
 }
 
+// CanRetryError reports whether a request which failed with err was never processed by the
+// server, so it's safe to send again on a new connection. This is the case for refused streams,
+// streams above the last stream id of a GOAWAY, and connections which can no longer take requests.
+// err may be wrapped
+func CanRetryError(err error) bool {
+	if errors.Is(err, errClientConnUnusable) || errors.Is(err, errClientConnGotGoAway) {
+		return true
+	}
+	var se StreamError
+	return errors.As(err, &se) && se.Code == ErrCodeRefusedStream
+}
+
 func canRetryError(err error) bool {
 	if err == errClientConnUnusable || err == errClientConnGotGoAway {
 		return true
@@ -641,6 +658,9 @@ func (t *Transport) NewClientConn(c net.Conn) (*ClientConn, error) {
 
 type UnexpectedStatusCodeError struct {
 	Code int
+
+	// Response is the full response to the upgrade request
+	Response *UpgradeResponse
 }
 
 func (u UnexpectedStatusCodeError) Error() string {
@@ -659,44 +679,71 @@ func (t *Transport) H2CUpgradeRequest(req *http.Request, c net.Conn) (*ClientCon
 		return nil, nil, xerrors.Wrap(err, "failed to dump http body")
 	}
 
-	_, err = c.Write(raw)
-	if err != nil {
-		return nil, nil, xerrors.Wrap(err, "Failed to send initial request")
+	return t.H2CUpgradeRawRequest(req, raw, c)
+}
+
+// H2CUpgradeRawRequest will write raw verbatim as the upgrade request and then continue the h2c handshake
+// req is used as the first stream and must match the request described by raw. Its body is not sent.
+// AllowHTTP must be enabled for this to work
+func (t *Transport) H2CUpgradeRawRequest(req *http.Request, raw []byte, c net.Conn) (*ClientConn, *http.Response, error) {
+	if !t.AllowHTTP {
+		return nil, nil, errors.New("http2: allowhttp not enabled.")
 	}
 
-	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	trace := httptrace.ContextClientTrace(req.Context())
+	sent := time.Now()
+	_, err := c.Write(raw)
+	traceWroteHeaders(trace)
+	traceWroteRequest(trace, err)
 	if err != nil {
-		return nil, nil, xerrors.Wrap(err, "Failed to parse response")
+		return nil, nil, xerrors.Wrap(err, "Failed to send initial request")
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	br := bufio.NewReader(c)
+	upgrade, err := ReadUpgradeResponse(br, sent)
 	if err != nil {
-		return nil, nil, xerrors.Wrap(err, "Failed to read body")
+		return nil, nil, xerrors.Wrap(err, "Failed to parse response")
 	}
 
 	logrus.WithFields(logrus.Fields{
-		"status":  resp.StatusCode,
-		"body":    string(body),
-		"headers": resp.Header,
+		"status":  upgrade.StatusCode,
+		"body":    upgrade.Body,
+		"headers": upgrade.Headers,
 	}).Tracef("upgrade request complete")
 
-	if resp.StatusCode != 101 {
-		logrus.Tracef("unexpected status code: %v", resp.StatusCode)
-		return nil, nil, UnexpectedStatusCodeError{Code: resp.StatusCode}
+	if upgrade.StatusCode != 101 {
+		logrus.Tracef("unexpected status code: %v", upgrade.StatusCode)
+		return nil, nil, UnexpectedStatusCodeError{Code: upgrade.StatusCode, Response: upgrade}
+	}
+	if fn := traceGot1xxResponseFunc(trace); fn != nil {
+		h := textproto.MIMEHeader{}
+		for _, v := range upgrade.Headers {
+			h.Add(v.Name, v.Value)
+		}
+		fn(upgrade.StatusCode, h)
 	}
 
-	cc, err := t.newClientConn(c, req, t.disableKeepAlives())
+	// the server may send its preface immediately after the 101, so the frames already buffered
+	// by br must be read by the client conn
+	cc, err := t.newClientConnReader(c, br, req, t.disableKeepAlives())
 	if err != nil {
 		return nil, nil, xerrors.Wrap(err, "Client conn failed")
 	}
+	cc.upgrade = upgrade
+
+	if err := cc.verifyUpgrade(req.Context()); err != nil {
+		cc.Close()
+		return nil, nil, NoH2Error{Response: upgrade, Err: err}
+	}
 
 	// Clean up the body as per our contract
-	_, err = io.Copy(ioutil.Discard, req.Body)
-	if err != nil {
-		return nil, nil, xerrors.Wrap(err, "Body copy failed")
+	if req.Body != nil {
+		_, err = io.Copy(ioutil.Discard, req.Body)
+		if err != nil {
+			return nil, nil, xerrors.Wrap(err, "Body copy failed")
+		}
+		req.Body.Close()
 	}
-	req.Body.Close()
 
 	res, err := cc.readFirstResponse(req)
 	if err != nil {
@@ -710,6 +757,11 @@ func (t *Transport) H2CUpgradeRequest(req *http.Request, c net.Conn) (*ClientCon
 }
 
 func (t *Transport) newClientConn(c net.Conn, initialRequest *http.Request, singleUse bool) (*ClientConn, error) {
+	return t.newClientConnReader(c, bufio.NewReader(c), initialRequest, singleUse)
+}
+
+// newClientConnReader is newClientConn, reading frames from br instead of c
+func (t *Transport) newClientConnReader(c net.Conn, br *bufio.Reader, initialRequest *http.Request, singleUse bool) (*ClientConn, error) {
 	cc := &ClientConn{
 		t:                     t,
 		tconn:                 c,
@@ -724,6 +776,7 @@ func (t *Transport) newClientConn(c net.Conn, initialRequest *http.Request, sing
 		singleUse:             singleUse,
 		wantSettingsAck:       true,
 		pings:                 make(map[[8]byte]chan struct{}),
+		settingsc:             make(chan struct{}),
 	}
 	if d := t.idleConnTimeout(); d != 0 {
 		cc.idleTimeout = d
@@ -739,7 +792,7 @@ func (t *Transport) newClientConn(c net.Conn, initialRequest *http.Request, sing
 	// TODO: adjust this writer size to account for frame size +
 	// MTU + crypto/tls record padding.
 	cc.bw = bufio.NewWriter(stickyErrWriter{c, &cc.werr})
-	cc.br = bufio.NewReader(c)
+	cc.br = br
 	cc.fr = NewFramer(cc.bw, cc.br)
 	cc.fr.ReadMetaHeaders = hpack.NewDecoder(initialHeaderTableSize, nil)
 	cc.fr.MaxHeaderListSize = t.maxHeaderListSize()
@@ -755,6 +808,7 @@ func (t *Transport) newClientConn(c net.Conn, initialRequest *http.Request, sing
 		cs := cc.newStream()
 		cs.req = initialRequest
 		cs.trace = httptrace.ContextClientTrace(initialRequest.Context())
+		cc.firstStream = cs
 	}
 
 	if cs, ok := c.(connectionStater); ok {
@@ -822,6 +876,40 @@ func (cc *ClientConn) setGoAway(f *GoAwayFrame) {
 	}
 }
 
+// UpgradeResponse returns the response to the h2c upgrade request which established the
+// connection. This is nil if the connection wasn't upgraded
+func (cc *ClientConn) UpgradeResponse() *UpgradeResponse {
+	return cc.upgrade
+}
+
+// SettingsReceived returns when the server's first SETTINGS frame was read.
+// This is zero if it hasn't been read yet
+func (cc *ClientConn) SettingsReceived() time.Time {
+	select {
+	case <-cc.settingsc:
+		return cc.settingsAt
+	default:
+		return time.Time{}
+	}
+}
+
+// MaxConcurrentStreams returns the server's SETTINGS_MAX_CONCURRENT_STREAMS.
+// Before the server's SETTINGS are read, this is the default of 1000
+func (cc *ClientConn) MaxConcurrentStreams() uint32 {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.maxConcurrentStreams
+}
+
+// Closing reports whether the connection has received a GOAWAY or been closed.
+// Unlike CanTakeNewRequest, this ignores the stream limit, so once true the
+// connection will never take a new request
+func (cc *ClientConn) Closing() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.goAway != nil || cc.closed || cc.closing
+}
+
 // CanTakeNewRequest reports whether the connection can take a new request,
 // meaning it has not been closed or received or sent a GOAWAY.
 func (cc *ClientConn) CanTakeNewRequest() bool {
@@ -1291,6 +1379,7 @@ func (cc *ClientConn) roundTrip(req *http.Request) (res *http.Response, gotErrAf
 
 var ErrAllowHTTPNotEnabled = fmt.Errorf("Unable to read first response. Allow HTTP not enabled.")
 var ErrAlreadyRead = fmt.Errorf("First read already performed.")
+var ErrNoUpgradeStream = fmt.Errorf("Unable to read first response. Conn was not upgraded.")
 
 // readFirstResponse will read the first response from the stream. This should only be called once
 // before subsequent requests are made.
@@ -1305,22 +1394,17 @@ func (cc *ClientConn) readFirstResponse(req *http.Request) (*http.Response, erro
 	}
 	cc.firstRead = true
 
-	var cs *clientStream
-	for {
-		cs = cc.streamByID(1, false) // we can assume the streamID is always 1 since its the first
-		if cs != nil {
-			cc.vlogf("http2: got stream")
-			break
-		}
+	cs := cc.firstStream
+	if cs == nil {
+		return nil, ErrNoUpgradeStream
+	}
 
-		select {
-		case <-req.Context().Done():
-			return nil, req.Context().Err()
-		default:
-			continue
-		}
+	var res resAndError
+	select {
+	case res = <-cs.resc:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
 	}
-	res := <-cs.resc
 	if res.res != nil {
 		res.res.Request = req
 	}
@@ -1952,6 +2036,8 @@ func (rl *clientConnReadLoop) run() error {
 				return ConnectionError(ErrCodeProtocol)
 			}
 			gotSettings = true
+			cc.settingsAt = time.Now()
+			close(cc.settingsc)
 		}
 		maybeIdle := false // whether frame might transition us to idle
 
@@ -0,0 +1,150 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// UpgradeHeader is a single header line of an upgrade response, as it was sent
+type UpgradeHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// UpgradeResponse is the raw HTTP/1.1 response to an h2c upgrade request.
+// Headers are kept in the order they were recieved, with their original casing and duplicates
+type UpgradeResponse struct {
+	StatusLine string          `json:"status-line"`
+	StatusCode int             `json:"status"`
+	Proto      string          `json:"proto"`
+	Headers    []UpgradeHeader `json:"headers"`
+	Body       string          `json:"body,omitempty"`
+
+	// Sent is when the upgrade request was written
+	Sent time.Time `json:"sent"`
+	// Duration is the time from Sent until the response was read
+	Duration time.Duration `json:"duration"`
+}
+
+// Header returns the first value of the header with the canonical name key
+func (u *UpgradeResponse) Header(key string) string {
+	key = http.CanonicalHeaderKey(key)
+	for _, h := range u.Headers {
+		if http.CanonicalHeaderKey(h.Name) == key {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+func (u *UpgradeResponse) String() string {
+	return u.StatusLine
+}
+
+// ReadUpgradeResponse will read the HTTP/1.1 response to an upgrade request from br. The header block is read line by line
+// so it can be recorded verbatim before being parsed by net/http
+func ReadUpgradeResponse(br *bufio.Reader, sent time.Time) (*UpgradeResponse, error) {
+	u := &UpgradeResponse{Sent: sent}
+
+	var head bytes.Buffer
+	tp := textproto.NewReader(br)
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		head.WriteString(line)
+		head.WriteString("\r\n")
+		if u.StatusLine == "" {
+			u.StatusLine = line
+			continue
+		}
+		if line == "" {
+			break
+		}
+		name, value := line, ""
+		if i := strings.IndexByte(line, ':'); i != -1 {
+			name, value = line[:i], strings.TrimLeft(line[i+1:], " \t")
+		}
+		u.Headers = append(u.Headers, UpgradeHeader{Name: name, Value: value})
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(&head), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	// the body is read from br directly, so nothing after the response is consumed
+	var r io.Reader
+	switch {
+	case resp.StatusCode < 200 || resp.StatusCode == 204 || resp.StatusCode == 304:
+		r = bytes.NewReader(nil)
+	case len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked":
+		r = io.MultiReader(httputil.NewChunkedReader(br), trailerReader{tp})
+	case resp.ContentLength >= 0:
+		r = io.LimitReader(br, resp.ContentLength)
+	default:
+		r = br
+	}
+
+	u.StatusCode = resp.StatusCode
+	u.Proto = resp.Proto
+	body, err := ioutil.ReadAll(r)
+	u.Body = string(body)
+	u.Duration = time.Since(sent)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// trailerReader will discard the trailer of a chunked body once the last chunk is read
+type trailerReader struct {
+	tp *textproto.Reader
+}
+
+func (t trailerReader) Read(p []byte) (int, error) {
+	if _, err := t.tp.ReadMIMEHeader(); err != nil {
+		return 0, err
+	}
+	return 0, io.EOF
+}
+
+// NoH2Error is returned when the upgrade was accepted with a 101, but the server didn't
+// speak http2 afterwards. Either no valid SETTINGS frame was recieved, or a PING wasn't acknowledged
+type NoH2Error struct {
+	// Response is the full response to the upgrade request
+	Response *UpgradeResponse
+	Err      error
+}
+
+func (e NoH2Error) Error() string {
+	return fmt.Sprintf("101 recieved without http2: %v", e.Err)
+}
+
+func (e NoH2Error) Unwrap() error {
+	return e.Err
+}
+
+// verifyUpgrade will ensure the server is speaking http2 after the upgrade. This waits for the server's
+// SETTINGS frame, then sends a PING and waits for the ACK. The connection deadline or ctx bounds the wait
+func (cc *ClientConn) verifyUpgrade(ctx context.Context) error {
+	select {
+	case <-cc.settingsc:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-cc.readerDone:
+		return cc.readerErr
+	}
+	return cc.Ping(ctx)
+}
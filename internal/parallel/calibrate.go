@@ -0,0 +1,204 @@
+package parallel
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CalibrationPaths are the random paths sent to calibrate each baseline. {random} is replaced
+// with a random token for each request
+var CalibrationPaths = []string{
+	"/{random}",
+	"/{random}.html",
+	"/{random}/{random}",
+}
+
+// AutoCalibrate will calibrate a baseline by sending random paths which shouldn't exist through
+// the tunnel. Results which match the baseline are treated as soft 404s and aren't shown.
+// A baseline is calibrated for each :authority and method the targets are sent with, once the
+// first response to one of them arrives. Every result waits for its baseline, so none are shown
+// unchecked. This is only supported by GetPathsOnHost and GetPathStreamOnHost
+func AutoCalibrate() ParallelOption {
+	return func(o *ParallelOptions) {
+		o.AutoCalibrate = true
+	}
+}
+
+// fingerprint identifies a response for calibration. The body is normalized by removing the
+// request's path and :authority first, since soft 404 pages often reflect them
+type fingerprint struct {
+	status int
+	size   int
+	words  int
+	hash   string
+}
+
+func newFingerprint(r *res) fingerprint {
+	body := r.body
+	for _, v := range r.reflections() {
+		// removing a single character, e.g. the path /, would mangle the whole body
+		if len(v) > 1 {
+			body = bytes.ReplaceAll(body, []byte(v), nil)
+		}
+	}
+	sum := sha256.Sum256(body)
+	return fingerprint{
+		status: r.res.StatusCode,
+		size:   len(body),
+		words:  len(bytes.Fields(body)),
+		hash:   hex.EncodeToString(sum[:8]),
+	}
+}
+
+// reflections returns the parts of the request which may be reflected in the response body
+func (r *res) reflections() []string {
+	ret := []string{r.authority}
+	if u, err := url.Parse(r.target); err == nil {
+		ret = append(ret, u.RequestURI(), u.EscapedPath(), u.Path)
+	}
+	return ret
+}
+
+// calibration is the baseline for an :authority and method
+type calibration struct {
+	done         chan struct{}
+	fingerprints []fingerprint
+}
+
+// matches reports whether fp looks like the baseline. A response matches if it has the same
+// status as a baseline, and its normalized body is identical or its size is within the range of
+// the baselines. If the baselines vary in size but not in word count, the word count is used instead
+func (c *calibration) matches(fp fingerprint) bool {
+	minSize, maxSize, words := -1, -1, -1
+	for _, b := range c.fingerprints {
+		if b.status != fp.status {
+			continue
+		}
+		if b.hash == fp.hash {
+			return true
+		}
+		if minSize == -1 {
+			minSize, maxSize, words = b.size, b.size, b.words
+		}
+		if b.size < minSize {
+			minSize = b.size
+		}
+		if b.size > maxSize {
+			maxSize = b.size
+		}
+		if b.words != words {
+			words = -2
+		}
+	}
+	if minSize == -1 {
+		return false
+	}
+	if fp.size >= minSize && fp.size <= maxSize {
+		return true
+	}
+	return minSize != maxSize && fp.words == words
+}
+
+// calibrator holds the baselines for a run. Each baseline is calibrated once, by the first worker
+// with a response which needs it, and shared by the others. They wait for it to complete
+type calibrator struct {
+	mu           sync.Mutex
+	calibrations map[string]*calibration
+}
+
+func newCalibrator() *calibrator {
+	return &calibrator{calibrations: map[string]*calibration{}}
+}
+
+// soft404 reports whether r matches the baseline for its :authority and method. The baseline is
+// calibrated through h with muts, the mutations r was sent with, if needed
+func (c *calibrator) soft404(ctx context.Context, h *hostTunnel, r *res, muts ...RequestMutation) bool {
+	if r.err != nil || r.res == nil {
+		return false
+	}
+	key := r.method + " " + r.authority
+
+	c.mu.Lock()
+	cal, ok := c.calibrations[key]
+	if !ok {
+		cal = &calibration{done: make(chan struct{})}
+		c.calibrations[key] = cal
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		cal.fingerprints = calibrate(ctx, h, r.target, muts...)
+		logCalibration(r, cal.fingerprints)
+		close(cal.done)
+	}
+	select {
+	case <-cal.done:
+	case <-ctx.Done():
+		return false
+	}
+	return cal.matches(newFingerprint(r))
+}
+
+// calibrate will send each of CalibrationPaths, relative to target, returning the fingerprints of
+// the responses
+func calibrate(ctx context.Context, h *hostTunnel, target string, muts ...RequestMutation) []fingerprint {
+	base, err := url.Parse(target)
+	if err != nil {
+		return nil
+	}
+
+	fps := []fingerprint{}
+	for _, p := range CalibrationPaths {
+		ref, err := url.Parse(randomPath(p))
+		if err != nil {
+			continue
+		}
+		t := base.ResolveReference(ref).String()
+		r, err := h.do(ctx, t, muts...)
+		if err != nil {
+			log.WithField("target", t).WithError(err).Debugf("failed to calibrate")
+			continue
+		}
+		fps = append(fps, newFingerprint(&r))
+	}
+	return fps
+}
+
+func logCalibration(r *res, fps []fingerprint) {
+	statuses := []int{}
+	sizes := []int{}
+	words := []int{}
+	hashes := []string{}
+	for _, fp := range fps {
+		statuses = append(statuses, fp.status)
+		sizes = append(sizes, fp.size)
+		words = append(words, fp.words)
+		hashes = append(hashes, fp.hash)
+	}
+	log.WithFields(log.Fields{
+		"authority": r.authority,
+		"method":    r.method,
+		"status":    statuses,
+		"sizes":     sizes,
+		"words":     words,
+		"hashes":    hashes,
+	}).Debugf("calibrated")
+}
+
+// randomPath replaces each {random} in p with a random token
+func randomPath(p string) string {
+	return string(bytes.ReplaceAll([]byte(p), []byte("{random}"), []byte(randomToken())))
+}
+
+func randomToken() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
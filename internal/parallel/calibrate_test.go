@@ -0,0 +1,63 @@
+package parallel
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCalibrator_soft404(t *testing.T) {
+	var requests int32
+	srv := newH2CServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST":
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case r.Host == "internal":
+			// dynamic content, which keeps the same size
+			fmt.Fprintf(w, "internal %d", 1000+atomic.AddInt32(&requests, 1))
+		case r.URL.Path == "/admin":
+			fmt.Fprintf(w, "admin panel")
+		case r.URL.Path == "/empty":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			// a soft 404 which reflects the path
+			fmt.Fprintf(w, "<html>page %s not found on %s</html>", r.URL.Path, r.Host)
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		path string
+		muts []RequestMutation
+		want bool
+	}{
+		{name: "soft 404", path: "/missing", want: true},
+		{name: "nested soft 404", path: "/a/b/c.php", want: true},
+		{name: "real page", path: "/admin", want: false},
+		{name: "different status", path: "/empty", want: false},
+		{name: "per method", path: "/admin", muts: []RequestMutation{RequestMutation(func(r *http.Request) { r.Method = "POST" })}, want: true},
+		{name: "per authority", path: "/admin", muts: []RequestMutation{authority("internal")}, want: true},
+	}
+
+	c := New()
+	defer c.Close()
+	cal := newCalibrator()
+	h := &hostTunnel{c: c, base: srv.URL, stats: &runStats{}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := h.do(context.Background(), srv.URL+tt.path, tt.muts...)
+			if err != nil {
+				t.Fatalf("hostTunnel.do() error = %v", err)
+			}
+			if got := cal.soft404(context.Background(), h, &r, tt.muts...); got != tt.want {
+				t.Errorf("calibrator.soft404() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if got := len(cal.calibrations); got != 3 {
+		t.Errorf("calibrations = %d, want 3", got)
+	}
+}
@@ -2,24 +2,104 @@ package parallel
 
 import (
 	"bytes"
+	"crypto/tls"
 	"net/http"
+	"time"
 
+	"github.com/minight/h2csmuggler"
 	"github.com/minight/h2csmuggler/http2"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
 type res struct {
-	target string
-	res    *http.Response // response.Body is already read and closed and stored on body
-	body   []byte
-	err    error
+	target    string
+	method    string
+	authority string         // the :authority the request was sent with
+	res       *http.Response // response.Body is already read and closed and stored on body
+	body      []byte
+	err       error
+	mode      h2csmuggler.Mode
+	variant   string // name of the upgrade variant used, if any
+	tls       *tls.ConnectionState
+	upgrade   *http2.UpgradeResponse
+	result    h2csmuggler.UpgradeResult
+	timing    *h2csmuggler.ConnTiming
+	stream    *h2csmuggler.StreamTiming // the timing of the result's own stream
+	// duration is the time from sending the request to reading the whole response
+	duration time.Duration
+	soft404  bool // the result matches the auto calibration baseline
+	// pathVariant is set if the target is a path variant of another target. See MutatePaths
+	pathVariant bool
+	seq         int // the order the target was dispatched in. See Client.Ordered
 }
 
 func (r *res) IsNil() bool {
 	return r.err == nil && r.res == nil
 }
 
+// variantFields returns the upgrade variant of the result. This is empty if no variant was used
+func (r *res) variantFields() log.Fields {
+	if r.variant == "" {
+		return log.Fields{}
+	}
+	return log.Fields{"variant": r.variant}
+}
+
+// upgradeFields returns the response to the upgrade request. This is empty if the result
+// wasn't received over an upgraded connection
+func (r *res) upgradeFields() log.Fields {
+	fields := log.Fields{}
+	if r.upgrade != nil {
+		fields["upgrade"] = r.upgrade
+	}
+	if r.result != h2csmuggler.UpgradeUnknown {
+		fields["upgrade-result"] = r.result.String()
+	}
+	return fields
+}
+
+// timingFields returns the timing breakdown of the connection the result was received on, and
+// of its stream
+func (r *res) timingFields() log.Fields {
+	fields := log.Fields{}
+	if r.timing != nil {
+		fields["timing"] = r.timing
+	}
+	if r.stream != nil {
+		fields["stream-timing"] = r.stream
+	}
+	return fields
+}
+
+// detailFields returns all the details of how the result was received
+func (r *res) detailFields() log.Fields {
+	fields := log.Fields{}
+	for _, f := range []log.Fields{r.variantFields(), r.upgradeFields(), r.timingFields(), r.tlsFields()} {
+		for k, v := range f {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
+// tlsFields returns the negotiated tls details of the result. This is empty if the
+// result wasn't received over tls
+func (r *res) tlsFields() log.Fields {
+	if r.tls == nil {
+		return log.Fields{}
+	}
+	fields := log.Fields{
+		"tls-version": h2csmuggler.TLSVersionName(r.tls.Version),
+		"tls-cipher":  tls.CipherSuiteName(r.tls.CipherSuite),
+		"tls-alpn":    r.tls.NegotiatedProtocol,
+	}
+	if len(r.tls.PeerCertificates) > 0 {
+		fields["tls-peer"] = r.tls.PeerCertificates[0].Subject.String()
+	}
+	return fields
+}
+
 func (r *res) Log(source string) {
 	log.WithFields(log.Fields{
 		"body":   string(r.body),
@@ -34,24 +114,31 @@ func (r *res) Log(source string) {
 				"status": uscErr.Code,
 				"target": r.target,
 				"source": source,
-			}).Errorf("unexpected status code")
+			}).WithFields(r.detailFields()).Errorf("unexpected status code")
 		} else {
 			log.WithField("target", r.target).WithError(r.err).Errorf("failed")
 		}
 	} else {
+		resp := r.response()
 		log.WithFields(log.Fields{
-			"status":  r.res.StatusCode,
-			"headers": r.res.Header,
-			"body":    len(r.body),
-			"target":  r.target,
-			"source":  source,
-		}).Infof("success")
+			"status":   r.res.StatusCode,
+			"headers":  r.res.Header,
+			"body":     len(r.body),
+			"words":    resp.Words(),
+			"lines":    resp.Lines(),
+			"duration": r.duration,
+			"target":   r.target,
+			"source":   source,
+		}).WithFields(r.detailFields()).Infof("success")
 	}
 }
 
 type Diff struct {
 	HTTP2 *res
 	H2C   *res
+	// Hidden is set if the h2c result didn't pass the matchers and filters, so the pair is
+	// dropped without being compared
+	Hidden bool
 }
 
 type ResponseDiff struct {
@@ -76,6 +163,16 @@ func (r *ResponseDiff) ShowDiffH2C(http2res *res) {
 	r.diffHosts(d)
 }
 
+// HideH2C will drop the pair of the h2c result without showing it, e.g. as it was filtered.
+// if the corresponding response is not cached, it's dropped once it arrives
+func (r *ResponseDiff) HideH2C(h2cres *res) {
+	d := r.diffH2C(h2cres)
+	d.Hidden = true
+	if d.HTTP2 != nil && r.DeleteOnShow {
+		delete(r.cache, h2cres.target)
+	}
+}
+
 // ShowDiffHTTP2 will show if there's a diff between the http2 and h2c responses.
 // if the corresponding response is not cached, this does nothing
 func (r *ResponseDiff) ShowDiffHTTP2(http2res *res) {
@@ -87,13 +184,18 @@ func (r *ResponseDiff) ShowDiffHTTP2(http2res *res) {
 }
 
 func (r *ResponseDiff) diffHosts(d *Diff) {
+	if d.Hidden {
+		if r.DeleteOnShow {
+			delete(r.cache, d.HTTP2.target)
+		}
+		return
+	}
 	log.Tracef("got d: %+v", d)
 	log.Tracef("r is :%+v", r)
 	diff := false
 	fields := log.Fields{}
 	debugFields := log.Fields{}
 
-
 	if d.HTTP2.err != d.H2C.err {
 		diff = true
 		if d.H2C.err != nil {
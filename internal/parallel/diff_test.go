@@ -0,0 +1,33 @@
+package parallel
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestResponseDiff_HideH2C(t *testing.T) {
+	tests := []struct {
+		name       string
+		http2First bool
+	}{
+		{name: "h2c first"},
+		{name: "http2 first", http2First: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDiffer(true)
+			h2c := &res{target: "/a", res: &http.Response{StatusCode: 200}}
+			http2 := &res{target: "/a", res: &http.Response{StatusCode: 403}}
+			if tt.http2First {
+				d.ShowDiffHTTP2(http2)
+				d.HideH2C(h2c)
+			} else {
+				d.HideH2C(h2c)
+				d.ShowDiffHTTP2(http2)
+			}
+			if len(d.cache) != 0 {
+				t.Errorf("ResponseDiff cache = %v, want the hidden pair dropped", d.cache)
+			}
+		})
+	}
+}
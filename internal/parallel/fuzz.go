@@ -0,0 +1,233 @@
+package parallel
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// FuzzClusterBomb sends every combination of the words
+	FuzzClusterBomb = "clusterbomb"
+	// FuzzPitchfork sends the nth word of each wordlist together
+	FuzzPitchfork = "pitchfork"
+
+	// DefaultFuzzKeyword is the keyword of a wordlist which doesn't name one
+	DefaultFuzzKeyword = "FUZZ"
+)
+
+// FuzzWordlist binds a keyword, e.g. FUZZ or FUZ2Z, to the words which replace it
+type FuzzWordlist struct {
+	Keyword string
+	Words   []string
+}
+
+// ReadFuzzWordlist will read a wordlist from a ffuf style argument, filename:KEYWORD. The keyword
+// defaults to FUZZ, and - reads stdin. Blank lines are skipped
+func ReadFuzzWordlist(arg string) (FuzzWordlist, error) {
+	filename, keyword := splitFuzzWordlist(arg)
+	wl := FuzzWordlist{Keyword: keyword}
+
+	in := io.Reader(os.Stdin)
+	if filename != "-" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return wl, errors.Wrap(err, "failed to open wordlist")
+		}
+		defer f.Close()
+		in = f
+	}
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		if w := strings.TrimRight(scanner.Text(), "\r"); w != "" {
+			wl.Words = append(wl.Words, w)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return wl, errors.Wrapf(err, "failed to read wordlist %v", filename)
+	}
+	return wl, nil
+}
+
+// splitFuzzWordlist splits filename:KEYWORD. A colon followed by a path separator is part of
+// the filename, e.g. C:\words.txt
+func splitFuzzWordlist(arg string) (filename string, keyword string) {
+	i := strings.LastIndex(arg, ":")
+	if i == -1 || i == len(arg)-1 || strings.ContainsAny(arg[i+1:], `/\`) {
+		return arg, DefaultFuzzKeyword
+	}
+	return arg[:i], arg[i+1:]
+}
+
+// Fuzzer generates request specs from a template, replacing each wordlist's keyword with its
+// words wherever it appears in the url, method, :authority, headers, body or body file. Keywords
+// in expect_body are replaced with the words quoted, so responses can be checked for reflections
+type Fuzzer struct {
+	Template  RequestSpec
+	Wordlists []FuzzWordlist
+	// Mode is how the wordlists are combined, FuzzClusterBomb or FuzzPitchfork. Pitchfork stops
+	// at the end of the shortest wordlist
+	Mode string
+}
+
+// validate will check the mode and that every keyword is used by the template
+func (f *Fuzzer) validate() error {
+	if f.Mode != FuzzClusterBomb && f.Mode != FuzzPitchfork {
+		return errors.Errorf("invalid fuzz mode %q. expected %v or %v", f.Mode, FuzzClusterBomb, FuzzPitchfork)
+	}
+	if len(f.Wordlists) == 0 {
+		return errors.Errorf("no wordlists to fuzz with")
+	}
+	if f.Template.URL == "" {
+		return errors.Errorf("template has no url")
+	}
+
+	t := f.Template
+	fields := []string{t.URL, t.Method, t.Authority, t.Body, t.BodyFile, t.ExpectBody}
+	for k, v := range t.Headers {
+		fields = append(fields, k, v)
+	}
+	used := strings.Join(fields, "\n")
+	seen := map[string]struct{}{}
+	for _, wl := range f.Wordlists {
+		if wl.Keyword == "" {
+			return errors.Errorf("wordlist has no keyword")
+		}
+		if _, ok := seen[wl.Keyword]; ok {
+			return errors.Errorf("keyword %v is bound to more than one wordlist", wl.Keyword)
+		}
+		seen[wl.Keyword] = struct{}{}
+		if !strings.Contains(used, wl.Keyword) {
+			return errors.Errorf("keyword %v isn't used in the template", wl.Keyword)
+		}
+		if len(wl.Words) == 0 {
+			return errors.Errorf("wordlist for %v is empty", wl.Keyword)
+		}
+	}
+	return nil
+}
+
+// Count returns the number of specs which will be generated
+func (f *Fuzzer) Count() int {
+	if len(f.Wordlists) == 0 {
+		return 0
+	}
+	n := len(f.Wordlists[0].Words)
+	for _, wl := range f.Wordlists[1:] {
+		if f.Mode != FuzzPitchfork {
+			n *= len(wl.Words)
+		} else if len(wl.Words) < n {
+			n = len(wl.Words)
+		}
+	}
+	return n
+}
+
+// Specs will validate the template, and then generate each spec on the returned channel as it's
+// received. The channel is closed once every combination has been generated, or ctx is cancelled.
+// Specs which fail to initialize, e.g. a body file which doesn't exist, are logged and skipped
+func (f *Fuzzer) Specs(ctx context.Context) (<-chan *RequestSpec, error) {
+	if err := f.validate(); err != nil {
+		return nil, err
+	}
+
+	// replace longer keywords first, so FUZZ doesn't clobber part of FUZZ2
+	order := make([]int, len(f.Wordlists))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return len(f.Wordlists[order[a]].Keyword) > len(f.Wordlists[order[b]].Keyword)
+	})
+
+	out := make(chan *RequestSpec)
+	go func() {
+		defer close(out)
+		idx := make([]int, len(f.Wordlists))
+		for n := 1; ; n++ {
+			s := f.spec(n, idx, order)
+			if err := s.init(); err != nil {
+				log.WithField("id", s.ID).WithError(err).Errorf("failed to generate spec")
+			} else {
+				select {
+				case out <- s:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if !f.next(idx) {
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// next advances idx to the next combination, returning false once they're exhausted
+func (f *Fuzzer) next(idx []int) bool {
+	if f.Mode == FuzzPitchfork {
+		for i := range idx {
+			idx[i]++
+			if idx[i] >= len(f.Wordlists[i].Words) {
+				return false
+			}
+		}
+		return true
+	}
+
+	// the last wordlist changes fastest
+	for i := len(idx) - 1; i >= 0; i-- {
+		idx[i]++
+		if idx[i] < len(f.Wordlists[i].Words) {
+			return true
+		}
+		idx[i] = 0
+	}
+	return false
+}
+
+// spec returns the nth spec, with the words at idx
+func (f *Fuzzer) spec(n int, idx []int, order []int) *RequestSpec {
+	inputs := map[string]string{}
+	pairs := []string{}
+	quoted := []string{}
+	for _, i := range order {
+		wl := f.Wordlists[i]
+		w := wl.Words[idx[i]]
+		inputs[wl.Keyword] = w
+		pairs = append(pairs, wl.Keyword, w)
+		quoted = append(quoted, wl.Keyword, regexp.QuoteMeta(w))
+	}
+	r := strings.NewReplacer(pairs...)
+
+	t := f.Template
+	s := &RequestSpec{
+		ID:           strconv.Itoa(n),
+		Method:       r.Replace(t.Method),
+		URL:          r.Replace(t.URL),
+		Authority:    r.Replace(t.Authority),
+		Body:         r.Replace(t.Body),
+		BodyFile:     r.Replace(t.BodyFile),
+		ExpectStatus: t.ExpectStatus,
+		ExpectBody:   strings.NewReplacer(quoted...).Replace(t.ExpectBody),
+		Inputs:       inputs,
+	}
+	if t.ID != "" {
+		s.ID = t.ID + "-" + s.ID
+	}
+	if len(t.Headers) > 0 {
+		s.Headers = make(map[string]string, len(t.Headers))
+		for k, v := range t.Headers {
+			s.Headers[r.Replace(k)] = r.Replace(v)
+		}
+	}
+	return s
+}
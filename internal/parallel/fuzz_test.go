@@ -0,0 +1,184 @@
+package parallel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func Test_splitFuzzWordlist(t *testing.T) {
+	tests := []struct {
+		arg          string
+		wantFilename string
+		wantKeyword  string
+	}{
+		{arg: "words.txt", wantFilename: "words.txt", wantKeyword: "FUZZ"},
+		{arg: "words.txt:HOST", wantFilename: "words.txt", wantKeyword: "HOST"},
+		{arg: "-:FUZ2Z", wantFilename: "-", wantKeyword: "FUZ2Z"},
+		{arg: `C:\words.txt`, wantFilename: `C:\words.txt`, wantKeyword: "FUZZ"},
+		{arg: "words.txt:", wantFilename: "words.txt:", wantKeyword: "FUZZ"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.arg, func(t *testing.T) {
+			filename, keyword := splitFuzzWordlist(tt.arg)
+			if filename != tt.wantFilename || keyword != tt.wantKeyword {
+				t.Errorf("splitFuzzWordlist() = %v, %v, want %v, %v", filename, keyword, tt.wantFilename, tt.wantKeyword)
+			}
+		})
+	}
+}
+
+func TestFuzzer_Specs(t *testing.T) {
+	tests := []struct {
+		name      string
+		f         Fuzzer
+		want      []string
+		wantCount int
+		wantErr   bool
+	}{
+		{
+			name: "clusterbomb",
+			f: Fuzzer{
+				Template:  RequestSpec{URL: "/FUZZ", Headers: map[string]string{"Host": "FUZ2Z"}},
+				Wordlists: []FuzzWordlist{{Keyword: "FUZZ", Words: []string{"a", "b"}}, {Keyword: "FUZ2Z", Words: []string{"x", "y", "z"}}},
+				Mode:      FuzzClusterBomb,
+			},
+			want:      []string{"1 /a x", "2 /a y", "3 /a z", "4 /b x", "5 /b y", "6 /b z"},
+			wantCount: 6,
+		},
+		{
+			name: "pitchfork stops at the shortest",
+			f: Fuzzer{
+				Template:  RequestSpec{ID: "t", URL: "/FUZZ", Headers: map[string]string{"Host": "FUZ2Z"}},
+				Wordlists: []FuzzWordlist{{Keyword: "FUZZ", Words: []string{"a", "b"}}, {Keyword: "FUZ2Z", Words: []string{"x", "y", "z"}}},
+				Mode:      FuzzPitchfork,
+			},
+			want:      []string{"t-1 /a x", "t-2 /b y"},
+			wantCount: 2,
+		},
+		{
+			name: "longer keywords first",
+			f: Fuzzer{
+				Template:  RequestSpec{URL: "/FUZZ/FUZZ2", Headers: map[string]string{"Host": "h"}},
+				Wordlists: []FuzzWordlist{{Keyword: "FUZZ", Words: []string{"a"}}, {Keyword: "FUZZ2", Words: []string{"b"}}},
+				Mode:      FuzzClusterBomb,
+			},
+			want:      []string{"1 /a/b h"},
+			wantCount: 1,
+		},
+		{
+			name: "unused keyword",
+			f: Fuzzer{
+				Template:  RequestSpec{URL: "/FUZZ"},
+				Wordlists: []FuzzWordlist{{Keyword: "HOST", Words: []string{"a"}}},
+				Mode:      FuzzClusterBomb,
+			},
+			wantErr: true,
+		},
+		{
+			name: "duplicate keyword",
+			f: Fuzzer{
+				Template:  RequestSpec{URL: "/FUZZ"},
+				Wordlists: []FuzzWordlist{{Keyword: "FUZZ", Words: []string{"a"}}, {Keyword: "FUZZ", Words: []string{"b"}}},
+				Mode:      FuzzClusterBomb,
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid mode",
+			f: Fuzzer{
+				Template:  RequestSpec{URL: "/FUZZ"},
+				Wordlists: []FuzzWordlist{{Keyword: "FUZZ", Words: []string{"a"}}},
+				Mode:      "sniper",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			specs, err := tt.f.Specs(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Fuzzer.Specs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got := []string{}
+			for s := range specs {
+				got = append(got, fmt.Sprintf("%v %v %v", s.ID, s.URL, s.Headers["Host"]))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Fuzzer.Specs() = %v, want %v", got, tt.want)
+			}
+			if c := tt.f.Count(); c != tt.wantCount {
+				t.Errorf("Fuzzer.Count() = %v, want %v", c, tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestClient_GetSpecStreamOnHost(t *testing.T) {
+	srv := newH2CServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s", r.Host, r.URL.Path, r.Header.Get("X-Test"))
+	}))
+	defer srv.Close()
+
+	f := &Fuzzer{
+		Template: RequestSpec{
+			URL:        "/FUZZ",
+			Authority:  "HOST.internal",
+			Headers:    map[string]string{"X-Test": "FUZZ"},
+			ExpectBody: "^HOST.internal /FUZZ FUZZ$",
+		},
+		Wordlists: []FuzzWordlist{{Keyword: "FUZZ", Words: []string{"a", "b.c"}}, {Keyword: "HOST", Words: []string{"api"}}},
+		Mode:      FuzzClusterBomb,
+	}
+	specs, err := f.Specs(context.Background())
+	if err != nil {
+		t.Fatalf("Fuzzer.Specs() error = %v", err)
+	}
+
+	c := New()
+	defer c.Close()
+	var out bytes.Buffer
+	if err := c.GetSpecStreamOnHost(srv.URL, specs, &out); err != nil {
+		t.Fatalf("Client.GetSpecStreamOnHost() error = %v", err)
+	}
+
+	got := map[string]SpecResult{}
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var r SpecResult
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("json.Unmarshal() error = %v", err)
+		}
+		got[r.ID] = r
+	}
+	tests := []struct {
+		id         string
+		wantBody   string
+		wantInputs map[string]string
+	}{
+		{id: "1", wantBody: "api.internal /a a", wantInputs: map[string]string{"FUZZ": "a", "HOST": "api"}},
+		{id: "2", wantBody: "api.internal /b.c b.c", wantInputs: map[string]string{"FUZZ": "b.c", "HOST": "api"}},
+	}
+	if len(got) != len(tests) {
+		t.Fatalf("Client.GetSpecStreamOnHost() wrote %d results, want %d", len(got), len(tests))
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			r := got[tt.id]
+			if r.Body != tt.wantBody || !reflect.DeepEqual(r.Inputs, tt.wantInputs) {
+				t.Errorf("result = %q %v, want %q %v", r.Body, r.Inputs, tt.wantBody, tt.wantInputs)
+			}
+			if r.Match == nil || !*r.Match {
+				t.Errorf("result.Match = %v, want true", r.Match)
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package parallel
+
+import (
+	"bytes"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minight/h2csmuggler/http2"
+	"github.com/pkg/errors"
+)
+
+// Response is the result of a smuggled request, as seen by a Matcher
+type Response struct {
+	Target string
+	// Status is 0 if no response was received
+	Status int
+	Header http.Header
+	Body   []byte
+	// Duration is the time from sending the request to reading the whole response
+	Duration time.Duration
+	Err      error
+}
+
+// Words returns the number of whitespace separated words in the body
+func (r *Response) Words() int {
+	return len(bytes.Fields(r.Body))
+}
+
+// Lines returns the number of lines in the body
+func (r *Response) Lines() int {
+	if len(r.Body) == 0 {
+		return 0
+	}
+	return bytes.Count(r.Body, []byte("\n")) + 1
+}
+
+// response returns the view of the result given to matchers
+func (r *res) response() *Response {
+	resp := &Response{
+		Target:   r.target,
+		Body:     r.body,
+		Duration: r.duration,
+		Err:      r.err,
+	}
+	if r.res != nil {
+		resp.Status = r.res.StatusCode
+		resp.Header = r.res.Header
+	}
+	var uscErr http2.UnexpectedStatusCodeError
+	if errors.As(r.err, &uscErr) {
+		resp.Status = uscErr.Code
+	}
+	return resp
+}
+
+// Matcher is a predicate on a response. Use the Match functions to create them, and And, Or
+// and Not to combine them
+type Matcher func(r *Response) bool
+
+// And matches if all of ms match. An empty And always matches
+func And(ms ...Matcher) Matcher {
+	return func(r *Response) bool {
+		for _, m := range ms {
+			if !m(r) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Or matches if any of ms match. An empty Or never matches
+func Or(ms ...Matcher) Matcher {
+	return func(r *Response) bool {
+		for _, m := range ms {
+			if m(r) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Not matches if m doesn't
+func Not(m Matcher) Matcher {
+	return func(r *Response) bool {
+		return !m(r)
+	}
+}
+
+// Range is an inclusive range of integers
+type Range struct {
+	Min int
+	Max int
+}
+
+func (r Range) contains(n int) bool {
+	return n >= r.Min && n <= r.Max
+}
+
+// ParseRanges will parse a comma separated list of numbers and ranges. e.g. 200-299,301
+func ParseRanges(s string) ([]Range, error) {
+	ret := []Range{}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		bounds := strings.SplitN(v, "-", 2)
+		min, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, errors.Errorf("invalid range %q", v)
+		}
+		max := min
+		if len(bounds) == 2 {
+			max, err = strconv.Atoi(bounds[1])
+			if err != nil || max < min {
+				return nil, errors.Errorf("invalid range %q", v)
+			}
+		}
+		ret = append(ret, Range{Min: min, Max: max})
+	}
+	if len(ret) == 0 {
+		return nil, errors.Errorf("no ranges in %q", s)
+	}
+	return ret, nil
+}
+
+func matchRanges(ranges []Range, n func(r *Response) int) Matcher {
+	return func(r *Response) bool {
+		v := n(r)
+		for _, rng := range ranges {
+			if rng.contains(v) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MatchStatus matches responses with a status code in any of the ranges
+func MatchStatus(ranges ...Range) Matcher {
+	return matchRanges(ranges, func(r *Response) int { return r.Status })
+}
+
+// MatchSize matches responses with a body length in any of the ranges
+func MatchSize(ranges ...Range) Matcher {
+	return matchRanges(ranges, func(r *Response) int { return len(r.Body) })
+}
+
+// MatchWords matches responses with a word count in any of the ranges
+func MatchWords(ranges ...Range) Matcher {
+	return matchRanges(ranges, func(r *Response) int { return r.Words() })
+}
+
+// MatchLines matches responses with a line count in any of the ranges
+func MatchLines(ranges ...Range) Matcher {
+	return matchRanges(ranges, func(r *Response) int { return r.Lines() })
+}
+
+// MatchRegexp matches responses with a body matching re
+func MatchRegexp(re *regexp.Regexp) Matcher {
+	return func(r *Response) bool {
+		return re.Match(r.Body)
+	}
+}
+
+// MatchHeaderRegexp matches responses with a header matching re. Each header is matched as a
+// "Name: value" line
+func MatchHeaderRegexp(re *regexp.Regexp) Matcher {
+	return func(r *Response) bool {
+		keys := make([]string, 0, len(r.Header))
+		for k := range r.Header {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			for _, v := range r.Header[k] {
+				if re.MatchString(k + ": " + v) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// MatchSlower matches responses which took longer than d
+func MatchSlower(d time.Duration) Matcher {
+	return func(r *Response) bool {
+		return r.Duration > d
+	}
+}
+
+// MatchFaster matches responses which took less than d
+func MatchFaster(d time.Duration) Matcher {
+	return func(r *Response) bool {
+		return r.Duration < d
+	}
+}
+
+const (
+	MatchKindStatus = "status"
+	MatchKindSize   = "size"
+	MatchKindWords  = "words"
+	MatchKindLines  = "lines"
+	MatchKindRegexp = "regexp"
+	MatchKindHeader = "header"
+	MatchKindTime   = "time"
+)
+
+// ParseMatcher will parse a matcher of the given kind, in the same format as ffuf:
+//   - status, size, words, lines: ranges as in ParseRanges. status also accepts all
+//   - regexp, header: a regular expression. See MatchHeaderRegexp
+//   - time: >duration or <duration. A duration without units is in milliseconds. e.g. >500
+func ParseMatcher(kind string, value string) (Matcher, error) {
+	switch kind {
+	case MatchKindStatus, MatchKindSize, MatchKindWords, MatchKindLines:
+		if kind == MatchKindStatus && value == "all" {
+			return func(r *Response) bool { return r.Status != 0 }, nil
+		}
+		ranges, err := ParseRanges(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %v matcher", kind)
+		}
+		return map[string]func(...Range) Matcher{
+			MatchKindStatus: MatchStatus,
+			MatchKindSize:   MatchSize,
+			MatchKindWords:  MatchWords,
+			MatchKindLines:  MatchLines,
+		}[kind](ranges...), nil
+	case MatchKindRegexp, MatchKindHeader:
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %v matcher", kind)
+		}
+		if kind == MatchKindHeader {
+			return MatchHeaderRegexp(re), nil
+		}
+		return MatchRegexp(re), nil
+	case MatchKindTime:
+		if len(value) < 2 || (value[0] != '>' && value[0] != '<') {
+			return nil, errors.Errorf("invalid time matcher %q. expected >duration or <duration", value)
+		}
+		v := value[1:]
+		if _, err := strconv.Atoi(v); err == nil {
+			v += "ms"
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid time matcher")
+		}
+		if value[0] == '>' {
+			return MatchSlower(d), nil
+		}
+		return MatchFaster(d), nil
+	}
+	return nil, errors.Errorf("unknown matcher %q", kind)
+}
+
+// ResultMatcher will only show results which match m. If used more than once, a result is shown
+// if it matches any of them. Combine matchers with And to require all of them
+func ResultMatcher(m Matcher) ParallelOption {
+	return func(o *ParallelOptions) {
+		o.Matchers = append(o.Matchers, m)
+	}
+}
+
+// ResultFilter will hide results which match m. If used more than once, a result is hidden if it
+// matches any of them. Filters take precedence over matchers
+func ResultFilter(m Matcher) ParallelOption {
+	return func(o *ParallelOptions) {
+		o.Filters = append(o.Filters, m)
+	}
+}
+
+// show reports whether the result passes the matchers and filters
+func (o *ParallelOptions) show(r *res) bool {
+	if len(o.Matchers) == 0 && len(o.Filters) == 0 {
+		return true
+	}
+	resp := r.response()
+	if len(o.Matchers) > 0 && !Or(o.Matchers...)(resp) {
+		return false
+	}
+	return !Or(o.Filters...)(resp)
+}
@@ -0,0 +1,85 @@
+package parallel
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseMatcher(t *testing.T) {
+	resp := &Response{
+		Status:   302,
+		Header:   http.Header{"Location": []string{"/login"}},
+		Body:     []byte("hello world\nsecond line"),
+		Duration: 600 * time.Millisecond,
+	}
+	tests := []struct {
+		name    string
+		kind    string
+		value   string
+		want    bool
+		wantErr bool
+	}{
+		{name: "status", kind: MatchKindStatus, value: "200,301-303", want: true},
+		{name: "status miss", kind: MatchKindStatus, value: "200-299", want: false},
+		{name: "status all", kind: MatchKindStatus, value: "all", want: true},
+		{name: "size", kind: MatchKindSize, value: "23", want: true},
+		{name: "words", kind: MatchKindWords, value: "4", want: true},
+		{name: "lines", kind: MatchKindLines, value: "1", want: false},
+		{name: "regexp", kind: MatchKindRegexp, value: "^hello", want: true},
+		{name: "header", kind: MatchKindHeader, value: "^Location: /login$", want: true},
+		{name: "slower", kind: MatchKindTime, value: ">500", want: true},
+		{name: "faster", kind: MatchKindTime, value: "<1s", want: true},
+		{name: "invalid range", kind: MatchKindStatus, value: "300-200", wantErr: true},
+		{name: "invalid regexp", kind: MatchKindRegexp, value: "(", wantErr: true},
+		{name: "invalid time", kind: MatchKindTime, value: "500", wantErr: true},
+		{name: "unknown", kind: "nope", value: "1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := ParseMatcher(tt.kind, tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseMatcher() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := m(resp); got != tt.want {
+				t.Errorf("Matcher() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParallelOptions_show(t *testing.T) {
+	ok := func(r *Response) bool { return r.Status == 200 }
+	big := func(r *Response) bool { return len(r.Body) > 4 }
+
+	tests := []struct {
+		name string
+		opts []ParallelOption
+		r    res
+		want bool
+	}{
+		{name: "no matchers", r: res{err: errors.New("failed")}, want: true},
+		{name: "match", opts: []ParallelOption{ResultMatcher(ok)}, r: res{res: &http.Response{StatusCode: 200}}, want: true},
+		{name: "no match", opts: []ParallelOption{ResultMatcher(ok)}, r: res{res: &http.Response{StatusCode: 404}}, want: false},
+		{name: "errors don't match", opts: []ParallelOption{ResultMatcher(ok)}, r: res{err: errors.New("failed")}, want: false},
+		{name: "matchers are or'd", opts: []ParallelOption{ResultMatcher(ok), ResultMatcher(big)}, r: res{res: &http.Response{StatusCode: 404}, body: []byte("large")}, want: true},
+		{name: "and", opts: []ParallelOption{ResultMatcher(And(ok, big))}, r: res{res: &http.Response{StatusCode: 200}, body: []byte("s")}, want: false},
+		{name: "filter", opts: []ParallelOption{ResultMatcher(ok), ResultFilter(big)}, r: res{res: &http.Response{StatusCode: 200}, body: []byte("large")}, want: false},
+		{name: "not filtered", opts: []ParallelOption{ResultFilter(Not(ok))}, r: res{res: &http.Response{StatusCode: 200}}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &ParallelOptions{}
+			for _, opt := range tt.opts {
+				opt(o)
+			}
+			if got := o.show(&tt.r); got != tt.want {
+				t.Errorf("ParallelOptions.show() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
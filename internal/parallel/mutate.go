@@ -0,0 +1,41 @@
+package parallel
+
+import (
+	"github.com/minight/h2csmuggler/internal/paths"
+	log "github.com/sirupsen/logrus"
+)
+
+// MutatePaths will also send the variants of each target's path from muts. The variants are
+// generated as each target is scheduled, and are sent straight after it. See paths.Mutation.
+// This is only supported by GetPathsOnHost and GetPathStreamOnHost
+func MutatePaths(muts ...paths.Mutation) ParallelOption {
+	return func(o *ParallelOptions) {
+		o.PathMutations = append(o.PathMutations, muts...)
+	}
+}
+
+// pathVariants generates the variants of targets as they're scheduled. The queue marks the
+// variants it schedules, so they aren't mutated again
+type pathVariants struct {
+	muts []paths.Mutation
+}
+
+func newPathVariants(muts []paths.Mutation) *pathVariants {
+	if len(muts) == 0 {
+		return nil
+	}
+	return &pathVariants{muts: muts}
+}
+
+// of returns the variants of target
+func (v *pathVariants) of(target string) []string {
+	if v == nil {
+		return nil
+	}
+	ret, err := paths.MutateURL(target, v.muts...)
+	if err != nil {
+		log.WithField("target", target).WithError(err).Errorf("failed to mutate")
+		return nil
+	}
+	return ret
+}
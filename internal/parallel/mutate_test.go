@@ -0,0 +1,40 @@
+package parallel
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/minight/h2csmuggler/internal/paths"
+)
+
+func TestClient_GetPathsOnHost_mutatePaths(t *testing.T) {
+	var mu sync.Mutex
+	requested := []string{}
+	srv := newH2CServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.RequestURI)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	c := New()
+	defer c.Close()
+	targets := []string{srv.URL + "/a/b?q=1"}
+	if err := c.GetPathsOnHost(srv.URL+"/", targets, MutatePaths(paths.Encode, paths.Normalize)); err != nil {
+		t.Fatalf("Client.GetPathsOnHost() error = %v", err)
+	}
+
+	// the variants must reach the backend as they were generated
+	want := []string{"/", "/a/b?q=1"}
+	for _, v := range paths.Mutate("/a/b", paths.Encode, paths.Normalize) {
+		want = append(want, v+"?q=1")
+	}
+	sort.Strings(want)
+	sort.Strings(requested)
+	if !reflect.DeepEqual(requested, want) {
+		t.Errorf("requested = %v, want %v", requested, want)
+	}
+}
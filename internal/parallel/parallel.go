@@ -1,62 +1,380 @@
 package parallel
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/minight/h2csmuggler"
 	"github.com/minight/h2csmuggler/http2"
+	"github.com/minight/h2csmuggler/internal/paths"
 	"github.com/pkg/errors"
 )
 
 const (
 	DefaultConnPerHost   = 5
 	DefaultParallelHosts = 10
+
+	DefaultMaxReconnects    = 3
+	DefaultReconnectBackoff = 250 * time.Millisecond
+	// MaxReconnectBackoff caps the delay between consecutive reconnects
+	MaxReconnectBackoff = 5 * time.Second
 )
 
 type Client struct {
+	// MaxConnPerHost is the number of tunnels GetPathsOnHost and GetPathDiffOnHost keep to the host.
+	// If StreamWindow is 0, this is the number of requests in flight, and the tunnels are shared
+	// up to the server's stream limit
 	MaxConnPerHost   int
 	MaxParallelHosts int
+
+	// StreamWindow, if set, is the number of streams kept in flight on each tunnel to a single host.
+	// MaxConnPerHost * StreamWindow requests are sent concurrently, so a few tunnels can carry a
+	// whole wordlist with fewer upgrades. It's capped by the server's SETTINGS_MAX_CONCURRENT_STREAMS.
+	// Websocket tunnels only carry one request at a time, so this is ignored in ModeWebSocket
+	StreamWindow int
+
+	// Ordered, if set, will release results in the order their targets were received rather than
+	// as they complete. Results which complete early are held until the targets before them are
+	// done. This doesn't apply to GetPathDiffOnHost, which pairs its results as they complete
+	Ordered bool
+
+	// Proxy, if set, will tunnel all connections through the upstream proxy.
+	// This applies to both the h2c and the normal http2 connections
+	Proxy *url.URL
+
+	// Resolver, if set, will be used for all lookups instead of the system resolver
+	Resolver *net.Resolver
+
+	// ResolveOverrides maps host:port to the address that should be dialed instead
+	ResolveOverrides map[string]string
+
+	// Modes are the connection modes GetParallelHosts will attempt for each target.
+	// GetPathsOnHost and GetPathDiffOnHost will only use the first mode.
+	// If empty, only ModeUpgrade is attempted
+	Modes []h2csmuggler.Mode
+
+	// TLSConfig, if set, will be used for all https connections. This applies to both the
+	// h2c and the normal http2 connections
+	TLSConfig *tls.Config
+
+	// UpgradeOptions are applied to every h2c upgrade request
+	UpgradeOptions []h2csmuggler.UpgradeOption
+
+	// WebSocketOptions are applied to every websocket upgrade request in ModeWebSocket
+	WebSocketOptions []h2csmuggler.WebSocketOption
+
+	// Timeouts, if set, will override h2csmuggler.DefaultTimeouts for all connections
+	Timeouts *h2csmuggler.Timeouts
+
+	// Variants are the upgrade header variants GetParallelHosts will attempt for each target
+	// in ModeUpgrade. If empty, only the UpgradeOptions are used
+	Variants []h2csmuggler.UpgradeVariant
+
+	// HAR, if set, will record all traffic sent by the client. This includes the upgrade
+	// exchanges, the smuggled requests and the baseline requests in GetPathDiffOnHost
+	HAR *h2csmuggler.HARRecorder
+
+	// Pool, if set, provides the h2c connections so tunnels to the same host are reused between
+	// targets and runs. It can be shared between clients, which only share connections if they
+	// have the same connection options. See poolProfile. If nil, the client creates its own on
+	// first use, which is closed by Close
+	Pool *h2csmuggler.Pool
+
+	// MaxReconnects is how many times GetPathsOnHost and GetPathDiffOnHost will re-establish a dead
+	// tunnel, or resend a target the server never processed, before giving up on the target.
+	// If 0, DefaultMaxReconnects is used. Use -1 to disable reconnects
+	MaxReconnects int
+
+	// ReconnectBackoff is the delay before the first reconnect. It doubles with each consecutive
+	// attempt, up to MaxReconnectBackoff. If 0, DefaultReconnectBackoff is used
+	ReconnectBackoff time.Duration
+
+	poolmu sync.Mutex
 }
 
 func New() *Client {
 	return &Client{}
 }
 
+// pool returns the client's pool, creating it if needed
+func (c *Client) pool() *h2csmuggler.Pool {
+	c.poolmu.Lock()
+	defer c.poolmu.Unlock()
+	if c.Pool == nil {
+		c.Pool = h2csmuggler.NewPool()
+	}
+	return c.Pool
+}
+
+// Close will close the client's pool and every tunnel in it
+func (c *Client) Close() {
+	c.poolmu.Lock()
+	pool := c.Pool
+	c.Pool = nil
+	c.poolmu.Unlock()
+
+	if pool != nil {
+		pool.Close()
+	}
+}
+
+// connOptions returns the options used for every h2csmuggler connection created by the client
+func (c *Client) connOptions() []h2csmuggler.ConnectionOption {
+	opts := []h2csmuggler.ConnectionOption{
+		h2csmuggler.ConnectionMaxRetries(3),
+	}
+	if c.Proxy != nil {
+		opts = append(opts, h2csmuggler.ConnectionProxy(c.Proxy))
+	}
+	if c.Resolver != nil {
+		opts = append(opts, h2csmuggler.ConnectionResolver(c.Resolver))
+	}
+	if c.ResolveOverrides != nil {
+		opts = append(opts, h2csmuggler.ConnectionResolveOverrides(c.ResolveOverrides))
+	}
+	if c.Timeouts != nil {
+		opts = append(opts, h2csmuggler.ConnectionTimeouts(*c.Timeouts))
+	}
+	if c.TLSConfig != nil {
+		opts = append(opts, h2csmuggler.ConnectionTLSConfig(c.TLSConfig))
+	}
+	if len(c.UpgradeOptions) > 0 {
+		opts = append(opts, h2csmuggler.ConnectionUpgradeOptions(c.UpgradeOptions...))
+	}
+	if len(c.WebSocketOptions) > 0 {
+		opts = append(opts, h2csmuggler.ConnectionWebSocketOptions(c.WebSocketOptions...))
+	}
+	if c.HAR != nil {
+		opts = append(opts, h2csmuggler.ConnectionHAR(c.HAR))
+	}
+	return opts
+}
+
+// poolProfile returns the pool profile of h2c connections upgraded with variant. It includes a
+// hash of every option which changes how a connection is made or recorded: the upgrade options,
+// proxy, resolver, resolve overrides, timeouts, HAR recorder and tls config, so a shared Pool never
+// hands one client a connection built with another client's options. The resolver, HAR recorder and
+// tls callbacks can't be compared by value, so clients only share connections if they share them.
+// WebSocketOptions are left out since websocket tunnels aren't pooled, as are the tls fields which
+// only apply to servers or don't change the connection, e.g. KeyLogWriter
+func (c *Client) poolProfile(variant string) string {
+	h := sha256.New()
+	o := h2csmuggler.UpgradeOptions{}
+	for _, opt := range c.UpgradeOptions {
+		opt(&o)
+	}
+	fmt.Fprintf(h, "upgrade %q %q %q %v %v %v %q %q\n", o.ConnectionHeader, o.HTTP2SettingsHeader,
+		o.UpgradeHeader, o.ConnectionHeaderDisabled, o.HTTP2SettingsHeaderDisabled,
+		o.UpgradeHeaderDisabled, o.Headers, []byte(o.Template))
+	if c.Proxy != nil {
+		fmt.Fprintf(h, "proxy %v\n", c.Proxy)
+	}
+	if c.Resolver != nil {
+		fmt.Fprintf(h, "resolver %p\n", c.Resolver)
+	}
+	overrides := make([]string, 0, len(c.ResolveOverrides))
+	for k, v := range c.ResolveOverrides {
+		overrides = append(overrides, k+"="+v)
+	}
+	sort.Strings(overrides)
+	fmt.Fprintf(h, "resolve %q\n", overrides)
+	fmt.Fprintf(h, "timeouts %+v\n", c.timeouts())
+	if c.HAR != nil {
+		fmt.Fprintf(h, "har %p\n", c.HAR)
+	}
+	if cfg := c.TLSConfig; cfg != nil {
+		fmt.Fprintf(h, "tls %q %q %v %v %v %v %v %v %v\n", cfg.ServerName, cfg.NextProtos, cfg.MinVersion,
+			cfg.MaxVersion, cfg.CipherSuites, cfg.CurvePreferences, cfg.InsecureSkipVerify,
+			cfg.Renegotiation, cfg.SessionTicketsDisabled)
+		for _, cert := range cfg.Certificates {
+			for _, raw := range cert.Certificate {
+				h.Write(raw)
+			}
+		}
+		if cfg.RootCAs != nil {
+			fmt.Fprintf(h, "roots %q\n", cfg.RootCAs.Subjects())
+		}
+		fmt.Fprintf(h, "tls callbacks %p %p %p\n", cfg.GetClientCertificate, cfg.VerifyPeerCertificate,
+			cfg.ClientSessionCache)
+	}
+	return variant + "#" + hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// timeouts returns the timeouts used for all connections
+func (c *Client) timeouts() h2csmuggler.Timeouts {
+	if c.Timeouts != nil {
+		return *c.Timeouts
+	}
+	return h2csmuggler.DefaultTimeouts
+}
+
+// dialContext will dial using the client's resolver and resolve overrides. This is
+// used by the normal http2 client so both clients reach the same address
+func (c *Client) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := *h2csmuggler.DefaultDialer
+	d.Timeout = c.timeouts().Dial
+	if c.Resolver != nil {
+		d.Resolver = c.Resolver
+	}
+	if override, ok := c.ResolveOverrides[addr]; ok {
+		addr = override
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// tunnel is a connection which smuggled requests are sent through
+type tunnel interface {
+	Doer
+	Close()
+	Initialized() bool
+	ConnectionState() *tls.ConnectionState
+	UpgradeResponse() *http2.UpgradeResponse
+}
+
+// newTunnel will return the tunnel for the mode. ModeWebSocket uses a websocket tunnel
+// and every other mode uses a h2c connection
+func newTunnel(target string, mode h2csmuggler.Mode, opts ...h2csmuggler.ConnectionOption) (tunnel, error) {
+	if mode == h2csmuggler.ModeWebSocket {
+		return h2csmuggler.NewWebSocketConn(target, opts...)
+	}
+	return h2csmuggler.NewConn(target, append(opts, h2csmuggler.ConnectionMode(mode))...)
+}
+
+// streamWindow returns the streams to keep in flight on each tunnel to a single host. If 0, the
+// tunnels are shared up to the server's limit
+func (c *Client) streamWindow() int {
+	if c.StreamWindow < 0 || c.mode() == h2csmuggler.ModeWebSocket {
+		return 0
+	}
+	return c.StreamWindow
+}
+
+// hostWorkers returns the number of workers which send n targets to a single host. Each worker
+// has one request in flight
+func (c *Client) hostWorkers(n int) int {
+	workers := c.MaxConnPerHost
+	if workers == 0 {
+		workers = DefaultConnPerHost
+	}
+	if window := c.streamWindow(); window > 0 {
+		workers *= window
+	}
+
+	// don't need to spin up 10 threads for just 2 targets
+	if n < workers {
+		workers = n
+	}
+	return workers
+}
+
+// mode returns the mode used for tunnels to a single host. This is the first of c.Modes
+func (c *Client) mode() h2csmuggler.Mode {
+	if len(c.Modes) == 0 {
+		return h2csmuggler.ModeUpgrade
+	}
+	return c.Modes[0]
+}
+
 // do will create a connection and perform the request. this is a convenience function
 // to let us defer closing the connection and body without leaking it until the worker loop
 // ends
-func do(target string) (r res, err error) {
+func do(ctx context.Context, target string, mode h2csmuggler.Mode, opts ...h2csmuggler.ConnectionOption) (r res, err error) {
 	r.target = target
-	conn, err := h2csmuggler.NewConn(target, h2csmuggler.ConnectionMaxRetries(3))
+	conn, err := newTunnel(target, mode, opts...)
 	if err != nil {
 		return r, errors.Wrap(err, "connect")
 	}
 	defer conn.Close()
+	return doTunnel(ctx, conn, target, mode)
+}
 
-	return doConn(conn, target)
+// doPooled is do with a h2c connection from the client's pool. The connection is reused by
+// later targets with the same scheme, host, port, mode and profile. See poolProfile. Websocket
+// tunnels aren't pooled
+func (c *Client) doPooled(ctx context.Context, target string, mode h2csmuggler.Mode, variant string, opts ...h2csmuggler.ConnectionOption) (r res, err error) {
+	if mode == h2csmuggler.ModeWebSocket {
+		return do(ctx, target, mode, opts...)
+	}
+
+	r.target = target
+	key, err := h2csmuggler.NewPoolKey(target, mode, c.poolProfile(variant))
+	if err != nil {
+		return r, errors.Wrap(err, "connect")
+	}
+	pool := c.pool()
+	conn, err := pool.Get(ctx, key, opts...)
+	if err != nil {
+		return r, errors.Wrap(err, "connect")
+	}
+	defer pool.Put(conn)
+	return doTunnel(ctx, conn, target, mode)
+}
+
+// doTunnel will perform the request on conn, recording the details of the tunnel on the result
+func doTunnel(ctx context.Context, conn tunnel, target string, mode h2csmuggler.Mode) (r res, err error) {
+	r, err = doConn(ctx, conn, target)
+	if r.tls == nil {
+		r.tls = conn.ConnectionState()
+	}
+	r.upgrade = conn.UpgradeResponse()
+	if hc, ok := conn.(*h2csmuggler.Conn); ok && mode == h2csmuggler.ModeUpgrade {
+		r.result = hc.UpgradeResult()
+	}
+	return r, err
 }
 
 type Doer interface {
 	Do(req *http.Request) (*http.Response, error)
 }
 
-func doConn(conn Doer, target string, muts ...RequestMutation) (r res, err error) {
+// timer is a connection which records its timing
+type timer interface {
+	Timing() h2csmuggler.ConnTiming
+}
+
+func doConn(ctx context.Context, conn Doer, target string, muts ...RequestMutation) (r res, err error) {
 	r.target = target
-	req, err := http.NewRequest("GET", target, nil)
+	ctx = h2csmuggler.WithStreamTiming(ctx, func(st h2csmuggler.StreamTiming) {
+		r.stream = &st
+	})
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
 	if err != nil {
 		return r, errors.Wrap(err, "request creation")
 	}
 	for _, mut := range muts {
 		mut(req)
 	}
+	r.method = req.Method
+	r.authority = req.Host
+	if r.authority == "" {
+		r.authority = req.URL.Host
+	}
+	if err := mutationErr(req); err != nil {
+		return r, err
+	}
 
+	start := time.Now()
+	defer func() {
+		r.duration = time.Since(start)
+	}()
 	res, err := conn.Do(req)
+	if tc, ok := conn.(timer); ok {
+		t := tc.Timing()
+		r.timing = &t
+	}
 	if err != nil {
 		return r, errors.Wrap(err, "connection do")
 	}
@@ -69,6 +387,7 @@ func doConn(conn Doer, target string, muts ...RequestMutation) (r res, err error
 
 	r.body = body
 	r.res = res
+	r.tls = res.TLS
 	return r, nil
 }
 
@@ -76,6 +395,57 @@ type ParallelOption func(o *ParallelOptions)
 type RequestMutation func(req *http.Request)
 type ParallelOptions struct {
 	RequestMutations []RequestMutation
+	// TargetMutations are only applied to the targets, and not the request which initializes
+	// the tunnel
+	TargetMutations []RequestMutation
+	// Matchers and Filters decide which results are shown. See ResultMatcher and ResultFilter
+	Matchers []Matcher
+	Filters  []Matcher
+	// AutoCalibrate hides results which match a baseline of random paths. See AutoCalibrate
+	AutoCalibrate bool
+	// RecursionDepth is how many directories below the targets to explore. See Recurse
+	RecursionDepth int
+	// PathMutations generate variants of each target's path to send as well. See MutatePaths
+	PathMutations []paths.Mutation
+}
+
+// targetMutations returns the mutations applied to each target
+func (o *ParallelOptions) targetMutations() []RequestMutation {
+	muts := make([]RequestMutation, 0, len(o.RequestMutations)+len(o.TargetMutations))
+	muts = append(muts, o.RequestMutations...)
+	return append(muts, o.TargetMutations...)
+}
+
+// pathsOnly returns an error if o has options which only GetPathsOnHost and GetPathStreamOnHost
+// honour, so run doesn't silently ignore them
+func (o *ParallelOptions) pathsOnly(run string) error {
+	if o.AutoCalibrate {
+		return errors.Errorf("%s doesn't support AutoCalibrate", run)
+	}
+	if o.RecursionDepth > 0 {
+		return errors.Errorf("%s doesn't support Recurse", run)
+	}
+	if len(o.PathMutations) > 0 {
+		return errors.Errorf("%s doesn't support MutatePaths", run)
+	}
+	return nil
+}
+
+type mutationErrKey struct{}
+
+// failMutation records that a mutation of req failed, so the target fails instead of being sent
+// without the mutation. Only the first error is kept
+func failMutation(req *http.Request, err error) {
+	if mutationErr(req) != nil {
+		return
+	}
+	*req = *req.WithContext(context.WithValue(req.Context(), mutationErrKey{}, err))
+}
+
+// mutationErr returns the error recorded by failMutation, if any
+func mutationErr(req *http.Request) error {
+	err, _ := req.Context().Value(mutationErrKey{}).(error)
+	return err
 }
 
 func RequestHeader(key string, value string) ParallelOption {
@@ -91,6 +461,20 @@ func RequestHeader(key string, value string) ParallelOption {
 	}
 }
 
+// RequestBody will send body with each target. The request which initializes the tunnel is sent
+// without it, since a h2c upgrade can't carry a body. The Content-Type is only set if a
+// RequestHeader hasn't already set one. Targets fail if the body can't be set
+func RequestBody(body *h2csmuggler.RequestBody) ParallelOption {
+	return func(o *ParallelOptions) {
+		mut := func(r *http.Request) {
+			if err := body.Apply(r); err != nil {
+				failMutation(r, errors.Wrap(err, "failed to set body"))
+			}
+		}
+		o.TargetMutations = append(o.TargetMutations, mut)
+	}
+}
+
 func RequestMethod(method string) ParallelOption {
 	return func(o *ParallelOptions) {
 		mut := func(r *http.Request) {
@@ -101,26 +485,44 @@ func RequestMethod(method string) ParallelOption {
 }
 
 // GetPathDiffOnHost will send the targets to the base host on both a http2 and a h2c connection
-// the results will be diffed
+// the results will be diffed. Only targets whose h2c result passes the ResultMatcher and
+// ResultFilter options are compared
 // this will use c.MaxConnPerHost to parallelize the paths
 // This assumes that the host can be connected to over h2c. This will fail if attempted
 // with a host that cannot be h2c smuggled
 // TODO: minimize allocations here, since we explode out a lot
 func (c *Client) GetPathDiffOnHost(base string, targets []string, opts ...ParallelOption) error {
-	maxConns := c.MaxConnPerHost
-	if maxConns == 0 {
-		maxConns = DefaultConnPerHost
-	}
+	return c.GetPathDiffOnHostContext(context.Background(), base, targets, opts...)
+}
 
-	// don't need to spin up 10 threads for just 2 targets
-	if len(targets) < maxConns {
-		maxConns = len(targets)
-	}
+// GetPathDiffOnHostContext is GetPathDiffOnHost with a context. Cancelling the context will
+// stop scheduling targets and cancel all in-flight requests
+func (c *Client) GetPathDiffOnHostContext(ctx context.Context, base string, targets []string, opts ...ParallelOption) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	return c.getPathDiffStream(ctx, base, Targets(ctx, targets), c.hostWorkers(len(targets)), opts...)
+}
+
+// GetPathDiffStreamOnHost is GetPathDiffOnHost for targets received from a channel, e.g. from
+// ReadLines. The run ends once targets is closed
+func (c *Client) GetPathDiffStreamOnHost(base string, targets <-chan string, opts ...ParallelOption) error {
+	return c.GetPathDiffStreamOnHostContext(context.Background(), base, targets, opts...)
+}
+
+// GetPathDiffStreamOnHostContext is GetPathDiffStreamOnHost with a context. Cancelling the
+// context will stop receiving targets and cancel all in-flight requests
+func (c *Client) GetPathDiffStreamOnHostContext(ctx context.Context, base string, targets <-chan string, opts ...ParallelOption) error {
+	return c.getPathDiffStream(ctx, base, targets, c.hostWorkers(math.MaxInt32), opts...)
+}
 
+func (c *Client) getPathDiffStream(ctx context.Context, base string, targets <-chan string, workers int, opts ...ParallelOption) error {
 	o := &ParallelOptions{}
 	for _, opt := range opts {
 		opt(o)
 	}
+	if err := o.pathsOnly("GetPathDiffOnHost"); err != nil {
+		return err
+	}
 
 	// validate our input
 	baseurl, err := url.Parse(base)
@@ -128,32 +530,46 @@ func (c *Client) GetPathDiffOnHost(base string, targets []string, opts ...Parall
 		return errors.Wrap(err, "failed to parse base")
 	}
 
-	http2Client := &http.Client{Transport: &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		},
-	}}
+	timeouts := c.timeouts()
+	tlsConfig := h2csmuggler.DefaultTLSConfig
+	if c.TLSConfig != nil {
+		tlsConfig = c.TLSConfig
+	}
+	http2Transport := &http.Transport{
+		TLSClientConfig:       tlsConfig.Clone(),
+		DialContext:           c.dialContext,
+		TLSHandshakeTimeout:   timeouts.TLSHandshake,
+		ResponseHeaderTimeout: timeouts.ResponseHeader,
+	}
+	if c.Proxy != nil {
+		http2Transport.Proxy = http.ProxyURL(c.Proxy)
+	}
+	http2Client := &http.Client{Transport: http2Transport}
+	if c.HAR != nil {
+		http2Client.Transport = h2csmuggler.NewHARRoundTripper(http2Transport, c.HAR, h2csmuggler.TransportBaseline)
+	}
 
 	// create a mutation for our HTTP2 client so it connects on the right
 	// connection. We only change the URL, since thats used to dial the conn
 	mutateBaseURL := func(r *http.Request) {
 		r.URL.Host = baseurl.Host
 	}
-	http2ClientMutations := append(o.RequestMutations, mutateBaseURL)
+	http2ClientMutations := append(o.targetMutations(), mutateBaseURL)
 
+	stats := &runStats{}
 	var wg sync.WaitGroup
-	inh2c := make(chan string, maxConns)
-	inhttp2 := make(chan string, maxConns)
-	outh2c := make(chan res, maxConns)
-	outhttp2 := make(chan res, maxConns)
+	inh2c := make(chan string, workers)
+	inhttp2 := make(chan string, workers)
+	outh2c := make(chan res, workers)
+	outhttp2 := make(chan res, workers)
 
 	// Create our http2 worker threads
-	for i := 0; i < maxConns; i++ {
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
 		go func() {
 			for t := range inhttp2 {
 				log.WithField("target", t).Tracef("requesting")
-				r, err := doConn(http2Client, t, http2ClientMutations...)
+				r, err := doConn(ctx, http2Client, t, http2ClientMutations...)
 				if err != nil {
 					log.WithField("target", t).WithError(err).Tracef("failed to request")
 					r.err = err
@@ -166,34 +582,14 @@ func (c *Client) GetPathDiffOnHost(base string, targets []string, opts ...Parall
 	}
 
 	// Create our h2c worker threads
-	for i := 0; i < maxConns; i++ {
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
 		go func() {
-			conn, connErr := h2csmuggler.NewConn(base, h2csmuggler.ConnectionMaxRetries(3))
-			if connErr == nil {
-				defer conn.Close()
-			}
-
-			// initialize the connection with our first base request
-			r, err := doConn(conn, base, o.RequestMutations...)
-			if err != nil {
-				log.WithField("target", base).WithError(err).Tracef("failed to request")
-				r.err = err
-			}
-			// don't return the result because its expected for this to work
+			h := &hostTunnel{c: c, base: base, muts: o.RequestMutations, targetMuts: o.targetMutations(), stats: stats}
+			defer h.close()
 
 			for t := range inh2c {
-				// just discard all results if we can't connect.
-				if connErr != nil {
-					outh2c <- res{
-						target: t,
-						err:    connErr,
-					}
-					continue
-				}
-
-				log.WithField("target", t).Tracef("requesting")
-				r, err := doConn(conn, t, o.RequestMutations...)
+				r, err := h.do(ctx, t)
 				if err != nil {
 					log.WithField("target", t).WithError(err).Tracef("failed to request")
 					r.err = err
@@ -208,12 +604,33 @@ func (c *Client) GetPathDiffOnHost(base string, targets []string, opts ...Parall
 
 	var swg sync.WaitGroup
 	swg.Add(1)
+	count := 0
 	// Create our dispatcher thread
 	go func() {
-		for _, t := range targets {
+	dispatch:
+		for {
+			var t string
+			var ok bool
+			select {
+			case t, ok = <-targets:
+			case <-ctx.Done():
+				break dispatch
+			}
+			if !ok {
+				break
+			}
+			count++
 			log.WithField("target", t).Tracef("scheduling")
-			inhttp2 <- t
-			inh2c <- t
+			select {
+			case inhttp2 <- t:
+			case <-ctx.Done():
+				break dispatch
+			}
+			select {
+			case inh2c <- t:
+			case <-ctx.Done():
+				break dispatch
+			}
 		}
 		close(inh2c)
 		close(inhttp2)
@@ -240,8 +657,16 @@ func (c *Client) GetPathDiffOnHost(base string, targets []string, opts ...Parall
 					h2cClosed = true
 					break
 				}
+				if ctx.Err() != nil {
+					break
+				}
 				tmp := r
 				// r.Log("h2c")
+				if !o.show(&tmp) {
+					log.WithField("target", tmp.target).Tracef("filtered")
+					results.HideH2C(&tmp)
+					break
+				}
 				results.ShowDiffH2C(&tmp)
 			}
 		case r := <-outhttp2:
@@ -250,6 +675,9 @@ func (c *Client) GetPathDiffOnHost(base string, targets []string, opts ...Parall
 					http2Closed = true
 					break
 				}
+				if ctx.Err() != nil {
+					break
+				}
 				tmp := r
 				// r.Log("http2")
 				results.ShowDiffHTTP2(&tmp)
@@ -260,73 +688,99 @@ func (c *Client) GetPathDiffOnHost(base string, targets []string, opts ...Parall
 	// Wait for workers to cleanup
 	wg.Wait()
 	swg.Wait()
-	return nil
+	if ctx.Err() == nil {
+		stats.log(count)
+	}
+	return ctx.Err()
 }
 
-// GetPathsOnHost will send the targets to the base host
-// this will use c.MaxConnPerHost to parallelize the paths
+// GetPathsOnHost will send the targets to the base host. Only results passing the
+// ResultMatcher and ResultFilter options are logged. With AutoCalibrate, soft 404s are hidden too.
+// With Recurse, directories found are explored with the same paths on the same tunnels
+// this will use c.MaxConnPerHost to parallelize the paths. The h2c connections to base are
+// pooled, so the workers share them and later runs reuse them. If c.StreamWindow is set, each
+// tunnel carries that many targets at once
 // This assumes that the host can be connected to over h2c. This will fail if attempted
 // with a host that cannot be h2c smuggled
 // TODO: minimize allocations here, since we explode out a lot
 func (c *Client) GetPathsOnHost(base string, targets []string, opts ...ParallelOption) error {
-	maxConns := c.MaxConnPerHost
-	if maxConns == 0 {
-		maxConns = DefaultConnPerHost
-	}
+	return c.GetPathsOnHostContext(context.Background(), base, targets, opts...)
+}
 
-	// don't need to spin up 10 threads for just 2 targets
-	if len(targets) < maxConns {
-		maxConns = len(targets)
-	}
+// GetPathsOnHostContext is GetPathsOnHost with a context. Cancelling the context will
+// stop scheduling targets and cancel all in-flight requests
+func (c *Client) GetPathsOnHostContext(ctx context.Context, base string, targets []string, opts ...ParallelOption) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	return c.getPathStream(ctx, base, Targets(ctx, targets), c.hostWorkers(len(targets)), opts...)
+}
+
+// GetPathStreamOnHost is GetPathsOnHost for targets received from a channel, e.g. from
+// ReadLines. The run ends once targets is closed
+func (c *Client) GetPathStreamOnHost(base string, targets <-chan string, opts ...ParallelOption) error {
+	return c.GetPathStreamOnHostContext(context.Background(), base, targets, opts...)
+}
 
+// GetPathStreamOnHostContext is GetPathStreamOnHost with a context. Cancelling the context will
+// stop receiving targets and cancel all in-flight requests
+func (c *Client) GetPathStreamOnHostContext(ctx context.Context, base string, targets <-chan string, opts ...ParallelOption) error {
+	return c.getPathStream(ctx, base, targets, c.hostWorkers(math.MaxInt32), opts...)
+}
+
+func (c *Client) getPathStream(ctx context.Context, base string, targets <-chan string, workers int, opts ...ParallelOption) error {
 	o := &ParallelOptions{}
 	for _, opt := range opts {
 		opt(o)
 	}
 
+	// recursion adds targets as it goes, so don't limit the workers to the initial targets
+	var rec *recursion
+	if o.RecursionDepth > 0 {
+		workers = c.hostWorkers(math.MaxInt32)
+		rec = newRecursion(base, o.RecursionDepth)
+	}
+
 	// validate our input
 	_, err := url.Parse(base)
 	if err != nil {
 		return errors.Wrap(err, "failed to parse base")
 	}
 
+	type job struct {
+		target  string
+		variant bool
+		seq     int
+	}
+
+	stats := &runStats{}
+	var cal *calibrator
+	if o.AutoCalibrate {
+		cal = newCalibrator()
+	}
+	queue := newTargetQueue(targets)
+	variants := newPathVariants(o.PathMutations)
 	var wg sync.WaitGroup
-	in := make(chan string, maxConns)
-	out := make(chan res, maxConns)
+	in := make(chan job, workers)
+	out := make(chan res, workers)
 
 	// Create our worker threads
-	for i := 0; i < maxConns; i++ {
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
 		go func() {
-			conn, connErr := h2csmuggler.NewConn(base, h2csmuggler.ConnectionMaxRetries(3))
-			if connErr == nil {
-				defer conn.Close()
-			}
-
-			// initialize the connection with our first base request
-			r, err := doConn(conn, base, o.RequestMutations...)
-			if err != nil {
-				log.WithField("target", base).WithError(err).Tracef("failed to request")
-				r.err = err
-			}
-			// don't return the result because its expected for this to work
-
-			for t := range in {
-				// just discard all results if we can't connect.
-				if connErr != nil {
-					out <- res{
-						target: t,
-						err:    connErr,
-					}
-					continue
-				}
+			h := &hostTunnel{c: c, base: base, muts: o.RequestMutations, targetMuts: o.targetMutations(), stats: stats}
+			defer h.close()
 
-				log.WithField("target", t).Tracef("requesting")
-				r, err := doConn(conn, t, o.RequestMutations...)
+			for j := range in {
+				r, err := h.do(ctx, j.target)
 				if err != nil {
-					log.WithField("target", t).WithError(err).Tracef("failed to request")
+					log.WithField("target", j.target).WithError(err).Tracef("failed to request")
 					r.err = err
 				}
+				if cal != nil {
+					r.soft404 = cal.soft404(ctx, h, &r)
+				}
+				r.pathVariant = j.variant
+				r.seq = j.seq
 				out <- r
 			}
 
@@ -338,9 +792,24 @@ func (c *Client) GetPathsOnHost(base string, targets []string, opts ...ParallelO
 	swg.Add(1)
 	// Create our dispatcher thread
 	go func() {
-		for _, t := range targets {
-			log.WithField("target", t).Tracef("scheduling")
-			in <- t
+	dispatch:
+		for seq := 0; ; seq++ {
+			t, ok := queue.pop(ctx)
+			if !ok {
+				break
+			}
+			if t.input && rec != nil {
+				queue.push(rec.add(t.target)...)
+			}
+			if !t.variant {
+				queue.pushVariants(variants.of(t.target)...)
+			}
+			log.WithField("target", t.target).Tracef("scheduling")
+			select {
+			case in <- job{target: t.target, variant: t.variant, seq: seq}:
+			case <-ctx.Done():
+				break dispatch
+			}
 		}
 		close(in)
 
@@ -351,40 +820,135 @@ func (c *Client) GetPathsOnHost(base string, targets []string, opts ...ParallelO
 	}()
 
 	// Fan-in results
+	source := "h2c"
+	if c.mode() == h2csmuggler.ModeWebSocket {
+		source = "websocket"
+	}
+	seq := c.sequencer()
 	for r := range out {
-		r.Log("h2c")
+		r := r
+		seq.release(r.seq, func() {
+			// queue the directories found before marking the target done, so the run doesn't
+			// end while there's more to explore
+			if ctx.Err() == nil && logResult(o, &r, source) && rec != nil {
+				queue.push(rec.expand(&r)...)
+			}
+			queue.done()
+		})
 	}
 
 	// Wait for workers to cleanup
 	wg.Wait()
 	swg.Wait()
-	return nil
+	if ctx.Err() == nil {
+		stats.log(queue.count())
+	}
+	return ctx.Err()
 }
 
-// GetParallelHosts will retrieve each target on a separate connection
+// logResult will log r if it passes the options, reporting whether it was shown
+func logResult(o *ParallelOptions, r *res, source string) bool {
+	if r.soft404 {
+		log.WithField("target", r.target).Debugf("matches calibration")
+		return false
+	}
+	if !o.show(r) {
+		log.WithField("target", r.target).Tracef("filtered")
+		return false
+	}
+	r.Log(source)
+	return true
+}
+
+// GetParallelHosts will retrieve each target over h2c. Targets which share a scheme, host and port
+// are sent as streams on the same pooled connection. See Client.Pool
+// Each target is attempted once per mode in c.Modes, with the mode reported on each result
+// In ModeUpgrade, each target is also attempted once per variant in c.Variants. The variants
+// which produced a working tunnel are summarized per target once all results are received
 // This uses a simple fan-out fan-in concurrency model
 func (c *Client) GetParallelHosts(targets []string) error {
+	return c.GetParallelHostsContext(context.Background(), targets)
+}
+
+// GetParallelHostsContext is GetParallelHosts with a context. Cancelling the context will
+// stop scheduling targets and cancel all in-flight requests
+func (c *Client) GetParallelHostsContext(ctx context.Context, targets []string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	return c.GetParallelHostStreamContext(ctx, Targets(ctx, targets))
+}
+
+// GetParallelHostStream is GetParallelHosts for targets received from a channel, e.g. from
+// ReadLines. The run ends once targets is closed. The targets are only held for the variant summary
+func (c *Client) GetParallelHostStream(targets <-chan string) error {
+	return c.GetParallelHostStreamContext(context.Background(), targets)
+}
+
+// GetParallelHostStreamContext is GetParallelHostStream with a context. Cancelling the context
+// will stop receiving targets and cancel all in-flight requests
+func (c *Client) GetParallelHostStreamContext(ctx context.Context, targets <-chan string) error {
 	maxHosts := c.MaxParallelHosts
 	if maxHosts == 0 {
 		maxHosts = DefaultParallelHosts
 	}
 
+	modes := c.Modes
+	if len(modes) == 0 {
+		modes = []h2csmuggler.Mode{h2csmuggler.ModeUpgrade}
+	}
+	// each target has a result per mode, and per variant in ModeUpgrade
+	perTarget := 0
+	for _, m := range modes {
+		if m == h2csmuggler.ModeUpgrade && len(c.Variants) > 0 {
+			perTarget += len(c.Variants)
+		} else {
+			perTarget++
+		}
+	}
+
+	type job struct {
+		target string
+		seq    int
+	}
+
 	var wg sync.WaitGroup
-	in := make(chan string, maxHosts)
+	in := make(chan job, maxHosts)
 	out := make(chan res, maxHosts)
 
 	// Create our worker threads
 	for i := 0; i < maxHosts; i++ {
 		wg.Add(1)
 		go func() {
-			for t := range in {
-				log.WithField("target", t).Tracef("requesting")
-				r, err := do(t)
-				if err != nil {
-					log.WithField("target", t).WithError(err).Tracef("failed to request")
-					r.err = err
+			for j := range in {
+				t := j.target
+				seq := j.seq * perTarget
+				for _, m := range modes {
+					variants := c.Variants
+					if m != h2csmuggler.ModeUpgrade || len(variants) == 0 {
+						variants = []h2csmuggler.UpgradeVariant{{}}
+					}
+					for _, v := range variants {
+						log.WithFields(log.Fields{
+							"target":  t,
+							"mode":    m,
+							"variant": v.Name,
+						}).Tracef("requesting")
+						opts := c.connOptions()
+						if v.Headers != nil {
+							opts = append(opts, h2csmuggler.ConnectionUpgradeOptions(v.Option()))
+						}
+						r, err := c.doPooled(ctx, t, m, v.Name, opts...)
+						if err != nil {
+							log.WithField("target", t).WithError(err).Tracef("failed to request")
+							r.err = err
+						}
+						r.mode = m
+						r.variant = v.Name
+						r.seq = seq
+						seq++
+						out <- r
+					}
 				}
-				out <- r
 			}
 
 			wg.Done()
@@ -395,9 +959,24 @@ func (c *Client) GetParallelHosts(targets []string) error {
 	swg.Add(1)
 	// Create our dispatcher thread
 	go func() {
-		for _, t := range targets {
+	dispatch:
+		for seq := 0; ; seq++ {
+			var t string
+			var ok bool
+			select {
+			case t, ok = <-targets:
+			case <-ctx.Done():
+				break dispatch
+			}
+			if !ok {
+				break
+			}
 			log.WithField("target", t).Tracef("scheduling")
-			in <- t
+			select {
+			case in <- job{target: t, seq: seq}:
+			case <-ctx.Done():
+				break dispatch
+			}
 		}
 		close(in)
 
@@ -408,29 +987,73 @@ func (c *Client) GetParallelHosts(targets []string) error {
 	}()
 
 	// Fan-in results
+	working := map[string][]string{}
+	summarized := []string{}
+	seq := c.sequencer()
 	for r := range out {
-		log.WithField("res", r).Tracef("recieved")
-		if r.err != nil {
-			var uscErr http2.UnexpectedStatusCodeError
-			if errors.As(r.err, &uscErr) {
-				log.WithFields(log.Fields{
-					"status": uscErr.Code,
-					"target": r.target,
-				}).Errorf("unexpected status code")
-			} else {
-				log.WithField("target", r.target).WithError(r.err).Debugf("failed")
+		r := r
+		seq.release(r.seq, func() {
+			if len(c.Variants) > 0 {
+				if _, ok := working[r.target]; !ok {
+					working[r.target] = []string{}
+					summarized = append(summarized, r.target)
+				}
 			}
-		} else {
-			log.WithFields(log.Fields{
-				"status": r.res.StatusCode,
-				"body":   len(r.body),
-				"target": r.target,
-			}).Infof("success")
-		}
+			logHostResult(ctx, &r, working)
+		})
 	}
 
 	// Wait for workers to cleanup
 	wg.Wait()
 	swg.Wait()
-	return nil
+
+	if len(c.Variants) > 0 && ctx.Err() == nil {
+		for _, t := range summarized {
+			log.WithFields(log.Fields{
+				"target":   t,
+				"variants": working[t],
+			}).Infof("working upgrade variants: %d/%d", len(working[t]), len(c.Variants))
+		}
+	}
+	return ctx.Err()
+}
+
+// logHostResult will log a result of GetParallelHosts, recording its variant in working if it
+// produced a tunnel
+func logHostResult(ctx context.Context, r *res, working map[string][]string) {
+	log.WithField("res", r).Tracef("recieved")
+	if ctx.Err() != nil {
+		return
+	}
+	if r.err != nil {
+		var uscErr http2.UnexpectedStatusCodeError
+		var noH2Err http2.NoH2Error
+		if errors.As(r.err, &uscErr) {
+			log.WithFields(log.Fields{
+				"status": uscErr.Code,
+				"target": r.target,
+				"mode":   r.mode.String(),
+			}).WithFields(r.detailFields()).Errorf("unexpected status code")
+		} else if errors.As(r.err, &noH2Err) {
+			log.WithFields(log.Fields{
+				"target": r.target,
+				"mode":   r.mode.String(),
+			}).WithFields(r.detailFields()).WithError(noH2Err.Err).Errorf("upgraded without http2")
+		} else {
+			log.WithFields(log.Fields{
+				"target": r.target,
+				"mode":   r.mode.String(),
+			}).WithFields(r.variantFields()).WithError(r.err).Debugf("failed")
+		}
+	} else {
+		log.WithFields(log.Fields{
+			"status": r.res.StatusCode,
+			"body":   len(r.body),
+			"target": r.target,
+			"mode":   r.mode.String(),
+		}).WithFields(r.detailFields()).Infof("success")
+		if r.variant != "" {
+			working[r.target] = append(working[r.target], r.variant)
+		}
+	}
 }
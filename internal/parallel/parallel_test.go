@@ -1,8 +1,29 @@
 package parallel
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/minight/h2csmuggler"
+	"github.com/minight/h2csmuggler/internal/paths"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/http2/hpack"
 )
 
 func TestNew(t *testing.T) {
@@ -35,7 +56,7 @@ func Test_do(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotR, err := do(tt.args.target)
+			gotR, err := do(context.Background(), tt.args.target, h2csmuggler.ModeUpgrade)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("do() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -47,6 +68,102 @@ func Test_do(t *testing.T) {
 	}
 }
 
+// doerFunc is a Doer which calls the function
+type doerFunc func(req *http.Request) (*http.Response, error)
+
+func (f doerFunc) Do(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func Test_doConn_bodyErr(t *testing.T) {
+	o := &ParallelOptions{}
+	RequestBody(h2csmuggler.NewRequestBody(func() (io.ReadCloser, error) {
+		return nil, errors.New("no such file")
+	}, 0, ""))(o)
+
+	sent := false
+	conn := doerFunc(func(req *http.Request) (*http.Response, error) {
+		sent = true
+		return nil, errors.New("unexpected request")
+	})
+	_, err := doConn(context.Background(), conn, "http://127.0.0.1/a", o.targetMutations()...)
+	if err == nil || !strings.Contains(err.Error(), "no such file") {
+		t.Errorf("doConn() error = %v, want the body error", err)
+	}
+	if sent {
+		t.Errorf("doConn() sent the request without its body")
+	}
+}
+
+func TestClient_poolProfile(t *testing.T) {
+	proxy, _ := url.Parse("http://127.0.0.1:8080")
+	timeouts := h2csmuggler.MaxTimeouts(time.Second)
+	getCert := func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return nil, nil }
+	base := New().poolProfile("")
+	tests := []struct {
+		name     string
+		c        *Client
+		base     *Client
+		variant  string
+		wantSame bool
+	}{
+		{name: "same options", c: New(), wantSame: true},
+		{name: "default timeouts", c: &Client{Timeouts: &h2csmuggler.DefaultTimeouts}, wantSame: true},
+		{name: "variant", c: New(), variant: "upgrade-only"},
+		{name: "upgrade options", c: &Client{UpgradeOptions: []h2csmuggler.UpgradeOption{h2csmuggler.SetUpgradeHeader("h2")}}},
+		{name: "upgrade template", c: &Client{UpgradeOptions: []h2csmuggler.UpgradeOption{h2csmuggler.SetUpgradeTemplate(h2csmuggler.UpgradeTemplate("GET / HTTP/1.1\n"))}}},
+		{name: "proxy", c: &Client{Proxy: proxy}},
+		{name: "resolver", c: &Client{Resolver: &net.Resolver{}}},
+		{name: "resolve overrides", c: &Client{ResolveOverrides: map[string]string{"a:80": "127.0.0.1:80"}}},
+		{name: "timeouts", c: &Client{Timeouts: &timeouts}},
+		{name: "har", c: &Client{HAR: h2csmuggler.NewHARRecorder(ioutil.Discard)}},
+		{name: "tls config", c: &Client{TLSConfig: &tls.Config{ServerName: "other"}}},
+		{name: "equal tls config", c: &Client{TLSConfig: &tls.Config{ServerName: "other"}}, base: &Client{TLSConfig: &tls.Config{ServerName: "other"}}, wantSame: true},
+		{name: "root cas", c: &Client{TLSConfig: &tls.Config{RootCAs: x509.NewCertPool()}}, base: &Client{TLSConfig: &tls.Config{}}},
+		{name: "client certificate callback", c: &Client{TLSConfig: &tls.Config{GetClientCertificate: getCert}}, base: &Client{TLSConfig: &tls.Config{}}},
+		{name: "renegotiation", c: &Client{TLSConfig: &tls.Config{Renegotiation: tls.RenegotiateFreelyAsClient}}, base: &Client{TLSConfig: &tls.Config{}}},
+		{name: "websocket options aren't pooled", c: &Client{WebSocketOptions: []h2csmuggler.WebSocketOption{h2csmuggler.AllowRefusedWebSocketUpgrade()}}, wantSame: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := base
+			if tt.base != nil {
+				base = tt.base.poolProfile("")
+			}
+			if got := tt.c.poolProfile(tt.variant); (got == base) != tt.wantSame {
+				t.Errorf("Client.poolProfile() = %v, base %v, want same %v", got, base, tt.wantSame)
+			}
+		})
+	}
+}
+
+func TestClient_pathsOnly(t *testing.T) {
+	srv := newH2CServer(http.HandlerFunc(echoPath))
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		opt  ParallelOption
+	}{
+		{name: "auto calibrate", opt: AutoCalibrate()},
+		{name: "recursion", opt: Recurse(1)},
+		{name: "path mutations", opt: MutatePaths(paths.Encode)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New()
+			defer c.Close()
+			if err := c.GetPathDiffOnHost(srv.URL, []string{"/a"}, tt.opt); err == nil {
+				t.Errorf("Client.GetPathDiffOnHost() error = nil, want the option rejected")
+			}
+			specs := []*RequestSpec{{ID: "a", URL: "/a"}}
+			if err := c.GetSpecsOnHost(srv.URL, specs, ioutil.Discard, tt.opt); err == nil {
+				t.Errorf("Client.GetSpecsOnHost() error = nil, want the option rejected")
+			}
+		})
+	}
+}
+
 func TestClient_GetParallelHosts(t *testing.T) {
 	type args struct {
 		targets []string
@@ -97,3 +214,218 @@ func TestClient_GetParallelHosts(t *testing.T) {
 		})
 	}
 }
+
+// newH2CServer returns a server which serves h over h2c, both by upgrade and prior knowledge
+func newH2CServer(h http.Handler) *httptest.Server {
+	return httptest.NewServer(h2c.NewHandler(h, &http2.Server{}))
+}
+
+// echoPath responds with the protocol and path of the request
+func echoPath(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "%s %s", r.Proto, r.URL.Path)
+}
+
+func Test_hostTunnel_reconnect(t *testing.T) {
+	tests := []struct {
+		name           string
+		stopServer     bool
+		wantErr        bool
+		wantReconnects int32
+	}{
+		{name: "reconnect", wantReconnects: 1},
+		{name: "reconnect failed", stopServer: true, wantErr: true, wantReconnects: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newH2CServer(http.HandlerFunc(echoPath))
+			defer srv.Close()
+
+			c := New()
+			c.MaxReconnects = 2
+			c.ReconnectBackoff = time.Millisecond
+			defer c.Close()
+
+			stats := &runStats{}
+			h := &hostTunnel{c: c, base: srv.URL, stats: stats}
+			if _, err := h.do(context.Background(), srv.URL+"/a"); err != nil {
+				t.Fatalf("hostTunnel.do() error = %v", err)
+			}
+
+			// kill the pooled tunnel out from under the worker
+			key, _ := h2csmuggler.NewPoolKey(srv.URL, h2csmuggler.ModeUpgrade, c.poolProfile(""))
+			conn, err := c.pool().Get(context.Background(), key)
+			if err != nil {
+				t.Fatalf("Pool.Get() error = %v", err)
+			}
+			if tt.stopServer {
+				srv.Close()
+			}
+			conn.Close()
+			c.pool().Put(conn)
+
+			r, err := h.do(context.Background(), srv.URL+"/b")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("hostTunnel.do() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := atomic.LoadInt32(&stats.reconnects); got != tt.wantReconnects {
+				t.Errorf("reconnects = %d, want %d", got, tt.wantReconnects)
+			}
+			if !tt.wantErr && string(r.body) != "HTTP/2.0 /b" {
+				t.Errorf("hostTunnel.do() body = %q, want %q", r.body, "HTTP/2.0 /b")
+			}
+		})
+	}
+}
+
+// newRefusingServer is a prior knowledge h2 server which answers each stream with its path,
+// except for the first stream for /b, which is passed to refuse. If refuse returns true, the
+// connection is closed
+func newRefusingServer(t *testing.T, refuse func(fr *http2.Framer, streamID uint32) bool) (base string, close func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	var refused int32
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		preface := make([]byte, len(http2.ClientPreface))
+		if _, err := io.ReadFull(conn, preface); err != nil {
+			return
+		}
+		fr := http2.NewFramer(conn, conn)
+		fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+		fr.WriteSettings()
+
+		var buf bytes.Buffer
+		enc := hpack.NewEncoder(&buf)
+		for {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			switch f := f.(type) {
+			case *http2.SettingsFrame:
+				if !f.IsAck() {
+					fr.WriteSettingsAck()
+				}
+			case *http2.MetaHeadersFrame:
+				path := f.PseudoValue("path")
+				if path == "/b" && atomic.CompareAndSwapInt32(&refused, 0, 1) {
+					if refuse(fr, f.StreamID) {
+						return
+					}
+					continue
+				}
+				buf.Reset()
+				enc.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+				fr.WriteHeaders(http2.HeadersFrameParam{StreamID: f.StreamID, BlockFragment: buf.Bytes(), EndHeaders: true})
+				fr.WriteData(f.StreamID, true, []byte("HTTP/2.0 "+path))
+			}
+		}
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return "http://" + ln.Addr().String(), func() { ln.Close() }
+}
+
+func Test_hostTunnel_retry(t *testing.T) {
+	tests := []struct {
+		name           string
+		refuse         func(fr *http2.Framer, streamID uint32) bool
+		wantReconnects int32
+	}{
+		{
+			name: "refused stream",
+			refuse: func(fr *http2.Framer, streamID uint32) bool {
+				fr.WriteRSTStream(streamID, http2.ErrCodeRefusedStream)
+				return false
+			},
+		},
+		{
+			name: "goaway below the stream",
+			refuse: func(fr *http2.Framer, streamID uint32) bool {
+				fr.WriteGoAway(streamID-2, http2.ErrCodeNo, nil)
+				return true
+			},
+			wantReconnects: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, stop := newRefusingServer(t, tt.refuse)
+			defer stop()
+
+			c := New()
+			c.Modes = []h2csmuggler.Mode{h2csmuggler.ModePriorKnowledge}
+			c.ReconnectBackoff = time.Millisecond
+			defer c.Close()
+
+			stats := &runStats{}
+			h := &hostTunnel{c: c, base: base, stats: stats}
+			if _, err := h.do(context.Background(), base+"/a"); err != nil {
+				t.Fatalf("hostTunnel.do() error = %v", err)
+			}
+			r, err := h.do(context.Background(), base+"/b")
+			if err != nil {
+				t.Fatalf("hostTunnel.do() error = %v", err)
+			}
+			if string(r.body) != "HTTP/2.0 /b" {
+				t.Errorf("hostTunnel.do() body = %q, want %q", r.body, "HTTP/2.0 /b")
+			}
+			if got := atomic.LoadInt32(&stats.retried); got != 1 {
+				t.Errorf("retried = %d, want 1", got)
+			}
+			if got := atomic.LoadInt32(&stats.reconnects); got != tt.wantReconnects {
+				t.Errorf("reconnects = %d, want %d", got, tt.wantReconnects)
+			}
+		})
+	}
+}
+
+func TestClient_GetPathsOnHost_streamWindow(t *testing.T) {
+	var upgrades, inflight, peak int32
+	h := h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}), &http2.Server{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "h2c" {
+			atomic.AddInt32(&upgrades, 1)
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	c := New()
+	c.MaxConnPerHost = 2
+	c.StreamWindow = 5
+	defer c.Close()
+
+	targets := []string{}
+	for i := 0; i < 40; i++ {
+		targets = append(targets, fmt.Sprintf("%s/%d", srv.URL, i))
+	}
+	if err := c.GetPathsOnHost(srv.URL, targets); err != nil {
+		t.Fatalf("Client.GetPathsOnHost() error = %v", err)
+	}
+	if got := atomic.LoadInt32(&upgrades); got != 2 {
+		t.Errorf("upgrades = %d, want 2", got)
+	}
+	if got := atomic.LoadInt32(&peak); got <= 2 || got > 10 {
+		t.Errorf("peak streams in flight = %d, want between 3 and 10", got)
+	}
+}
@@ -0,0 +1,290 @@
+package parallel
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/minight/h2csmuggler/internal/paths"
+	log "github.com/sirupsen/logrus"
+)
+
+// Recurse will explore directory-like hits with the same paths, up to depth directories below the
+// targets. A hit is directory-like if it redirects to the path with a trailing slash, is forbidden
+// on a path without an extension, or is an index page. See dirHit.
+// Only hits which are shown are explored, so matchers, filters and AutoCalibrate apply.
+// This is only supported by GetPathsOnHost and GetPathStreamOnHost
+func Recurse(depth int) ParallelOption {
+	return func(o *ParallelOptions) {
+		o.RecursionDepth = depth
+	}
+}
+
+// dirHit returns the directory the result found, with a trailing slash. ok is false if the result
+// doesn't look like a directory
+func dirHit(r *res) (dir string, ok bool) {
+	if r.err != nil || r.res == nil {
+		return "", false
+	}
+	u, err := url.Parse(r.target)
+	if err != nil {
+		return "", false
+	}
+	u.RawQuery = ""
+	u.Fragment = ""
+	slashed := *u
+	if !strings.HasSuffix(slashed.Path, "/") {
+		slashed.Path += "/"
+	}
+
+	switch r.res.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		loc, err := url.Parse(r.res.Header.Get("Location"))
+		if err != nil {
+			return "", false
+		}
+		loc = u.ResolveReference(loc)
+		if loc.Path != u.Path+"/" {
+			return "", false
+		}
+	case http.StatusForbidden:
+		if path.Ext(u.Path) != "" {
+			return "", false
+		}
+	case http.StatusOK:
+		if !strings.HasSuffix(u.Path, "/") && !bytes.Contains(r.body, []byte("<title>Index of")) {
+			return "", false
+		}
+	default:
+		return "", false
+	}
+	if slashed.Path == "/" {
+		// the root is what the targets were already relative to
+		return "", false
+	}
+	return slashed.String(), true
+}
+
+// recursion tracks the directories explored by a run, so none is scheduled twice. Every word and
+// every target it schedules is held in memory to do so. The targets from the input aren't held,
+// and are at depth 0
+type recursion struct {
+	mu       sync.Mutex
+	basePath string
+	maxDepth int
+	words    []string
+	seen     map[string]struct{} // the words
+	depths   map[string]int      // the depth of each target scheduled by the recursion
+	dirs     []string            // the directories explored, in order
+	dirDepth map[string]int
+}
+
+// newRecursion returns the recursion for targets relative to base. The words to explore each
+// directory with are added as the targets are received. See add
+func newRecursion(base string, maxDepth int) *recursion {
+	basePath := "/"
+	if u, err := url.Parse(base); err == nil {
+		basePath = strings.TrimSuffix(u.Path, "/") + "/"
+	}
+	return &recursion{
+		basePath: basePath,
+		maxDepth: maxDepth,
+		seen:     map[string]struct{}{},
+		depths:   map[string]int{},
+		dirDepth: map[string]int{},
+	}
+}
+
+// add will record a target from the input. Its path relative to the base is a word to explore
+// directories with. Directories which were already explored are returned with the new word,
+// since they were explored before it was known
+func (rec *recursion) add(target string) []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	u, err := url.Parse(target)
+	if err != nil || !strings.HasPrefix(u.Path, rec.basePath) {
+		return nil
+	}
+	w := strings.TrimPrefix(u.Path, rec.basePath)
+	if _, ok := rec.seen[w]; ok || w == "" {
+		return nil
+	}
+	rec.seen[w] = struct{}{}
+	rec.words = append(rec.words, w)
+
+	ret := []string{}
+	for _, dir := range rec.dirs {
+		ret = append(ret, rec.schedule(dir, rec.dirDepth[dir], []string{w})...)
+	}
+	return ret
+}
+
+// expand returns the new targets to explore if r is a directory-like hit. Directories and targets
+// which were already scheduled aren't returned again. Path variants aren't explored
+func (rec *recursion) expand(r *res) []string {
+	if r.pathVariant {
+		return nil
+	}
+	dir, ok := dirHit(r)
+	if !ok {
+		return nil
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	// targets which the recursion didn't schedule are from the input
+	depth := rec.depths[r.target] + 1
+	if depth > rec.maxDepth {
+		return nil
+	}
+	if _, ok := rec.dirDepth[dir]; ok {
+		return nil
+	}
+	rec.dirs = append(rec.dirs, dir)
+	rec.dirDepth[dir] = depth
+
+	ret := rec.schedule(dir, depth, rec.words)
+	log.WithFields(log.Fields{
+		"dir":     dir,
+		"depth":   depth,
+		"targets": len(ret),
+	}).Infof("exploring directory")
+	return ret
+}
+
+// schedule returns the words under dir which haven't been scheduled yet, recording their depth
+func (rec *recursion) schedule(dir string, depth int, words []string) []string {
+	u, err := url.Parse(dir)
+	if err != nil {
+		return nil
+	}
+	targets, err := paths.Pitchfork(dir, paths.Prefix([]string{strings.TrimSuffix(u.Path, "/")}, words))
+	if err != nil {
+		return nil
+	}
+	ret := []string{}
+	for _, t := range targets {
+		if _, ok := rec.depths[t]; ok {
+			continue
+		}
+		rec.depths[t] = depth
+		ret = append(ret, t)
+	}
+	return ret
+}
+
+// targetQueue schedules the targets of a run. Targets pushed by the run are popped before the
+// input, which is only read as it's needed. Each target popped must be marked done once its
+// result has been handled, since it may push more
+type targetQueue struct {
+	mu      sync.Mutex
+	input   <-chan string // nil once closed
+	queue   []queuedTarget
+	pending int
+	total   int
+
+	wake chan struct{} // signalled when targets are pushed or done
+}
+
+// queuedTarget is a target scheduled by a targetQueue
+type queuedTarget struct {
+	target  string
+	input   bool // read from the input, rather than pushed by the run
+	variant bool // a path variant of another target. See MutatePaths
+}
+
+func newTargetQueue(input <-chan string) *targetQueue {
+	return &targetQueue{input: input, wake: make(chan struct{}, 1)}
+}
+
+// push will queue the targets after any others which were pushed
+func (q *targetQueue) push(targets ...string) {
+	if len(targets) == 0 {
+		return
+	}
+	q.mu.Lock()
+	for _, t := range targets {
+		q.queue = append(q.queue, queuedTarget{target: t})
+	}
+	q.mu.Unlock()
+	q.signal()
+}
+
+// pushVariants will queue the path variants of a target before any others
+func (q *targetQueue) pushVariants(targets ...string) {
+	if len(targets) == 0 {
+		return
+	}
+	q.mu.Lock()
+	queue := make([]queuedTarget, 0, len(targets)+len(q.queue))
+	for _, t := range targets {
+		queue = append(queue, queuedTarget{target: t, variant: true})
+	}
+	q.queue = append(queue, q.queue...)
+	q.mu.Unlock()
+	q.signal()
+}
+
+func (q *targetQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pop will wait for the next target. ok is false once the input is closed and every target is
+// done, or ctx is cancelled. Only one goroutine may pop
+func (q *targetQueue) pop(ctx context.Context) (t queuedTarget, ok bool) {
+	for {
+		q.mu.Lock()
+		if len(q.queue) > 0 {
+			t = q.queue[0]
+			q.queue = q.queue[1:]
+			q.pending++
+			q.total++
+			q.mu.Unlock()
+			return t, true
+		}
+		in := q.input
+		finished := in == nil && q.pending == 0
+		q.mu.Unlock()
+		if finished {
+			return t, false
+		}
+
+		select {
+		case t, ok := <-in:
+			q.mu.Lock()
+			if !ok {
+				q.input = nil
+				q.mu.Unlock()
+				continue
+			}
+			q.pending++
+			q.total++
+			q.mu.Unlock()
+			return queuedTarget{target: t, input: true}, true
+		case <-q.wake:
+		case <-ctx.Done():
+			return queuedTarget{}, false
+		}
+	}
+}
+
+// done marks a target's result as handled
+func (q *targetQueue) done() {
+	q.mu.Lock()
+	q.pending--
+	q.mu.Unlock()
+	q.signal()
+}
+
+// count returns the number of targets popped
+func (q *targetQueue) count() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.total
+}
@@ -0,0 +1,141 @@
+package parallel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func Test_dirHit(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   string
+		status   int
+		location string
+		body     string
+		want     string
+	}{
+		{name: "redirect to slash", target: "http://a/admin", status: 301, location: "/admin/", want: "http://a/admin/"},
+		{name: "absolute redirect to slash", target: "http://a/admin?x=1", status: 302, location: "http://a/admin/", want: "http://a/admin/"},
+		{name: "redirect elsewhere", target: "http://a/admin", status: 302, location: "/login", want: ""},
+		{name: "forbidden prefix", target: "http://a/private", status: 403, want: "http://a/private/"},
+		{name: "forbidden file", target: "http://a/.htaccess", status: 403, want: ""},
+		{name: "index page", target: "http://a/files", status: 200, body: "<html><title>Index of /files</title>", want: "http://a/files/"},
+		{name: "slash page", target: "http://a/files/", status: 200, want: "http://a/files/"},
+		{name: "page", target: "http://a/files", status: 200, want: ""},
+		{name: "root", target: "http://a/", status: 200, want: ""},
+		{name: "not found", target: "http://a/files", status: 404, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &res{
+				target: tt.target,
+				res:    &http.Response{StatusCode: tt.status, Header: http.Header{"Location": []string{tt.location}}},
+				body:   []byte(tt.body),
+			}
+			got, ok := dirHit(r)
+			if got != tt.want || ok != (tt.want != "") {
+				t.Errorf("dirHit() = %v, %v, want %v", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestClient_GetPathsOnHost_recurse(t *testing.T) {
+	var mu sync.Mutex
+	var upgrades int32
+	requested := map[string]int{}
+	h := h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/admin", "/admin/admin":
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		case "/users", "/admin/users":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}), &http2.Server{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "h2c" {
+			atomic.AddInt32(&upgrades, 1)
+			r.URL.Path = "/init"
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	c := New()
+	c.MaxConnPerHost = 2
+	defer c.Close()
+	targets := []string{srv.URL + "/admin", srv.URL + "/users", srv.URL + "/x"}
+	if err := c.GetPathsOnHost(srv.URL+"/", targets, Recurse(2)); err != nil {
+		t.Fatalf("Client.GetPathsOnHost() error = %v", err)
+	}
+
+	got := []string{}
+	for p, n := range requested {
+		if n != 1 {
+			t.Errorf("%v requested %d times", p, n)
+		}
+		got = append(got, p)
+	}
+	sort.Strings(got)
+	want := []string{
+		"/admin", "/admin/admin", "/admin/admin/admin", "/admin/admin/users", "/admin/admin/x",
+		"/admin/users", "/admin/users/admin", "/admin/users/users", "/admin/users/x", "/admin/x",
+		"/init", "/users", "/users/admin", "/users/users", "/users/x", "/x",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("requested = %v, want %v", got, want)
+	}
+	if got := atomic.LoadInt32(&upgrades); got != 1 {
+		t.Errorf("upgrades = %d, want 1", got)
+	}
+}
+
+func Test_recursion_add(t *testing.T) {
+	rec := newRecursion("http://a/", 2)
+	if got := rec.add("http://a/admin"); len(got) != 0 {
+		t.Errorf("recursion.add() = %v, want none", got)
+	}
+	r := &res{
+		target: "http://a/admin",
+		res:    &http.Response{StatusCode: http.StatusMovedPermanently, Header: http.Header{"Location": []string{"/admin/"}}},
+	}
+	if got, want := rec.expand(r), []string{"http://a/admin/admin"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("recursion.expand() = %v, want %v", got, want)
+	}
+
+	// words which arrive later are sent to the directories already explored
+	if got, want := rec.add("http://a/x"), []string{"http://a/admin/x"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("recursion.add() = %v, want %v", got, want)
+	}
+	if got := rec.add("http://a/x"); len(got) != 0 {
+		t.Errorf("recursion.add() = %v, want none", got)
+	}
+
+	// only the targets the recursion scheduled are held
+	if want := map[string]int{"http://a/admin/admin": 1, "http://a/admin/x": 1}; !reflect.DeepEqual(rec.depths, want) {
+		t.Errorf("recursion.depths = %v, want %v", rec.depths, want)
+	}
+
+	// path variants aren't explored
+	r = &res{
+		target:      "http://a/x",
+		res:         &http.Response{StatusCode: http.StatusMovedPermanently, Header: http.Header{"Location": []string{"/x/"}}},
+		pathVariant: true,
+	}
+	if got := rec.expand(r); len(got) != 0 {
+		t.Errorf("recursion.expand() = %v, want none", got)
+	}
+}
@@ -0,0 +1,476 @@
+package parallel
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/minight/h2csmuggler"
+	"github.com/minight/h2csmuggler/http2"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// RequestSpec is a single request to smuggle, read from a line of a JSONL spec file. e.g.
+//
+//	{"id": "admin", "method": "POST", "url": "/admin", ":authority": "internal", "headers": {"X-Role": "admin"}, "body": "a=1", "expect_status": [200]}
+type RequestSpec struct {
+	// ID identifies the spec in the results. If empty, the line number is used
+	ID     string `json:"id,omitempty"`
+	Method string `json:"method,omitempty"`
+	// URL is the url or path to request. Paths are resolved against the base host
+	URL string `json:"url"`
+	// Authority, if set, is sent as the :authority of the smuggled request
+	Authority string            `json:"authority,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	// Body is sent literally. BodyFile streams the file instead. Only one can be set
+	Body     string `json:"body,omitempty"`
+	BodyFile string `json:"body_file,omitempty"`
+
+	// ExpectStatus, if set, are the status codes the response must have to match
+	ExpectStatus []int `json:"expect_status,omitempty"`
+	// ExpectBody, if set, is a regular expression the response body must match
+	ExpectBody string `json:"expect_body,omitempty"`
+
+	// Inputs are the words a Fuzzer generated the spec with, by keyword
+	Inputs map[string]string `json:"-"`
+
+	body       *h2csmuggler.RequestBody
+	expectBody *regexp.Regexp
+}
+
+// UnmarshalJSON accepts ":authority" as well as "authority", to match how the header is
+// written in http2
+func (s *RequestSpec) UnmarshalJSON(b []byte) error {
+	type spec RequestSpec
+	var v struct {
+		spec
+		PseudoAuthority string `json:":authority"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*s = RequestSpec(v.spec)
+	if v.PseudoAuthority != "" {
+		s.Authority = v.PseudoAuthority
+	}
+	return nil
+}
+
+// SpecReader streams the specs of a reader. This is the input of GetSpecStreamOnHost, so work
+// starts on the first spec of a large file without the rest being held in memory
+type SpecReader struct {
+	// C receives each spec. It's closed once the reader is exhausted, fails, has an invalid spec,
+	// or the context is cancelled
+	C <-chan *RequestSpec
+
+	mu  sync.Mutex
+	err error
+}
+
+// ReadRequestSpecs will stream a spec from each line of r on the returned SpecReader's channel.
+// Blank lines and lines starting with # are skipped
+func ReadRequestSpecs(ctx context.Context, r io.Reader) *SpecReader {
+	out := make(chan *RequestSpec)
+	sr := &SpecReader{C: out}
+	go func() {
+		defer close(out)
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			s := &RequestSpec{}
+			if err := json.Unmarshal([]byte(line), s); err != nil {
+				sr.setErr(errors.Wrapf(err, "line %d", n))
+				return
+			}
+			if s.ID == "" {
+				s.ID = strconv.Itoa(n)
+			}
+			if err := s.init(); err != nil {
+				sr.setErr(errors.Wrapf(err, "line %d", n))
+				return
+			}
+			select {
+			case out <- s:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			sr.setErr(errors.Wrap(err, "failed to read specs"))
+		}
+	}()
+	return sr
+}
+
+func (sr *SpecReader) setErr(err error) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.err = err
+}
+
+// Err returns the error which ended the read, if any. It's only complete once C is closed
+func (sr *SpecReader) Err() error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	return sr.err
+}
+
+// ParseRequestSpecs will read every spec in r. See ReadRequestSpecs to stream them instead
+func ParseRequestSpecs(r io.Reader) ([]*RequestSpec, error) {
+	sr := ReadRequestSpecs(context.Background(), r)
+	specs := []*RequestSpec{}
+	for s := range sr.C {
+		specs = append(specs, s)
+	}
+	if err := sr.Err(); err != nil {
+		return nil, err
+	}
+	return specs, nil
+}
+
+// init will validate the spec and prepare its body and matchers
+func (s *RequestSpec) init() (err error) {
+	if s.URL == "" {
+		return errors.Errorf("spec %v has no url", s.ID)
+	}
+	switch {
+	case s.Body != "" && s.BodyFile != "":
+		return errors.Errorf("spec %v has both a body and a body_file", s.ID)
+	case s.Body != "":
+		s.body = h2csmuggler.BodyString(s.Body)
+	case s.BodyFile != "":
+		s.body, err = h2csmuggler.BodyFile(s.BodyFile)
+		if err != nil {
+			return err
+		}
+	}
+	if s.ExpectBody != "" {
+		s.expectBody, err = regexp.Compile(s.ExpectBody)
+		if err != nil {
+			return errors.Wrapf(err, "spec %v has an invalid expect_body", s.ID)
+		}
+	}
+	return nil
+}
+
+// target returns the url of the spec, resolved against base
+func (s *RequestSpec) target(base *url.URL) (string, error) {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return "", errors.Wrapf(err, "spec %v has an invalid url", s.ID)
+	}
+	return base.ResolveReference(u).String(), nil
+}
+
+// mutations returns the mutations which apply the spec to a request. These are applied after
+// the run's own mutations, so the spec takes precedence
+func (s *RequestSpec) mutations() []RequestMutation {
+	muts := []RequestMutation{}
+	if s.Method != "" {
+		muts = append(muts, func(r *http.Request) {
+			r.Method = s.Method
+		})
+	}
+	if s.Authority != "" {
+		muts = append(muts, func(r *http.Request) {
+			r.Host = s.Authority
+		})
+	}
+	if len(s.Headers) > 0 {
+		muts = append(muts, func(r *http.Request) {
+			for k, v := range s.Headers {
+				if strings.EqualFold(k, "Host") {
+					r.Host = v
+					continue
+				}
+				r.Header.Set(k, v)
+			}
+		})
+	}
+	if s.body != nil {
+		muts = append(muts, func(r *http.Request) {
+			if err := s.body.Apply(r); err != nil {
+				failMutation(r, errors.Wrap(err, "failed to set body"))
+			}
+		})
+	}
+	return muts
+}
+
+// hasExpectations is true if the spec has anything to match the response against
+func (s *RequestSpec) hasExpectations() bool {
+	return len(s.ExpectStatus) > 0 || s.expectBody != nil
+}
+
+// match reports whether the response meets the spec's expectations
+func (s *RequestSpec) match(r *res) bool {
+	if r.err != nil {
+		return false
+	}
+	if len(s.ExpectStatus) > 0 {
+		ok := false
+		for _, code := range s.ExpectStatus {
+			ok = ok || code == r.res.StatusCode
+		}
+		if !ok {
+			return false
+		}
+	}
+	if s.expectBody != nil && !s.expectBody.Match(r.body) {
+		return false
+	}
+	return true
+}
+
+// SpecResult is the result of a RequestSpec, written as a line of JSONL
+type SpecResult struct {
+	ID     string `json:"id"`
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Mode   string `json:"mode"`
+	// Inputs are the words the spec was fuzzed with, by keyword
+	Inputs map[string]string `json:"inputs,omitempty"`
+
+	Status  int         `json:"status,omitempty"`
+	Proto   string      `json:"proto,omitempty"`
+	Headers http.Header `json:"headers,omitempty"`
+	Length  int         `json:"length"`
+	// Body is base64 encoded if it isn't valid utf8. See BodyEncoding
+	Body         string `json:"body,omitempty"`
+	BodyEncoding string `json:"body_encoding,omitempty"`
+
+	// Match is set if the spec has expectations, and reports whether they were met
+	Match *bool  `json:"match,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// newSpecResult returns the result of sending s
+func newSpecResult(s *RequestSpec, mode h2csmuggler.Mode, r *res) SpecResult {
+	sr := SpecResult{
+		ID:     s.ID,
+		Method: r.method,
+		URL:    r.target,
+		Mode:   mode.String(),
+		Inputs: s.Inputs,
+	}
+	if s.hasExpectations() {
+		match := s.match(r)
+		sr.Match = &match
+	}
+	if r.err != nil {
+		sr.Error = r.err.Error()
+		var uscErr http2.UnexpectedStatusCodeError
+		if errors.As(r.err, &uscErr) {
+			sr.Status = uscErr.Code
+		}
+		return sr
+	}
+
+	sr.Status = r.res.StatusCode
+	sr.Proto = r.res.Proto
+	sr.Headers = r.res.Header
+	sr.Length = len(r.body)
+	if utf8.Valid(r.body) {
+		sr.Body = string(r.body)
+	} else {
+		sr.Body = base64.StdEncoding.EncodeToString(r.body)
+		sr.BodyEncoding = "base64"
+	}
+	return sr
+}
+
+// GetSpecsOnHost will smuggle each spec to the base host, writing a SpecResult to out for each as
+// JSONL. Results are written as they complete, so they may not be in the same order as the specs.
+// Results which don't pass the ResultMatcher and ResultFilter options aren't written.
+// opts are applied to every spec before the spec's own method, headers and body.
+// This uses c.MaxConnPerHost to parallelize the specs, sharing tunnels as GetPathsOnHost does
+func (c *Client) GetSpecsOnHost(base string, specs []*RequestSpec, out io.Writer, opts ...ParallelOption) error {
+	return c.GetSpecsOnHostContext(context.Background(), base, specs, out, opts...)
+}
+
+// GetSpecsOnHostContext is GetSpecsOnHost with a context. Cancelling the context will
+// stop scheduling specs and cancel all in-flight requests
+func (c *Client) GetSpecsOnHostContext(ctx context.Context, base string, specs []*RequestSpec, out io.Writer, opts ...ParallelOption) error {
+	// validate our input
+	baseurl, err := url.Parse(base)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse base")
+	}
+	for _, s := range specs {
+		if _, err := s.target(baseurl); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	in := make(chan *RequestSpec)
+	go func() {
+		defer close(in)
+		for _, s := range specs {
+			select {
+			case in <- s:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return c.getSpecStream(ctx, base, in, c.hostWorkers(len(specs)), out, opts...)
+}
+
+// GetSpecStreamOnHost is GetSpecsOnHost for specs received from a channel, e.g. from Fuzzer.Specs.
+// The run ends once specs is closed. Specs with an invalid url are written with an error rather
+// than ending the run
+func (c *Client) GetSpecStreamOnHost(base string, specs <-chan *RequestSpec, out io.Writer, opts ...ParallelOption) error {
+	return c.GetSpecStreamOnHostContext(context.Background(), base, specs, out, opts...)
+}
+
+// GetSpecStreamOnHostContext is GetSpecStreamOnHost with a context. Cancelling the context will
+// stop receiving specs and cancel all in-flight requests
+func (c *Client) GetSpecStreamOnHostContext(ctx context.Context, base string, specs <-chan *RequestSpec, out io.Writer, opts ...ParallelOption) error {
+	return c.getSpecStream(ctx, base, specs, c.hostWorkers(math.MaxInt32), out, opts...)
+}
+
+func (c *Client) getSpecStream(ctx context.Context, base string, specs <-chan *RequestSpec, workers int, out io.Writer, opts ...ParallelOption) error {
+	o := &ParallelOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if err := o.pathsOnly("GetSpecsOnHost"); err != nil {
+		return err
+	}
+
+	// validate our input
+	baseurl, err := url.Parse(base)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse base")
+	}
+
+	// stop consuming the specs if the results can't be written
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type job struct {
+		s   *RequestSpec
+		seq int
+		r   res
+	}
+
+	stats := &runStats{}
+	var wg sync.WaitGroup
+	in := make(chan job, workers)
+	results := make(chan job, workers)
+
+	// Create our worker threads
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			h := &hostTunnel{c: c, base: base, muts: o.RequestMutations, targetMuts: o.targetMutations(), stats: stats}
+			defer h.close()
+
+			for j := range in {
+				target, err := j.s.target(baseurl)
+				if err != nil {
+					j.r = res{target: j.s.URL, method: j.s.Method, err: err}
+					results <- j
+					continue
+				}
+				j.r, err = h.do(ctx, target, j.s.mutations()...)
+				if err != nil {
+					log.WithField("id", j.s.ID).WithError(err).Tracef("failed to request")
+					j.r.err = err
+				}
+				results <- j
+			}
+
+			wg.Done()
+		}()
+	}
+
+	var swg sync.WaitGroup
+	swg.Add(1)
+	count := 0
+	// Create our dispatcher thread
+	go func() {
+	dispatch:
+		for {
+			var s *RequestSpec
+			var ok bool
+			select {
+			case s, ok = <-specs:
+			case <-ctx.Done():
+				break dispatch
+			}
+			if !ok {
+				break
+			}
+			log.WithField("id", s.ID).Tracef("scheduling")
+			select {
+			case in <- job{s: s, seq: count}:
+				count++
+			case <-ctx.Done():
+				break dispatch
+			}
+		}
+		close(in)
+
+		// wait for all the workers to finish, then close our respones channel
+		wg.Wait()
+		close(results)
+		swg.Done()
+	}()
+
+	// Fan-in results
+	source := "h2c"
+	if c.mode() == h2csmuggler.ModeWebSocket {
+		source = "websocket"
+	}
+	enc := json.NewEncoder(out)
+	enc.SetEscapeHTML(false)
+	var werr error
+	seq := c.sequencer()
+	for j := range results {
+		j := j
+		seq.release(j.seq, func() {
+			if ctx.Err() != nil || werr != nil {
+				return
+			}
+			r := j.r
+			if !o.show(&r) {
+				log.WithField("id", j.s.ID).Tracef("filtered")
+				return
+			}
+			r.Log(source)
+			if werr = enc.Encode(newSpecResult(j.s, c.mode(), &r)); werr != nil {
+				cancel()
+			}
+		})
+	}
+
+	// Wait for workers to cleanup
+	wg.Wait()
+	swg.Wait()
+	if werr != nil {
+		return errors.Wrap(werr, "failed to write result")
+	}
+	if ctx.Err() == nil {
+		stats.log(count)
+	}
+	return ctx.Err()
+}
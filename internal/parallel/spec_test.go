@@ -0,0 +1,165 @@
+package parallel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRequestSpecs(t *testing.T) {
+	tests := []struct {
+		name          string
+		in            string
+		wantIDs       []string
+		wantAuthority string
+		wantErr       bool
+	}{
+		{
+			name:    "ids default to the line number",
+			in:      "{\"id\": \"a\", \"url\": \"/a\"}\n\n# comment\n{\"url\": \"/b\"}\n",
+			wantIDs: []string{"a", "4"},
+		},
+		{
+			name:          "pseudo header authority",
+			in:            `{"url": "/", ":authority": "internal"}`,
+			wantIDs:       []string{"1"},
+			wantAuthority: "internal",
+		},
+		{
+			name:          "authority",
+			in:            `{"url": "/", "authority": "internal"}`,
+			wantIDs:       []string{"1"},
+			wantAuthority: "internal",
+		},
+		{name: "invalid json", in: `{"url": "/"`, wantErr: true},
+		{name: "missing url", in: `{"id": "a"}`, wantErr: true},
+		{name: "body and body file", in: `{"url": "/", "body": "a", "body_file": "b"}`, wantErr: true},
+		{name: "invalid expect body", in: `{"url": "/", "expect_body": "("}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRequestSpecs(strings.NewReader(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRequestSpecs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(got) != len(tt.wantIDs) {
+				t.Fatalf("ParseRequestSpecs() = %d specs, want %d", len(got), len(tt.wantIDs))
+			}
+			for i, s := range got {
+				if s.ID != tt.wantIDs[i] {
+					t.Errorf("specs[%d].ID = %v, want %v", i, s.ID, tt.wantIDs[i])
+				}
+			}
+			if got[0].Authority != tt.wantAuthority {
+				t.Errorf("specs[0].Authority = %v, want %v", got[0].Authority, tt.wantAuthority)
+			}
+		})
+	}
+}
+
+func TestReadRequestSpecs(t *testing.T) {
+	// each spec should be received as soon as its line is written, before the rest of the input
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	sr := ReadRequestSpecs(context.Background(), pr)
+
+	for _, id := range []string{"a", "b"} {
+		go fmt.Fprintf(pw, "{\"id\": %q, \"url\": \"/%s\"}\n", id, id)
+		select {
+		case s := <-sr.C:
+			if s.ID != id {
+				t.Errorf("ReadRequestSpecs() = %v, want %v", s.ID, id)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("ReadRequestSpecs() didn't send spec %v before the input ended", id)
+		}
+	}
+
+	go fmt.Fprint(pw, "{\"id\": \"c\"}\n")
+	if s, ok := <-sr.C; ok {
+		t.Errorf("ReadRequestSpecs() = %v, want closed after an invalid spec", s.ID)
+	}
+	if sr.Err() == nil {
+		t.Errorf("SpecReader.Err() = nil, want the invalid spec")
+	}
+}
+
+func TestClient_GetSpecsOnHost(t *testing.T) {
+	srv := newH2CServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body []byte
+		if r.Method != "GET" {
+			body, _ = ioutil.ReadAll(r.Body)
+		}
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		fmt.Fprintf(w, "%s %s %s %s %s", r.Method, r.Host, r.URL.Path, r.Header.Get("X-Test"), body)
+	}))
+	defer srv.Close()
+
+	specs, err := ParseRequestSpecs(strings.NewReader(`
+{"id": "get", "url": "/a", "expect_status": [200]}
+{"id": "post", "method": "POST", "url": "/b", ":authority": "internal", "headers": {"X-Test": "1"}, "body": "a=1", "expect_body": "^POST internal /b 1 a=1$"}
+{"id": "missing", "url": "/missing", "expect_status": [200]}
+`))
+	if err != nil {
+		t.Fatalf("ParseRequestSpecs() error = %v", err)
+	}
+
+	c := New()
+	defer c.Close()
+	var out bytes.Buffer
+	if err := c.GetSpecsOnHost(srv.URL, specs, &out); err != nil {
+		t.Fatalf("Client.GetSpecsOnHost() error = %v", err)
+	}
+
+	got := map[string]SpecResult{}
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var r SpecResult
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("json.Unmarshal() error = %v", err)
+		}
+		got[r.ID] = r
+	}
+
+	tests := []struct {
+		id         string
+		wantMethod string
+		wantStatus int
+		wantBody   string
+		wantMatch  bool
+	}{
+		{id: "get", wantMethod: "GET", wantStatus: 200, wantBody: "GET " + srv.Listener.Addr().String() + " /a  ", wantMatch: true},
+		{id: "post", wantMethod: "POST", wantStatus: 200, wantBody: "POST internal /b 1 a=1", wantMatch: true},
+		{id: "missing", wantMethod: "GET", wantStatus: 404, wantBody: "GET " + srv.Listener.Addr().String() + " /missing  ", wantMatch: false},
+	}
+	if len(got) != len(tests) {
+		t.Fatalf("Client.GetSpecsOnHost() wrote %d results, want %d", len(got), len(tests))
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			r, ok := got[tt.id]
+			if !ok {
+				t.Fatalf("no result for %v", tt.id)
+			}
+			if r.Method != tt.wantMethod || r.Status != tt.wantStatus || r.Body != tt.wantBody {
+				t.Errorf("result = %v %v %q, want %v %v %q", r.Method, r.Status, r.Body, tt.wantMethod, tt.wantStatus, tt.wantBody)
+			}
+			if r.Match == nil || *r.Match != tt.wantMatch {
+				t.Errorf("result.Match = %v, want %v", r.Match, tt.wantMatch)
+			}
+		})
+	}
+}
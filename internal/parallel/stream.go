@@ -0,0 +1,131 @@
+package parallel
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Targets sends each of targets on the returned channel, which is closed once they've all been
+// received or ctx is cancelled. This adapts a slice to the Stream functions
+func Targets(ctx context.Context, targets []string) <-chan string {
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		for _, t := range targets {
+			select {
+			case out <- t:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// LineReader streams the lines of a reader as targets. This is the input of the Stream functions,
+// e.g. GetPathStreamOnHost, so work starts on the first line of a large list without the rest
+// being held in memory
+type LineReader struct {
+	// C receives each line. Blank lines are skipped. It's closed once the reader is exhausted,
+	// fails, or the context is cancelled
+	C <-chan string
+
+	mu  sync.Mutex
+	err error
+}
+
+// ReadLines will stream the lines of r on the returned LineReader's channel
+func ReadLines(ctx context.Context, r io.Reader) *LineReader {
+	out := make(chan string)
+	l := &LineReader{C: out}
+	go func() {
+		defer close(out)
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			line := strings.TrimRight(scanner.Text(), "\r")
+			if line == "" {
+				continue
+			}
+			select {
+			case out <- line:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			l.mu.Lock()
+			l.err = errors.Wrap(err, "failed to read lines")
+			l.mu.Unlock()
+		}
+	}()
+	return l
+}
+
+// Err returns the error which ended the read, if any. It's only complete once C is closed
+func (l *LineReader) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// Unique passes on each target the first time it's received. Every target is held in memory to
+// do so. The returned channel is closed once in is, or ctx is cancelled
+func Unique(ctx context.Context, in <-chan string) <-chan string {
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		seen := map[string]struct{}{}
+		for t := range in {
+			if _, ok := seen[t]; ok {
+				continue
+			}
+			seen[t] = struct{}{}
+			select {
+			case out <- t:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// sequencer releases results in the order their targets were dispatched, holding the results
+// which complete early. A nil sequencer releases each result as it's received
+type sequencer struct {
+	next int
+	held map[int]func()
+}
+
+// sequencer returns the sequencer for a run, which is nil unless c.Ordered is set
+func (c *Client) sequencer() *sequencer {
+	if !c.Ordered {
+		return nil
+	}
+	return &sequencer{held: map[int]func(){}}
+}
+
+// release will call f for the result with sequence number seq once every result before it has
+// been released. Each sequence number from 0 must be released exactly once
+func (s *sequencer) release(seq int, f func()) {
+	if s == nil {
+		f()
+		return
+	}
+	s.held[seq] = f
+	for {
+		f, ok := s.held[s.next]
+		if !ok {
+			return
+		}
+		delete(s.held, s.next)
+		s.next++
+		f()
+	}
+}
@@ -0,0 +1,139 @@
+package parallel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadLines(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		dedupe bool
+		want   []string
+	}{
+		{name: "lines", input: "/a\n/b\n", want: []string{"/a", "/b"}},
+		{name: "blank and crlf", input: "/a\r\n\n\n/b", want: []string{"/a", "/b"}},
+		{name: "duplicates", input: "/a\n/b\n/a\n", want: []string{"/a", "/b", "/a"}},
+		{name: "dedupe", input: "/a\n/b\n/a\n", dedupe: true, want: []string{"/a", "/b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := ReadLines(context.Background(), strings.NewReader(tt.input))
+			in := l.C
+			if tt.dedupe {
+				in = Unique(context.Background(), in)
+			}
+			got := []string{}
+			for line := range in {
+				got = append(got, line)
+			}
+			if !reflect.DeepEqual(got, tt.want) || l.Err() != nil {
+				t.Errorf("ReadLines() = %v, %v, want %v", got, l.Err(), tt.want)
+			}
+		})
+	}
+}
+
+func Test_sequencer_release(t *testing.T) {
+	tests := []struct {
+		name    string
+		ordered bool
+		seqs    []int
+		want    []int
+	}{
+		{name: "unordered", seqs: []int{2, 0, 1}, want: []int{2, 0, 1}},
+		{name: "ordered", ordered: true, seqs: []int{2, 0, 3, 1}, want: []int{0, 1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := (&Client{Ordered: tt.ordered}).sequencer()
+			got := []int{}
+			for _, seq := range tt.seqs {
+				seq := seq
+				s.release(seq, func() { got = append(got, seq) })
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("released = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClient_GetPathStreamOnHost(t *testing.T) {
+	requested := make(chan string, 10)
+	srv := newH2CServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- r.URL.Path
+	}))
+	defer srv.Close()
+
+	c := New()
+	defer c.Close()
+	targets := make(chan string)
+	errc := make(chan error)
+	go func() {
+		errc <- c.GetPathStreamOnHost(srv.URL+"/", targets)
+	}()
+
+	// each target must be sent before the next is received
+	for _, p := range []string{"/a", "/b"} {
+		targets <- srv.URL + p
+		timeout := time.After(5 * time.Second)
+		for got := ""; got != p; {
+			select {
+			case got = <-requested:
+			case <-timeout:
+				t.Fatalf("%v wasn't sent before the input ended", p)
+			}
+		}
+	}
+	close(targets)
+	if err := <-errc; err != nil {
+		t.Fatalf("Client.GetPathStreamOnHost() error = %v", err)
+	}
+}
+
+func TestClient_GetSpecStreamOnHost_ordered(t *testing.T) {
+	srv := newH2CServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer srv.Close()
+
+	specs := make(chan *RequestSpec, 4)
+	specs <- &RequestSpec{ID: "0", URL: "/slow"}
+	for i := 1; i < 4; i++ {
+		specs <- &RequestSpec{ID: fmt.Sprint(i), URL: "/fast"}
+	}
+	close(specs)
+
+	c := New()
+	c.Ordered = true
+	defer c.Close()
+	var out bytes.Buffer
+	if err := c.GetSpecStreamOnHost(srv.URL, specs, &out); err != nil {
+		t.Fatalf("Client.GetSpecStreamOnHost() error = %v", err)
+	}
+
+	got := []string{}
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var r SpecResult
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("json.Unmarshal() error = %v", err)
+		}
+		got = append(got, r.ID)
+	}
+	if want := []string{"0", "1", "2", "3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("results = %v, want %v", got, want)
+	}
+}
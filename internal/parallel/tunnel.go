@@ -0,0 +1,196 @@
+package parallel
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/minight/h2csmuggler"
+	"github.com/minight/h2csmuggler/http2"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// runStats are shared by the workers of a run, and logged once it completes
+type runStats struct {
+	tunnels    int32 // tunnels initialized by the run, including reconnects
+	reconnects int32
+	retried    int32
+}
+
+func (s *runStats) log(targets int) {
+	log.WithFields(log.Fields{
+		"targets":    targets,
+		"tunnels":    atomic.LoadInt32(&s.tunnels),
+		"reconnects": atomic.LoadInt32(&s.reconnects),
+		"retried":    atomic.LoadInt32(&s.retried),
+	}).Infof("run complete")
+}
+
+// hostTunnel hands out tunnels to base for a single worker. h2c connections come from the client's
+// pool, so they're shared between workers and runs, up to the client's StreamWindow. Websocket
+// tunnels only carry one request at a time, so each worker keeps its own.
+// Once the worker has used a working tunnel, any new tunnel it needs is a reconnect. Reconnects
+// which fail to upgrade are retried with backoff, up to the client's MaxReconnects
+type hostTunnel struct {
+	c          *Client
+	base       string
+	muts       []RequestMutation // applied to the request which initializes the tunnel
+	targetMuts []RequestMutation
+	stats      *runStats
+
+	ws          tunnel
+	established bool
+}
+
+// do will send target through a tunnel. muts are applied after the worker's target mutations.
+// Targets which the server never processed, e.g. streams refused or above the last stream id of a
+// GOAWAY, are resent with backoff
+func (h *hostTunnel) do(ctx context.Context, target string, muts ...RequestMutation) (r res, err error) {
+	if len(muts) > 0 {
+		muts = append(append([]RequestMutation{}, h.targetMuts...), muts...)
+	} else {
+		muts = h.targetMuts
+	}
+
+	for attempt := 0; ; attempt++ {
+		conn, release, err := h.get(ctx)
+		if err != nil {
+			return res{target: target}, err
+		}
+
+		log.WithField("target", target).Tracef("requesting")
+		r, err = doConn(ctx, conn, target, muts...)
+		release()
+		if err == nil || ctx.Err() != nil {
+			return r, err
+		}
+
+		if h.c.mode() == h2csmuggler.ModeWebSocket {
+			// the websocket tunnel is closed after a failed request, so the next target needs a new one
+			h.close()
+			return r, err
+		}
+		if !http2.CanRetryError(err) || attempt >= h.c.maxReconnects() {
+			return r, err
+		}
+
+		atomic.AddInt32(&h.stats.retried, 1)
+		log.WithField("target", target).WithError(err).Debugf("not processed by the server. retrying")
+		if err := h.c.backoff(ctx, attempt); err != nil {
+			return r, err
+		}
+	}
+}
+
+// get will return a tunnel, initializing it with a request to base if needed. release must be
+// called once the caller has read the response
+func (h *hostTunnel) get(ctx context.Context) (conn tunnel, release func(), err error) {
+	for attempt := 0; ; attempt++ {
+		conn, release, err := h.acquire(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		if conn.Initialized() {
+			h.established = true
+			return conn, release, nil
+		}
+
+		// initialize the connection with our first base request
+		// don't return the result because its expected for this to work
+		_, err = doConn(ctx, conn, h.base, h.muts...)
+		if conn.Initialized() {
+			atomic.AddInt32(&h.stats.tunnels, 1)
+		}
+		if err != nil {
+			log.WithField("target", h.base).WithError(err).Tracef("failed to request")
+		}
+		if !h.established {
+			// let the target attempt the upgrade itself
+			h.established = conn.Initialized()
+			return conn, release, nil
+		}
+
+		atomic.AddInt32(&h.stats.reconnects, 1)
+		if conn.Initialized() {
+			log.WithField("target", h.base).Debugf("reconnected")
+			return conn, release, nil
+		}
+
+		release()
+		h.close()
+		if attempt >= h.c.maxReconnects() {
+			return nil, nil, errors.Wrap(err, "reconnect failed")
+		}
+		log.WithField("target", h.base).WithError(err).Debugf("reconnect failed. retrying")
+		if err := h.c.backoff(ctx, attempt); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// acquire returns the worker's websocket tunnel, or a h2c connection from the pool
+func (h *hostTunnel) acquire(ctx context.Context) (conn tunnel, release func(), err error) {
+	mode := h.c.mode()
+	if mode == h2csmuggler.ModeWebSocket {
+		if h.ws == nil {
+			h.ws, err = newTunnel(h.base, mode, h.c.connOptions()...)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "connect")
+			}
+		}
+		return h.ws, func() {}, nil
+	}
+
+	key, err := h2csmuggler.NewPoolKey(h.base, mode, h.c.poolProfile(""))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "connect")
+	}
+	pool := h.c.pool()
+	pc, err := pool.GetStreams(ctx, key, h.c.streamWindow(), h.c.connOptions()...)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "connect")
+	}
+	return pc, func() { pool.Put(pc) }, nil
+}
+
+// close will close the worker's websocket tunnel. Pooled connections are left to the pool
+func (h *hostTunnel) close() {
+	if h.ws != nil {
+		h.ws.Close()
+		h.ws = nil
+	}
+}
+
+func (c *Client) maxReconnects() int {
+	switch {
+	case c.MaxReconnects < 0:
+		return 0
+	case c.MaxReconnects == 0:
+		return DefaultMaxReconnects
+	}
+	return c.MaxReconnects
+}
+
+// backoff will wait before the next reconnect. The delay doubles with each attempt
+func (c *Client) backoff(ctx context.Context, attempt int) error {
+	d := c.ReconnectBackoff
+	if d == 0 {
+		d = DefaultReconnectBackoff
+	}
+	for i := 0; i < attempt && d < MaxReconnectBackoff; i++ {
+		d *= 2
+	}
+	if d > MaxReconnectBackoff {
+		d = MaxReconnectBackoff
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,321 @@
+package parallel
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// VhostAddresses are always tried as candidates by VhostCandidates
+	VhostAddresses = []string{
+		"localhost",
+		"127.0.0.1",
+		"0.0.0.0",
+		"[::1]",
+		"10.0.0.1",
+		"172.17.0.1",
+		"192.168.0.1",
+		"169.254.169.254",
+	}
+
+	// VhostServices are common internal service names. They're used as the words for
+	// VhostCandidates if no wordlist is provided
+	VhostServices = []string{
+		"admin",
+		"api",
+		"internal",
+		"backend",
+		"intranet",
+		"dev",
+		"staging",
+		"test",
+		"management",
+		"metrics",
+		"status",
+		"kubernetes.default",
+	}
+
+	// VhostSuffixes are the internal TLDs and domains each word is tried with
+	VhostSuffixes = []string{
+		"internal",
+		"local",
+		"localdomain",
+		"localhost",
+		"lan",
+		"corp",
+		"svc",
+		"svc.cluster.local",
+	}
+
+	// VhostLengthTolerance is how many bytes a response can differ from the baseline by before it's
+	// considered different. This is added to the variance between the baselines
+	VhostLengthTolerance = 16
+)
+
+// VhostCandidates will return the :authority values to try against base. Each word is tried as
+// is, with each of VhostSuffixes, and as a subdomain of base's domain. VhostAddresses are always
+// included. If words is empty, VhostServices are used.
+// Duplicates are removed, keeping the first occurrence
+func VhostCandidates(base string, words []string) []string {
+	if len(words) == 0 {
+		words = VhostServices
+	}
+
+	var domain string
+	if u, err := url.Parse(base); err == nil && net.ParseIP(u.Hostname()) == nil {
+		domain = u.Hostname()
+		// use the parent domain if there is one. www.example.com -> example.com
+		if labels := strings.Split(domain, "."); len(labels) > 2 {
+			domain = strings.Join(labels[1:], ".")
+		}
+	}
+
+	seen := map[string]struct{}{}
+	ret := []string{}
+	add := func(h string) {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if h == "" {
+			return
+		}
+		if _, ok := seen[h]; ok {
+			return
+		}
+		seen[h] = struct{}{}
+		ret = append(ret, h)
+	}
+
+	for _, w := range words {
+		add(w)
+		for _, s := range VhostSuffixes {
+			add(w + "." + s)
+		}
+		if domain != "" && !strings.Contains(w, ".") {
+			add(w + "." + domain)
+		}
+	}
+	for _, a := range VhostAddresses {
+		add(a)
+	}
+	return ret
+}
+
+// vhostFingerprint is the parts of a response which are compared to find vhosts. The
+// :authority is removed from the body and Location first, since many servers reflect it
+type vhostFingerprint struct {
+	err      bool
+	status   int
+	location string
+	length   int
+}
+
+func newVhostFingerprint(r *res, authority string) vhostFingerprint {
+	if r.err != nil {
+		return vhostFingerprint{err: true}
+	}
+	body := bytes.ReplaceAll(r.body, []byte(authority), nil)
+	return vhostFingerprint{
+		status:   r.res.StatusCode,
+		location: strings.ReplaceAll(r.res.Header.Get("Location"), authority, ""),
+		length:   len(body),
+	}
+}
+
+// vhostBaseline holds the fingerprints of the responses to nonsense hosts
+type vhostBaseline struct {
+	fingerprints []vhostFingerprint
+	tolerance    int
+}
+
+func newVhostBaseline(fps ...vhostFingerprint) *vhostBaseline {
+	// allow for dynamic content by tolerating the variance between the baselines
+	variance := 0
+	for _, a := range fps {
+		for _, c := range fps {
+			if d := a.length - c.length; a.status == c.status && d > variance {
+				variance = d
+			}
+		}
+	}
+	return &vhostBaseline{fingerprints: fps, tolerance: variance + VhostLengthTolerance}
+}
+
+// differs reports whether fp doesn't match any of the baselines
+func (b *vhostBaseline) differs(fp vhostFingerprint) bool {
+	for _, base := range b.fingerprints {
+		if fp.err != base.err || fp.status != base.status || fp.location != base.location {
+			continue
+		}
+		d := fp.length - base.length
+		if d < 0 {
+			d = -d
+		}
+		if d <= b.tolerance {
+			return false
+		}
+	}
+	return true
+}
+
+// nonsenseHost returns a random host which shouldn't be routed by any backend
+func nonsenseHost() string {
+	return "h2cs-" + randomToken() + ".invalid"
+}
+
+// authority returns a mutation which sends host as the :authority of the request
+func authority(host string) RequestMutation {
+	return func(r *http.Request) {
+		r.Host = host
+	}
+}
+
+// GetVhostsOnHost will smuggle target to the base host once per host, sending each host as the
+// :authority. The responses are compared with baselines for nonsense hosts, and only hosts whose
+// responses differ in status, redirect or length, and pass the ResultMatcher and ResultFilter
+// options, are reported. The hosts found are returned.
+// Use VhostCandidates to generate the hosts from a wordlist.
+// This uses c.MaxConnPerHost to parallelize the hosts, sharing tunnels as GetPathsOnHost does.
+// The request which initializes the tunnel is sent with its usual :authority
+func (c *Client) GetVhostsOnHost(base string, target string, hosts []string, opts ...ParallelOption) ([]string, error) {
+	return c.GetVhostsOnHostContext(context.Background(), base, target, hosts, opts...)
+}
+
+// GetVhostsOnHostContext is GetVhostsOnHost with a context. Cancelling the context will
+// stop scheduling hosts and cancel all in-flight requests
+func (c *Client) GetVhostsOnHostContext(ctx context.Context, base string, target string, hosts []string, opts ...ParallelOption) ([]string, error) {
+	workers := c.hostWorkers(len(hosts))
+
+	o := &ParallelOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	// validate our input
+	_, err := url.Parse(base)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse base")
+	}
+
+	stats := &runStats{}
+
+	// establish the baseline first, so every host is compared with the same responses
+	h := &hostTunnel{c: c, base: base, muts: o.RequestMutations, targetMuts: o.targetMutations(), stats: stats}
+	fps := []vhostFingerprint{}
+	for i := 0; i < 2; i++ {
+		host := nonsenseHost()
+		r, err := h.do(ctx, target, authority(host))
+		if err != nil {
+			r.err = err
+		}
+		fp := newVhostFingerprint(&r, host)
+		log.WithFields(log.Fields{
+			"host":   host,
+			"status": fp.status,
+			"body":   fp.length,
+			"err":    r.err,
+		}).Debugf("vhost baseline")
+		fps = append(fps, fp)
+	}
+	h.close()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	baseline := newVhostBaseline(fps...)
+
+	type job struct {
+		host string
+		r    res
+	}
+
+	var wg sync.WaitGroup
+	in := make(chan string, workers)
+	out := make(chan job, workers)
+
+	// Create our worker threads
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			h := &hostTunnel{c: c, base: base, muts: o.RequestMutations, targetMuts: o.targetMutations(), stats: stats}
+			defer h.close()
+
+			for host := range in {
+				r, err := h.do(ctx, target, authority(host))
+				if err != nil {
+					log.WithField("host", host).WithError(err).Tracef("failed to request")
+					r.err = err
+				}
+				out <- job{host: host, r: r}
+			}
+
+			wg.Done()
+		}()
+	}
+
+	var swg sync.WaitGroup
+	swg.Add(1)
+	// Create our dispatcher thread
+	go func() {
+	dispatch:
+		for _, host := range hosts {
+			log.WithField("host", host).Tracef("scheduling")
+			select {
+			case in <- host:
+			case <-ctx.Done():
+				break dispatch
+			}
+		}
+		close(in)
+
+		// wait for all the workers to finish, then close our respones channel
+		wg.Wait()
+		close(out)
+		swg.Done()
+	}()
+
+	// Fan-in results
+	found := []string{}
+	for j := range out {
+		if ctx.Err() != nil {
+			continue
+		}
+		fp := newVhostFingerprint(&j.r, j.host)
+		fields := log.Fields{
+			"host":            j.host,
+			"target":          target,
+			"status":          fp.status,
+			"body":            fp.length,
+			"baseline-status": baseline.fingerprints[0].status,
+			"baseline-body":   baseline.fingerprints[0].length,
+		}
+		if !baseline.differs(fp) {
+			log.WithFields(fields).Debugf("vhost matches baseline")
+			continue
+		}
+		if !o.show(&j.r) {
+			log.WithFields(fields).Debugf("vhost filtered")
+			continue
+		}
+		found = append(found, j.host)
+		if j.r.err != nil {
+			log.WithFields(fields).WithError(j.r.err).Infof("vhost found")
+			continue
+		}
+		log.WithFields(fields).WithField("headers", j.r.res.Header).Infof("vhost found")
+	}
+
+	// Wait for workers to cleanup
+	wg.Wait()
+	swg.Wait()
+	if ctx.Err() == nil {
+		stats.log(len(hosts))
+		log.WithField("found", len(found)).Infof("vhost discovery complete")
+	}
+	return found, ctx.Err()
+}
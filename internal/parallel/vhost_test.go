@@ -0,0 +1,103 @@
+package parallel
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVhostCandidates(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     string
+		words    []string
+		want     []string
+		wantMiss []string
+	}{
+		{
+			name:  "subdomain of the parent domain",
+			base:  "https://www.example.com/",
+			words: []string{"admin"},
+			want:  []string{"admin", "admin.internal", "admin.svc.cluster.local", "admin.example.com", "localhost", "127.0.0.1"},
+		},
+		{
+			name:     "ip base",
+			base:     "http://10.1.1.1/",
+			words:    []string{"admin"},
+			want:     []string{"admin", "admin.internal"},
+			wantMiss: []string{"admin.10.1.1.1", "admin.1.1.1"},
+		},
+		{
+			name:     "words with a domain aren't made subdomains",
+			base:     "https://example.com/",
+			words:    []string{"api.corp"},
+			want:     []string{"api.corp", "api.corp.internal"},
+			wantMiss: []string{"api.corp.example.com"},
+		},
+		{
+			name: "services by default",
+			base: "https://example.com/",
+			want: []string{"api", "api.example.com", "backend.internal"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := VhostCandidates(tt.base, tt.words)
+			seen := map[string]int{}
+			for _, h := range got {
+				seen[h]++
+				if seen[h] > 1 {
+					t.Errorf("VhostCandidates() returned %v more than once", h)
+				}
+			}
+			for _, h := range tt.want {
+				if seen[h] == 0 {
+					t.Errorf("VhostCandidates() missing %v", h)
+				}
+			}
+			for _, h := range tt.wantMiss {
+				if seen[h] != 0 {
+					t.Errorf("VhostCandidates() returned %v", h)
+				}
+			}
+		})
+	}
+}
+
+func TestClient_GetVhostsOnHost(t *testing.T) {
+	srv := newH2CServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Host == "admin.internal":
+			fmt.Fprintf(w, "admin panel for %s. %s", r.Host, strings.Repeat("secret ", 20))
+		case r.Host == "redirect.internal":
+			http.Redirect(w, r, "https://sso.example.com/", http.StatusFound)
+		case strings.HasPrefix(r.Host, "127.0.0.1"):
+			fmt.Fprintf(w, "default")
+		default:
+			// the host is reflected, which shouldn't make each host look different
+			w.Header().Set("Location", "https://"+r.Host+"/")
+			w.WriteHeader(http.StatusMisdirectedRequest)
+			fmt.Fprintf(w, "unknown host %s", r.Host)
+		}
+	}))
+	defer srv.Close()
+
+	c := New()
+	defer c.Close()
+	hosts := []string{"admin.internal", "redirect.internal", "nothing.internal", "a-much-longer-host-that-is-still-not-routed.internal"}
+	got, err := c.GetVhostsOnHost(srv.URL, srv.URL+"/", hosts)
+	if err != nil {
+		t.Fatalf("Client.GetVhostsOnHost() error = %v", err)
+	}
+
+	found := map[string]bool{}
+	for _, h := range got {
+		found[h] = true
+	}
+	want := map[string]bool{"admin.internal": true, "redirect.internal": true}
+	if !reflect.DeepEqual(found, want) {
+		t.Errorf("Client.GetVhostsOnHost() = %v, want %v", got, want)
+	}
+}
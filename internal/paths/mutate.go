@@ -0,0 +1,274 @@
+package paths
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Mutation returns variants of an escaped path, which an ACL may not recognise as the path but
+// the backend may still route to it. The path itself isn't returned
+type Mutation func(p string) []string
+
+// Extensions are appended to the path by the extensions mutation
+var Extensions = []string{".json", ".html", ".php", ".css", ".js"}
+
+var mutations = map[string]Mutation{
+	"encode":        Encode,
+	"double-encode": DoubleEncode,
+	"overlong":      OverlongEncode,
+	"normalize":     Normalize,
+	"case":          CasePermute,
+	"extensions": func(p string) []string {
+		return AppendExtensions(Extensions...)(p)
+	},
+}
+
+// MutationNames are the mutations accepted by ParseMutations, in the order they're applied
+var MutationNames = []string{"encode", "double-encode", "overlong", "normalize", "case", "extensions"}
+
+// ParseMutations returns the mutations with the given names. all is every mutation
+func ParseMutations(names []string) ([]Mutation, error) {
+	ret := []Mutation{}
+	for _, n := range names {
+		if n == "all" {
+			return ParseMutations(MutationNames)
+		}
+		m, ok := mutations[n]
+		if !ok {
+			return nil, errors.Errorf("unknown mutation %q. expected one of %v or all", n, strings.Join(MutationNames, ", "))
+		}
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+// Mutate returns the variants of the escaped path p from each of muts, without duplicates
+// or p itself
+func Mutate(p string, muts ...Mutation) []string {
+	seen := map[string]struct{}{p: {}}
+	ret := []string{}
+	for _, mut := range muts {
+		for _, v := range mut(p) {
+			if _, ok := seen[v]; ok {
+				continue
+			}
+			seen[v] = struct{}{}
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// MutateURL returns the variants of the target's path from each of muts. The query is kept
+// as is. The variants are built from the escaped path, so they must be parsed, not set as
+// url.URL.Path, to be sent as they are
+func MutateURL(target string, muts ...Mutation) ([]string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse target")
+	}
+	prefix := ""
+	if u.Host != "" {
+		prefix = u.Scheme + "://" + u.Host
+	}
+	suffix := ""
+	if u.RawQuery != "" || u.ForceQuery {
+		suffix = "?" + u.RawQuery
+	}
+	p := u.EscapedPath()
+	if p == "" {
+		p = "/"
+	}
+
+	ret := []string{}
+	for _, v := range Mutate(p, muts...) {
+		ret = append(ret, prefix+v+suffix)
+	}
+	return ret, nil
+}
+
+// segments splits p into its segments, without the leading slash
+func segments(p string) []string {
+	return strings.Split(strings.TrimPrefix(p, "/"), "/")
+}
+
+// join is the inverse of segments
+func join(segs []string, sep string) string {
+	return "/" + strings.Join(segs, sep)
+}
+
+// replaceSegment returns p with segment i replaced by f's result
+func replaceSegment(segs []string, i int, f func(seg string) string) string {
+	cp := append([]string{}, segs...)
+	cp[i] = f(cp[i])
+	return join(cp, "/")
+}
+
+// lastSegment returns the index of the last non-empty segment, or -1 if there isn't one
+func lastSegment(segs []string) int {
+	for i := len(segs) - 1; i >= 0; i-- {
+		if segs[i] != "" {
+			return i
+		}
+	}
+	return -1
+}
+
+// encodeWith returns a mutation encoding the path with enc:
+//   - the first character of each segment
+//   - every character of the last segment
+//   - each slash between segments
+func encodeWith(enc func(b byte) string) Mutation {
+	return func(p string) []string {
+		segs := segments(p)
+		ret := []string{}
+		for i, seg := range segs {
+			if seg == "" || seg[0] == '%' {
+				continue
+			}
+			ret = append(ret, replaceSegment(segs, i, func(seg string) string {
+				return enc(seg[0]) + seg[1:]
+			}))
+		}
+		if i := lastSegment(segs); i != -1 && !strings.Contains(segs[i], "%") && len(segs[i]) > 1 {
+			ret = append(ret, replaceSegment(segs, i, func(seg string) string {
+				var b strings.Builder
+				for j := 0; j < len(seg); j++ {
+					b.WriteString(enc(seg[j]))
+				}
+				return b.String()
+			}))
+		}
+		if len(segs) > 1 {
+			ret = append(ret, join(segs, enc('/')))
+		}
+		return ret
+	}
+}
+
+// Encode will percent-encode parts of the path once. e.g. /admin -> /%61dmin
+var Encode = encodeWith(func(b byte) string {
+	return fmt.Sprintf("%%%02X", b)
+})
+
+// DoubleEncode will percent-encode parts of the path twice. e.g. /admin -> /%2561dmin
+var DoubleEncode = encodeWith(func(b byte) string {
+	return fmt.Sprintf("%%25%02X", b)
+})
+
+// OverlongEncode will encode parts of the path as overlong 2 byte UTF-8 sequences. e.g. / -> %C0%AF
+var OverlongEncode = encodeWith(func(b byte) string {
+	return fmt.Sprintf("%%%02X%%%02X", 0xc0|b>>6, 0x80|b&0x3f)
+})
+
+// Normalize will add segments and characters which are removed when the path is normalized:
+// doubled slashes, /./ segments, a leading /..;/, a ;param on each segment and a trailing dot
+func Normalize(p string) []string {
+	segs := segments(p)
+	ret := []string{
+		"/" + join(segs, "/"),
+		"/" + join(segs, "//"),
+		"/." + join(segs, "/./"),
+		"/..;" + join(segs, "/"),
+	}
+	for i, seg := range segs {
+		if seg == "" {
+			continue
+		}
+		ret = append(ret, replaceSegment(segs, i, func(seg string) string {
+			return seg + ";x"
+		}))
+	}
+	if i := lastSegment(segs); i != -1 {
+		ret = append(ret, replaceSegment(segs, i, func(seg string) string {
+			return seg + "."
+		}))
+	}
+	return ret
+}
+
+// CasePermute will change the case of the letters in the path: all upper case, each segment
+// capitalized, and each letter of the last segment on its own
+func CasePermute(p string) []string {
+	segs := segments(p)
+	ret := []string{
+		mapLetters(p, func(i int, c byte) byte { return upper(c) }),
+	}
+	title := make([]string, len(segs))
+	for i, seg := range segs {
+		title[i] = mapLetters(seg, func(j int, c byte) byte {
+			if j == 0 {
+				return upper(c)
+			}
+			return c
+		})
+	}
+	ret = append(ret, join(title, "/"))
+
+	if i := lastSegment(segs); i != -1 {
+		for j := 0; j < len(segs[i]); j++ {
+			v := replaceSegment(segs, i, func(seg string) string {
+				return mapLetters(seg, func(k int, c byte) byte {
+					if k == j {
+						return toggle(c)
+					}
+					return c
+				})
+			})
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// mapLetters applies f to each ASCII letter of s with its index, skipping percent-encodings
+func mapLetters(s string, f func(i int, c byte) byte) string {
+	b := []byte(s)
+	for i := 0; i < len(b); i++ {
+		if b[i] == '%' {
+			i += 2
+			continue
+		}
+		if isLetter(b[i]) {
+			b[i] = f(i, b[i])
+		}
+	}
+	return string(b)
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func upper(c byte) byte {
+	if c >= 'a' && c <= 'z' {
+		return c - 'a' + 'A'
+	}
+	return c
+}
+
+func toggle(c byte) byte {
+	if c >= 'a' && c <= 'z' {
+		return c - 'a' + 'A'
+	}
+	return c - 'A' + 'a'
+}
+
+// AppendExtensions returns a mutation which appends each of exts to the path, after any
+// trailing slash is removed
+func AppendExtensions(exts ...string) Mutation {
+	return func(p string) []string {
+		p = strings.TrimSuffix(p, "/")
+		if p == "" {
+			return nil
+		}
+		ret := []string{}
+		for _, ext := range exts {
+			ret = append(ret, p+ext)
+		}
+		return ret
+	}
+}
@@ -0,0 +1,104 @@
+package paths
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMutate(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		muts []Mutation
+		want []string
+	}{
+		{
+			name: "encode",
+			path: "/a/bc",
+			muts: []Mutation{Encode},
+			want: []string{"/%61/bc", "/a/%62c", "/a/%62%63", "/a%2Fbc"},
+		},
+		{
+			name: "encode skips encodings",
+			path: "/%61/bc",
+			muts: []Mutation{Encode},
+			want: []string{"/%61/%62c", "/%61/%62%63", "/%61%2Fbc"},
+		},
+		{
+			name: "double encode",
+			path: "/ab",
+			muts: []Mutation{DoubleEncode},
+			want: []string{"/%2561b", "/%2561%2562"},
+		},
+		{
+			name: "overlong",
+			path: "/a/.",
+			muts: []Mutation{OverlongEncode},
+			want: []string{"/%C1%A1/.", "/a/%C0%AE", "/a%C0%AF."},
+		},
+		{
+			name: "normalize",
+			path: "/a/b",
+			muts: []Mutation{Normalize},
+			want: []string{"//a/b", "//a//b", "/./a/./b", "/..;/a/b", "/a;x/b", "/a/b;x", "/a/b."},
+		},
+		{
+			name: "normalize trailing slash",
+			path: "/a/",
+			muts: []Mutation{Normalize},
+			want: []string{"//a/", "//a//", "/./a/./", "/..;/a/", "/a;x/", "/a./"},
+		},
+		{
+			name: "case",
+			path: "/ab/c%2f",
+			muts: []Mutation{CasePermute},
+			want: []string{"/AB/C%2f", "/Ab/C%2f", "/ab/C%2f"},
+		},
+		{
+			name: "extensions",
+			path: "/a/",
+			muts: []Mutation{AppendExtensions(".json", ";.css")},
+			want: []string{"/a.json", "/a;.css"},
+		},
+		{
+			name: "deduplicated",
+			path: "/a",
+			muts: []Mutation{Encode, Encode, CasePermute},
+			want: []string{"/%61", "/A"},
+		},
+		{
+			name: "root",
+			path: "/",
+			muts: []Mutation{Encode, CasePermute, AppendExtensions(".json")},
+			want: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Mutate(tt.path, tt.muts...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Mutate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMutateURL(t *testing.T) {
+	got, err := MutateURL("http://x/a%2Fb?q=1", Encode)
+	if err != nil {
+		t.Fatalf("MutateURL() error = %v", err)
+	}
+	want := []string{"http://x/%61%2Fb?q=1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MutateURL() = %v, want %v", got, want)
+	}
+}
+
+func TestParseMutations(t *testing.T) {
+	muts, err := ParseMutations([]string{"all"})
+	if err != nil || len(muts) != len(MutationNames) {
+		t.Errorf("ParseMutations(all) = %v, %v", len(muts), err)
+	}
+	if _, err := ParseMutations([]string{"nope"}); err == nil {
+		t.Errorf("ParseMutations(nope) expected an error")
+	}
+}
@@ -0,0 +1,264 @@
+package h2csmuggler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrPoolClosed = errors.New("h2csmuggler: pool closed")
+)
+
+// PoolKey identifies the connections a Pool can share. Connections are only shared between
+// requests with the same scheme, host, port, mode and upgrade profile
+type PoolKey struct {
+	Scheme string
+	// Host is the lowercase host:port. The port is inferred from the scheme if not provided
+	Host string
+	Mode Mode
+	// Profile names the upgrade options used for the connection, e.g. the upgrade variant.
+	// Connections upgraded with different options are kept apart
+	Profile string
+}
+
+// NewPoolKey will return the key for target. ModeWebSocket can't be pooled, since websocket
+// tunnels only carry one request at a time
+func NewPoolKey(target string, mode Mode, profile string) (PoolKey, error) {
+	if mode == ModeWebSocket {
+		return PoolKey{}, errors.Wrap(ErrUnexpectedMode, "websocket tunnels can't be pooled")
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return PoolKey{}, errors.Wrap(err, "failed to parse target")
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return PoolKey{
+		Scheme:  strings.ToLower(u.Scheme),
+		Host:    net.JoinHostPort(strings.ToLower(u.Hostname()), port),
+		Mode:    mode,
+		Profile: profile,
+	}, nil
+}
+
+// URL returns the url connections for the key are created with
+func (k PoolKey) URL() string {
+	return fmt.Sprintf("%s://%s/", k.Scheme, k.Host)
+}
+
+// Pool hands out live h2c connections keyed by PoolKey. A connection is shared until it has as many
+// streams in flight as the server's SETTINGS_MAX_CONCURRENT_STREAMS allows, after which a new
+// connection is created. Connections are retired once they receive a GOAWAY, close, or fail to
+// initialize.
+// A new connection is handed to a single caller until it is returned, so that caller's request is
+// used to initialize it. Other callers for the same key wait for it rather than dialing their own.
+// If it fails to initialize, the waiting callers fail with its error at once rather than each
+// dialing the failing host in turn.
+// Pool is safe for concurrent use
+type Pool struct {
+	// MaxStreams caps the streams in flight on each connection. The server's limit always applies.
+	// If 0, only the server's limit is used
+	MaxStreams int
+
+	opts []ConnectionOption
+
+	mu     sync.Mutex
+	conns  map[PoolKey][]*poolConn
+	byConn map[*Conn]*poolConn
+	closed bool
+}
+
+type poolConn struct {
+	key     PoolKey
+	c       *Conn
+	streams int
+	settled chan struct{} // closed once the first caller returns the connection
+	err     error         // set before settled is closed if the connection failed to initialize
+}
+
+func (pc *poolConn) isSettled() bool {
+	select {
+	case <-pc.settled:
+		return true
+	default:
+		return false
+	}
+}
+
+// NewPool will return an empty pool. opts are applied to every connection it creates
+func NewPool(opts ...ConnectionOption) *Pool {
+	return &Pool{
+		opts:   opts,
+		conns:  map[PoolKey][]*poolConn{},
+		byConn: map[*Conn]*poolConn{},
+	}
+}
+
+// Get will return a connection for key with room for another stream. It must be returned with Put
+// once the caller is done with it, including reading the response body.
+// opts are applied after the pool's options if a new connection is created
+func (p *Pool) Get(ctx context.Context, key PoolKey, opts ...ConnectionOption) (*Conn, error) {
+	return p.GetStreams(ctx, key, 0, opts...)
+}
+
+// GetStreams is Get, only sharing a connection while it has fewer than maxStreams streams in
+// flight. This lets the caller bound the streams on each connection for a run, below the
+// pool's MaxStreams. If 0, only the pool's limit is used
+func (p *Pool) GetStreams(ctx context.Context, key PoolKey, maxStreams int, opts ...ConnectionOption) (*Conn, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+
+		var wait *poolConn
+		for _, pc := range p.prune(key) {
+			if !pc.isSettled() {
+				wait = pc
+				continue
+			}
+			if pc.streams < p.limit(pc.c, maxStreams) {
+				pc.streams++
+				p.mu.Unlock()
+				return pc.c, nil
+			}
+		}
+
+		if wait == nil {
+			c, err := p.newConn(key, opts...)
+			p.mu.Unlock()
+			return c, err
+		}
+		p.mu.Unlock()
+
+		select {
+		case <-wait.settled:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if wait.err != nil {
+			return nil, errors.Wrap(wait.err, "h2csmuggler: pooled connection failed to initialize")
+		}
+	}
+}
+
+// Put will return c to the pool. Connections which can no longer take streams are closed
+// once their last stream is returned
+func (p *Pool) Put(c *Conn) {
+	p.mu.Lock()
+	pc, ok := p.byConn[c]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	pc.streams--
+	if !pc.isSettled() {
+		pc.err = c.initError()
+		close(pc.settled)
+	}
+
+	retire := !c.usable()
+	if retire {
+		p.remove(pc)
+		if pc.streams == 0 {
+			delete(p.byConn, c)
+		}
+	}
+	p.mu.Unlock()
+
+	if retire && pc.streams == 0 {
+		c.Close()
+	}
+}
+
+// Close will close every connection in the pool. Connections which are in use are closed too,
+// which will fail their streams
+func (p *Pool) Close() {
+	p.mu.Lock()
+	conns := make([]*Conn, 0, len(p.byConn))
+	for c := range p.byConn {
+		conns = append(conns, c)
+	}
+	p.conns = map[PoolKey][]*poolConn{}
+	p.byConn = map[*Conn]*poolConn{}
+	p.closed = true
+	p.mu.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// prune will remove the retired connections for key, and return the rest
+func (p *Pool) prune(key PoolKey) []*poolConn {
+	live := p.conns[key][:0]
+	for _, pc := range p.conns[key] {
+		if pc.isSettled() && !pc.c.usable() {
+			if pc.streams == 0 {
+				delete(p.byConn, pc.c)
+				go pc.c.Close()
+			}
+			continue
+		}
+		live = append(live, pc)
+	}
+	p.conns[key] = live
+	return live
+}
+
+func (p *Pool) remove(pc *poolConn) {
+	conns := p.conns[pc.key]
+	for i, v := range conns {
+		if v == pc {
+			p.conns[pc.key] = append(conns[:i], conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// limit returns the number of streams which can be in flight on c. max further caps the limit
+// if it's above 0
+func (p *Pool) limit(c *Conn, max int) int {
+	n := c.maxConcurrentStreams()
+	if p.MaxStreams > 0 && p.MaxStreams < n {
+		n = p.MaxStreams
+	}
+	if max > 0 && max < n {
+		n = max
+	}
+	return n
+}
+
+func (p *Pool) newConn(key PoolKey, opts ...ConnectionOption) (*Conn, error) {
+	copts := make([]ConnectionOption, 0, len(p.opts)+len(opts)+1)
+	copts = append(copts, p.opts...)
+	copts = append(copts, opts...)
+	copts = append(copts, ConnectionMode(key.Mode))
+	c, err := NewConn(key.URL(), copts...)
+	if err != nil {
+		return nil, err
+	}
+
+	pc := &poolConn{
+		key:     key,
+		c:       c,
+		streams: 1,
+		settled: make(chan struct{}),
+	}
+	p.conns[key] = append(p.conns[key], pc)
+	p.byConn[c] = pc
+	return c, nil
+}
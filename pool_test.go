@@ -0,0 +1,218 @@
+package h2csmuggler
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewPoolKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		mode    Mode
+		want    PoolKey
+		wantErr bool
+	}{
+		{
+			name:   "http default port",
+			target: "http://Example.com/a",
+			want:   PoolKey{Scheme: "http", Host: "example.com:80"},
+		},
+		{
+			name:   "https default port",
+			target: "https://example.com/",
+			mode:   ModePriorKnowledge,
+			want:   PoolKey{Scheme: "https", Host: "example.com:443", Mode: ModePriorKnowledge},
+		},
+		{
+			name:   "explicit port",
+			target: "https://example.com:8443/b",
+			want:   PoolKey{Scheme: "https", Host: "example.com:8443"},
+		},
+		{
+			name:    "websocket",
+			target:  "http://example.com/",
+			mode:    ModeWebSocket,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewPoolKey(tt.target, tt.mode, "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewPoolKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("NewPoolKey() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// poolDo will perform a request to path on a pooled connection, returning the connection used.
+// This is safe to call from multiple goroutines
+func poolDo(t *testing.T, p *Pool, key PoolKey, path string) *Conn {
+	c, err := p.Get(context.Background(), key)
+	if err != nil {
+		t.Errorf("Pool.Get() error = %v", err)
+		return nil
+	}
+	defer p.Put(c)
+
+	req, err := http.NewRequest("GET", "http://"+key.Host+path, nil)
+	if err != nil {
+		t.Errorf("NewRequest() error = %v", err)
+		return nil
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		t.Errorf("Conn.Do() error = %v", err)
+		return nil
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	return c
+}
+
+func TestPool(t *testing.T) {
+	var upgrades int32
+	srv := newH2CServer(&upgrades)
+	defer srv.Close()
+
+	key, err := NewPoolKey(srv.URL, ModeUpgrade, "")
+	if err != nil {
+		t.Fatalf("NewPoolKey() error = %v", err)
+	}
+
+	t.Run("reuse", func(t *testing.T) {
+		atomic.StoreInt32(&upgrades, 0)
+		p := NewPool()
+		defer p.Close()
+
+		a := poolDo(t, p, key, "/a")
+		b := poolDo(t, p, key, "/b")
+		if a != b {
+			t.Errorf("Pool.Get() returned a new connection for the same key")
+		}
+
+		other := key
+		other.Profile = "other"
+		if c := poolDo(t, p, other, "/c"); c == a {
+			t.Errorf("Pool.Get() shared a connection between profiles")
+		}
+		if got := atomic.LoadInt32(&upgrades); got != 2 {
+			t.Errorf("upgrades = %d, want 2", got)
+		}
+	})
+
+	t.Run("concurrent callers wait for initialization", func(t *testing.T) {
+		atomic.StoreInt32(&upgrades, 0)
+		p := NewPool()
+		defer p.Close()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				poolDo(t, p, key, "/")
+			}()
+		}
+		wg.Wait()
+		if got := atomic.LoadInt32(&upgrades); got != 1 {
+			t.Errorf("upgrades = %d, want 1", got)
+		}
+	})
+
+	t.Run("failed initialization releases waiters", func(t *testing.T) {
+		// a backend which never responds, so every upgrade times out
+		silent, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen() error = %v", err)
+		}
+		defer silent.Close()
+		go func() {
+			for {
+				conn, err := silent.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+		key, err := NewPoolKey("http://"+silent.Addr().String(), ModeUpgrade, "")
+		if err != nil {
+			t.Fatalf("NewPoolKey() error = %v", err)
+		}
+
+		timeout := 300 * time.Millisecond
+		p := NewPool(ConnectionTimeouts(MaxTimeouts(timeout)))
+		defer p.Close()
+
+		start := time.Now()
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c, err := p.Get(context.Background(), key)
+				if err != nil {
+					return
+				}
+				defer p.Put(c)
+				req, _ := http.NewRequest("GET", key.URL(), nil)
+				if _, err := c.Do(req); err == nil {
+					t.Errorf("Conn.Do() error = nil, want an upgrade timeout")
+				}
+			}()
+		}
+		wg.Wait()
+		if elapsed := time.Since(start); elapsed > 3*timeout {
+			t.Errorf("callers took %v, want them released after the first upgrade times out", elapsed)
+		}
+	})
+
+	t.Run("max streams", func(t *testing.T) {
+		p := NewPool()
+		p.MaxStreams = 1
+		defer p.Close()
+
+		a := poolDo(t, p, key, "/a")
+		held, err := p.Get(context.Background(), key)
+		if err != nil {
+			t.Fatalf("Pool.Get() error = %v", err)
+		}
+		defer p.Put(held)
+		if held != a {
+			t.Fatalf("Pool.Get() returned a new connection with no streams in flight")
+		}
+		if c := poolDo(t, p, key, "/b"); c == held {
+			t.Errorf("Pool.Get() exceeded MaxStreams")
+		}
+	})
+
+	t.Run("retire closed", func(t *testing.T) {
+		p := NewPool()
+		defer p.Close()
+
+		a := poolDo(t, p, key, "/a")
+		a.Close()
+		if b := poolDo(t, p, key, "/b"); b == a {
+			t.Errorf("Pool.Get() returned a closed connection")
+		}
+	})
+
+	t.Run("closed pool", func(t *testing.T) {
+		p := NewPool()
+		p.Close()
+		if _, err := p.Get(context.Background(), key); err != ErrPoolClosed {
+			t.Errorf("Pool.Get() error = %v, want %v", err, ErrPoolClosed)
+		}
+	})
+}
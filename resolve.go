@@ -0,0 +1,59 @@
+package h2csmuggler
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// NewResolver will return a resolver which sends all lookups to the provided nameservers
+// Nameservers will be used round robin. If no port is provided, 53 will be used.
+// If no nameservers are provided, the system resolver is returned
+func NewResolver(nameservers []string) *net.Resolver {
+	if len(nameservers) == 0 {
+		return net.DefaultResolver
+	}
+
+	servers := make([]string, 0, len(nameservers))
+	for _, ns := range nameservers {
+		if _, _, err := net.SplitHostPort(ns); err != nil {
+			ns = net.JoinHostPort(strings.Trim(ns, "[]"), "53")
+		}
+		servers = append(servers, ns)
+	}
+
+	var next uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{
+				Timeout: time.Millisecond * time.Duration(5000),
+			}
+			ns := servers[int(atomic.AddUint32(&next, 1)-1)%len(servers)]
+			return d.DialContext(ctx, network, ns)
+		},
+	}
+}
+
+// ParseResolveOverrides will parse curl style --resolve entries of host:port:addr
+// into a map of host:port -> addr:port. IPv6 addresses may be wrapped in brackets
+// e.g. example.com:443:127.0.0.1 or example.com:443:[::1]
+func ParseResolveOverrides(entries []string) (map[string]string, error) {
+	ret := make(map[string]string, len(entries))
+	for _, e := range entries {
+		v := strings.SplitN(e, ":", 3)
+		if len(v) != 3 || v[0] == "" || v[1] == "" || v[2] == "" {
+			return nil, errors.Errorf("invalid resolve entry %q: expected host:port:addr", e)
+		}
+		host, port, addr := v[0], v[1], strings.Trim(v[2], "[]")
+		if net.ParseIP(addr) == nil {
+			return nil, errors.Errorf("invalid resolve entry %q: %q is not an ip address", e, addr)
+		}
+		ret[net.JoinHostPort(host, port)] = net.JoinHostPort(addr, port)
+	}
+	return ret, nil
+}
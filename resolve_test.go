@@ -0,0 +1,32 @@
+package h2csmuggler
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseResolveOverrides(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "ipv4", entries: []string{"example.com:443:127.0.0.1"}, want: map[string]string{"example.com:443": "127.0.0.1:443"}},
+		{name: "ipv6", entries: []string{"example.com:80:[::1]"}, want: map[string]string{"example.com:80": "[::1]:80"}},
+		{name: "missing addr", entries: []string{"example.com:443"}, wantErr: true},
+		{name: "hostname addr", entries: []string{"example.com:443:other.com"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseResolveOverrides(tt.entries)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseResolveOverrides() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseResolveOverrides() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
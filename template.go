@@ -0,0 +1,53 @@
+package h2csmuggler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// UpgradeTemplate is a raw HTTP/1.1 upgrade request. This is written to the connection
+// verbatim, allowing for header casing, ordering and whitespace that net/http would normalize.
+// The following placeholders are replaced when rendered:
+// {{method}}   the request method e.g. GET
+// {{host}}     the request host e.g. example.com
+// {{path}}     the request uri e.g. /foo?bar
+// {{settings}} the HTTP2-Settings value
+// All LF line endings are converted to CRLF so templates can be written in a normal text editor,
+// and any trailing line breaks are replaced with the single blank line which ends the headers.
+type UpgradeTemplate []byte
+
+// LoadUpgradeTemplate will read the upgrade template from the file
+func LoadUpgradeTemplate(filename string) (UpgradeTemplate, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read upgrade template")
+	}
+	if len(raw) == 0 {
+		return nil, errors.New("upgrade template is empty")
+	}
+	return UpgradeTemplate(raw), nil
+}
+
+// Render will return the raw upgrade request for req
+func (t UpgradeTemplate) Render(req *http.Request, settings string) []byte {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	r := strings.NewReplacer(
+		"{{method}}", req.Method,
+		"{{host}}", host,
+		"{{path}}", req.URL.RequestURI(),
+		"{{settings}}", settings,
+	)
+	raw := []byte(r.Replace(string(t)))
+	raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	raw = bytes.TrimRight(raw, "\n")
+	raw = bytes.ReplaceAll(raw, []byte("\n"), []byte("\r\n"))
+	return append(raw, "\r\n\r\n"...)
+}
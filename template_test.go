@@ -0,0 +1,57 @@
+package h2csmuggler
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestUpgradeTemplate_Render(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://example.com/foo?bar=1", nil)
+	if err != nil {
+		t.Fatalf("NewRequest() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		t    UpgradeTemplate
+		want string
+	}{
+		{
+			name: "lf converted",
+			t:    UpgradeTemplate("{{method}} {{path}} HTTP/1.1\nhost: {{host}}\nupgrade :h2c\nHTTP2-Settings: {{settings}}\n\n"),
+			want: "GET /foo?bar=1 HTTP/1.1\r\nhost: example.com\r\nupgrade :h2c\r\nHTTP2-Settings: AAAA\r\n\r\n",
+		},
+		{
+			name: "crlf verbatim",
+			t:    UpgradeTemplate("GET http://{{host}}{{path}} HTTP/1.1\r\nUpgrade:\th2c\r\nConnection: Upgrade\r\n\r\n"),
+			want: "GET http://example.com/foo?bar=1 HTTP/1.1\r\nUpgrade:\th2c\r\nConnection: Upgrade\r\n\r\n",
+		},
+		{
+			name: "mixed line endings",
+			t:    UpgradeTemplate("GET {{path}} HTTP/1.1\r\nUpgrade:\th2c\nConnection: Upgrade\r\n\r\n"),
+			want: "GET /foo?bar=1 HTTP/1.1\r\nUpgrade:\th2c\r\nConnection: Upgrade\r\n\r\n",
+		},
+		{
+			name: "single trailing newline",
+			t:    UpgradeTemplate("GET {{path}} HTTP/1.1\nHost: {{host}}\n"),
+			want: "GET /foo?bar=1 HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		},
+		{
+			name: "no trailing newline",
+			t:    UpgradeTemplate("GET {{path}} HTTP/1.1\r\nHost: {{host}}"),
+			want: "GET /foo?bar=1 HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		},
+		{
+			name: "extra trailing newlines",
+			t:    UpgradeTemplate("GET {{path}} HTTP/1.1\r\nHost: {{host}}\r\n\r\n\n\r\n"),
+			want: "GET /foo?bar=1 HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(tt.t.Render(req, "AAAA")); got != tt.want {
+				t.Errorf("UpgradeTemplate.Render() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
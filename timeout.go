@@ -0,0 +1,161 @@
+package h2csmuggler
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Timeouts control the deadline of each phase of a connection.
+// A zero value for a phase disables its deadline
+type Timeouts struct {
+	// Dial is the maximum time to establish the tcp connection, including any proxy tunnel
+	Dial time.Duration
+	// TLSHandshake is the maximum time to complete the tls handshake with the target
+	TLSHandshake time.Duration
+	// Upgrade is the maximum time to send the upgrade request and receive the upgrade response
+	Upgrade time.Duration
+	// ResponseHeader is the maximum time to wait for each smuggled stream's response headers,
+	// including the first stream, which is timed from the upgrade response
+	ResponseHeader time.Duration
+	// ResponseBody is the maximum time to read each smuggled stream's response body
+	ResponseBody time.Duration
+}
+
+var (
+	DefaultTimeouts = Timeouts{
+		Dial:           time.Millisecond * time.Duration(5000),
+		TLSHandshake:   time.Millisecond * time.Duration(5000),
+		Upgrade:        time.Millisecond * time.Duration(10000),
+		ResponseHeader: time.Millisecond * time.Duration(10000),
+		ResponseBody:   time.Millisecond * time.Duration(10000),
+	}
+
+	ErrUpgradeTimeout        = errors.New("h2csmuggler: timeout awaiting upgrade response")
+	ErrResponseHeaderTimeout = errors.New("h2csmuggler: timeout awaiting response headers")
+	ErrResponseBodyTimeout   = errors.New("h2csmuggler: timeout reading response body")
+)
+
+// MaxTimeouts will return timeouts with every phase set to d. This mirrors
+// the --max-time socket timeout of h2csmuggler.py
+func MaxTimeouts(d time.Duration) Timeouts {
+	return Timeouts{
+		Dial:           d,
+		TLSHandshake:   d,
+		Upgrade:        d,
+		ResponseHeader: d,
+		ResponseBody:   d,
+	}
+}
+
+// aLongTimeAgo is a deadline in the past, used to interrupt blocking io
+var aLongTimeAgo = time.Unix(1, 0)
+
+// interruptAfter will set the deadline of conn to the timeout. If ctx is done before stop is
+// called, including by its own deadline, any blocking io on conn will be interrupted. The ctx
+// deadline isn't copied onto conn, so ctx.Err is always set by the time its io fails.
+// stop will clear the deadline and must be called once the phase completes
+func interruptAfter(ctx context.Context, conn net.Conn, timeout time.Duration) (stop func()) {
+	return newInterrupter(ctx, conn, timeout).stop
+}
+
+// interrupter is interruptAfter for io spanning several phases, each with its own timeout
+type interrupter struct {
+	conn  net.Conn
+	stopc chan struct{}
+	done  chan struct{}
+	once  sync.Once
+
+	mu          sync.Mutex
+	interrupted bool
+}
+
+// newInterrupter will set the deadline of conn to the timeout of the first phase. See interruptAfter
+func newInterrupter(ctx context.Context, conn net.Conn, timeout time.Duration) *interrupter {
+	i := &interrupter{
+		conn:  conn,
+		stopc: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	i.next(timeout)
+	go func() {
+		defer close(i.done)
+		select {
+		case <-ctx.Done():
+			i.mu.Lock()
+			i.interrupted = true
+			conn.SetDeadline(aLongTimeAgo)
+			i.mu.Unlock()
+		case <-i.stopc:
+		}
+	}()
+	return i
+}
+
+// next will replace the deadline of conn with the timeout of the next phase, unless ctx has
+// already interrupted it
+func (i *interrupter) next(timeout time.Duration) {
+	var deadline time.Time
+	if timeout != 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if !i.interrupted {
+		i.conn.SetDeadline(deadline)
+	}
+}
+
+// stop will clear the deadline and must be called once the last phase completes
+func (i *interrupter) stop() {
+	i.once.Do(func() {
+		close(i.stopc)
+		<-i.done
+		i.conn.SetDeadline(time.Time{})
+	})
+}
+
+// timeoutBody will cancel the stream if the body isn't read within the timeout.
+// cancel will always be called when the body is closed to release the stream context
+type timeoutBody struct {
+	io.ReadCloser
+	cancel   context.CancelFunc
+	timer    *time.Timer
+	timedOut int32
+}
+
+func newTimeoutBody(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *timeoutBody {
+	b := &timeoutBody{
+		ReadCloser: body,
+		cancel:     cancel,
+	}
+	if timeout != 0 {
+		b.timer = time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&b.timedOut, 1)
+			cancel()
+		})
+	}
+	return b
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && atomic.LoadInt32(&b.timedOut) == 1 {
+		return n, ErrResponseBodyTimeout
+	}
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
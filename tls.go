@@ -0,0 +1,62 @@
+package h2csmuggler
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// DefaultTLSConfig is used when no tls config is provided. Certificates are not
+	// verified since we're typically talking to edges with mismatched certificates
+	DefaultTLSConfig = &tls.Config{
+		InsecureSkipVerify: true,
+	}
+
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+)
+
+// ParseTLSVersion will parse a tls version in the form 1.0, 1.1, 1.2 or 1.3
+func ParseTLSVersion(s string) (uint16, error) {
+	v, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(s), "tls")]
+	if !ok {
+		return 0, errors.Errorf("unknown tls version %q", s)
+	}
+	return v, nil
+}
+
+// TLSVersionName will return the name of the tls version e.g. TLS 1.2
+func TLSVersionName(v uint16) string {
+	for name, version := range tlsVersions {
+		if version == v {
+			return "TLS " + name
+		}
+	}
+	return fmt.Sprintf("0x%04X", v)
+}
+
+// ParseCipherSuites will parse the IANA names of cipher suites, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+// insecure cipher suites are accepted, since we may need them to talk to old edges
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	known := map[string]uint16{}
+	for _, c := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[c.Name] = c.ID
+	}
+
+	ret := make([]uint16, 0, len(names))
+	for _, n := range names {
+		id, ok := known[strings.ToUpper(n)]
+		if !ok {
+			return nil, errors.Errorf("unknown cipher suite %q", n)
+		}
+		ret = append(ret, id)
+	}
+	return ret, nil
+}
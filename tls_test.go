@@ -0,0 +1,31 @@
+package h2csmuggler
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    uint16
+		wantErr bool
+	}{
+		{name: "short", input: "1.2", want: tls.VersionTLS12},
+		{name: "prefixed", input: "TLS1.3", want: tls.VersionTLS13},
+		{name: "unknown", input: "2.0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTLSVersion(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseTLSVersion() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParseTLSVersion() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
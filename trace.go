@@ -0,0 +1,218 @@
+package h2csmuggler
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConnTiming is the timing breakdown of a Conn. Each duration covers a single phase so slow hops
+// in a proxy chain stand out. Phases which weren't reached or don't apply, e.g. DNS when dialing an ip, are zero
+type ConnTiming struct {
+	// Start is when the connection was dialed
+	Start time.Time `json:"start"`
+	// DNS is the time to resolve the target, or the proxy if one is used
+	DNS time.Duration `json:"dns"`
+	// Connect is the time to establish the tcp connection to the target, or the proxy if one is used
+	Connect time.Duration `json:"connect"`
+	// TLSHandshake is the time to complete the tls handshake with the target
+	TLSHandshake time.Duration `json:"tls-handshake"`
+	// Dial is the total time to establish the connection, including the phases above and any proxy tunnel
+	Dial time.Duration `json:"dial"`
+	// UpgradeWrite is the time to write the upgrade request
+	UpgradeWrite time.Duration `json:"upgrade-write"`
+	// Upgrade is the time from writing the upgrade request to reading its response
+	Upgrade time.Duration `json:"upgrade"`
+	// Settings is the time from the 101, or the connection in ModePriorKnowledge, to reading the server's SETTINGS
+	Settings time.Duration `json:"settings"`
+}
+
+// StreamTiming is the timing breakdown of a single stream. Each duration is measured from Start.
+// The first stream in ModeUpgrade is the upgrade request, so it's written as HTTP/1.1.
+// See WithStreamTiming
+type StreamTiming struct {
+	URL   string    `json:"url"`
+	Start time.Time `json:"start"`
+	// WroteRequest is when the request was completely written
+	WroteRequest time.Duration `json:"wrote-request"`
+	// FirstByte is when the first byte of the response headers was read
+	FirstByte time.Duration `json:"first-byte"`
+}
+
+// String returns a compact summary of the timings, for text output
+func (t ConnTiming) String() string {
+	phases := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"dns", t.DNS},
+		{"connect", t.Connect},
+		{"tls", t.TLSHandshake},
+		{"dial", t.Dial},
+		{"upgrade-write", t.UpgradeWrite},
+		{"upgrade", t.Upgrade},
+		{"settings", t.Settings},
+	}
+	s := []string{}
+	for _, p := range phases {
+		if p.d != 0 {
+			s = append(s, fmt.Sprintf("%s=%v", p.name, p.d))
+		}
+	}
+	return strings.Join(s, " ")
+}
+
+// String returns a compact summary of the timings, for text output
+func (t StreamTiming) String() string {
+	return fmt.Sprintf("wrote=%v ttfb=%v", t.WroteRequest, t.FirstByte)
+}
+
+type streamTimingKey struct{}
+
+// WithStreamTiming returns a copy of ctx which will call f with the timing of the stream its
+// request is sent on. f is called once the response headers are read or the request fails.
+// Connections don't keep the timing of their streams, so this is how it's read
+func WithStreamTiming(ctx context.Context, f func(StreamTiming)) context.Context {
+	return context.WithValue(ctx, streamTimingKey{}, f)
+}
+
+// reportStream will call the WithStreamTiming hook of ctx, if any, with the timing of t
+func reportStream(ctx context.Context, t StreamTiming) {
+	if f, ok := ctx.Value(streamTimingKey{}).(func(StreamTiming)); ok {
+		f(t)
+	}
+}
+
+// connTimer records the ConnTiming of a Conn from httptrace hooks
+type connTimer struct {
+	mu sync.Mutex
+	t  ConnTiming
+
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	upgradeStart time.Time
+	upgradeWrote time.Time
+	settingsFrom time.Time // the time the server's SETTINGS are measured from
+}
+
+// dialStart resets the connection phases for a new dial attempt
+func (ct *connTimer) dialStart() {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.t = ConnTiming{Start: time.Now()}
+}
+
+func (ct *connTimer) dialDone() {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.t.Dial = time.Since(ct.t.Start)
+	ct.settingsFrom = time.Now()
+}
+
+func (ct *connTimer) startUpgrade() {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.upgradeStart = time.Now()
+}
+
+// dialTrace records the dns, connect and tls phases
+func (ct *connTimer) dialTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			ct.mark(&ct.dnsStart)
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			ct.since(&ct.t.DNS, &ct.dnsStart)
+		},
+		ConnectStart: func(network, addr string) {
+			ct.mark(&ct.connectStart)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			ct.since(&ct.t.Connect, &ct.connectStart)
+		},
+		TLSHandshakeStart: func() {
+			ct.mark(&ct.tlsStart)
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			ct.since(&ct.t.TLSHandshake, &ct.tlsStart)
+		},
+	}
+}
+
+// upgradeTrace records the upgrade phases
+func (ct *connTimer) upgradeTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			ct.mu.Lock()
+			defer ct.mu.Unlock()
+			ct.upgradeWrote = time.Now()
+			ct.t.UpgradeWrite = ct.upgradeWrote.Sub(ct.upgradeStart)
+		},
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			ct.mu.Lock()
+			defer ct.mu.Unlock()
+			ct.settingsFrom = time.Now()
+			ct.t.Upgrade = ct.settingsFrom.Sub(ct.upgradeWrote)
+			return nil
+		},
+	}
+}
+
+// streamTrace records a new stream. The returned timing should be read with stream
+func (ct *connTimer) streamTrace(url string) (*httptrace.ClientTrace, *StreamTiming) {
+	st := &StreamTiming{
+		URL:   url,
+		Start: time.Now(),
+	}
+	return &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			ct.mu.Lock()
+			defer ct.mu.Unlock()
+			st.WroteRequest = time.Since(st.Start)
+		},
+		GotFirstResponseByte: func() {
+			ct.mu.Lock()
+			defer ct.mu.Unlock()
+			st.FirstByte = time.Since(st.Start)
+		},
+	}, st
+}
+
+// stream returns a copy of st
+func (ct *connTimer) stream(st *StreamTiming) StreamTiming {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return *st
+}
+
+// timing returns a copy of the connection timings. settings is when the server's SETTINGS were read, if known
+func (ct *connTimer) timing(settings time.Time) ConnTiming {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	t := ct.t
+	if !settings.IsZero() && !ct.settingsFrom.IsZero() {
+		t.Settings = settings.Sub(ct.settingsFrom)
+	}
+	return t
+}
+
+func (ct *connTimer) mark(t *time.Time) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	*t = time.Now()
+}
+
+func (ct *connTimer) since(d *time.Duration, t *time.Time) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if !t.IsZero() {
+		*d = time.Since(*t)
+	}
+}
@@ -0,0 +1,71 @@
+package h2csmuggler
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestConn_Timing(t *testing.T) {
+	var upgrades int32
+	srv := newH2CServer(&upgrades)
+	defer srv.Close()
+
+	tests := []struct {
+		name        string
+		mode        Mode
+		wantUpgrade bool
+	}{
+		{name: "upgrade", mode: ModeUpgrade, wantUpgrade: true},
+		{name: "prior knowledge", mode: ModePriorKnowledge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewConn(srv.URL, ConnectionMode(tt.mode))
+			if err != nil {
+				t.Fatalf("NewConn() error = %v", err)
+			}
+			defer c.Close()
+
+			streams := []StreamTiming{}
+			for _, path := range []string{"/a", "/b"} {
+				ctx := WithStreamTiming(context.Background(), func(st StreamTiming) {
+					streams = append(streams, st)
+				})
+				req, err := http.NewRequestWithContext(ctx, "GET", srv.URL+path, nil)
+				if err != nil {
+					t.Fatalf("NewRequest() error = %v", err)
+				}
+				res, err := c.Do(req)
+				if err != nil {
+					t.Fatalf("Conn.Do() error = %v", err)
+				}
+				ioutil.ReadAll(res.Body)
+				res.Body.Close()
+			}
+
+			got := c.Timing()
+			if got.Start.IsZero() || got.Connect == 0 || got.Dial < got.Connect {
+				t.Errorf("Conn.Timing() dial phases = %+v", got)
+			}
+			if (got.Upgrade != 0) != tt.wantUpgrade || (got.UpgradeWrite != 0) != tt.wantUpgrade {
+				t.Errorf("Conn.Timing() upgrade phases = %v, %v, want upgrade %v", got.UpgradeWrite, got.Upgrade, tt.wantUpgrade)
+			}
+			if got.Settings == 0 {
+				t.Errorf("Conn.Timing().Settings = 0")
+			}
+			if len(streams) != 2 {
+				t.Fatalf("WithStreamTiming() streams = %+v, want 2 streams", streams)
+			}
+			for i, st := range streams {
+				if want := srv.URL + []string{"/a", "/b"}[i]; st.URL != want {
+					t.Errorf("streams[%d].URL = %v, want %v", i, st.URL, want)
+				}
+				if st.FirstByte == 0 || st.FirstByte < st.WroteRequest {
+					t.Errorf("streams[%d] = %+v", i, st)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package h2csmuggler
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// UpgradeVariant is a named set of raw upgrade header lines. Variants are used to enumerate which
+// combinations of the Connection, Upgrade and HTTP2-Settings headers an edge will forward.
+// Header lines are written verbatim, and support the {{settings}} placeholder
+type UpgradeVariant struct {
+	Name    string   `mapstructure:"name"`
+	Headers []string `mapstructure:"headers"`
+}
+
+// Option returns the upgrade option which applies this variant
+func (v UpgradeVariant) Option() UpgradeOption {
+	return SetUpgradeHeaders(v.Headers)
+}
+
+// DefaultUpgradeVariant is the combination sent when no variant is chosen
+const DefaultUpgradeVariant = "default"
+
+// DefaultUpgradeVariants is the built-in matrix of header variants
+var DefaultUpgradeVariants = []UpgradeVariant{
+	{Name: DefaultUpgradeVariant, Headers: []string{
+		"Upgrade: h2c",
+		"HTTP2-Settings: {{settings}}",
+		"Connection: Upgrade, HTTP2-Settings",
+	}},
+	{Name: "upgrade-only", Headers: []string{
+		"Upgrade: h2c",
+		"HTTP2-Settings: {{settings}}",
+		"Connection: Upgrade",
+	}},
+	{Name: "settings-omitted", Headers: []string{
+		"Upgrade: h2c",
+		"Connection: Upgrade",
+	}},
+	{Name: "lowercase", Headers: []string{
+		"upgrade: h2c",
+		"http2-settings: {{settings}}",
+		"connection: upgrade, http2-settings",
+	}},
+	{Name: "uppercase", Headers: []string{
+		"UPGRADE: h2c",
+		"HTTP2-SETTINGS: {{settings}}",
+		"CONNECTION: UPGRADE, HTTP2-SETTINGS",
+	}},
+	{Name: "reversed-tokens", Headers: []string{
+		"Upgrade: h2c",
+		"HTTP2-Settings: {{settings}}",
+		"Connection: HTTP2-Settings, Upgrade",
+	}},
+	{Name: "keep-alive-tokens", Headers: []string{
+		"Upgrade: h2c",
+		"HTTP2-Settings: {{settings}}",
+		"Connection: keep-alive, Upgrade, HTTP2-Settings",
+	}},
+	{Name: "duplicate-connection", Headers: []string{
+		"Upgrade: h2c",
+		"HTTP2-Settings: {{settings}}",
+		"Connection: Upgrade",
+		"Connection: HTTP2-Settings",
+	}},
+	{Name: "duplicate-upgrade", Headers: []string{
+		"Upgrade: h2c",
+		"Upgrade: h2c",
+		"HTTP2-Settings: {{settings}}",
+		"Connection: Upgrade, HTTP2-Settings",
+	}},
+}
+
+// FindUpgradeVariants will return the variants with the given names, in the order of names.
+// "all" will return every variant
+func FindUpgradeVariants(variants []UpgradeVariant, names []string) ([]UpgradeVariant, error) {
+	byName := make(map[string]UpgradeVariant, len(variants))
+	for _, v := range variants {
+		byName[v.Name] = v
+	}
+
+	ret := make([]UpgradeVariant, 0, len(names))
+	for _, n := range names {
+		if n == "all" {
+			return variants, nil
+		}
+		v, ok := byName[n]
+		if !ok {
+			return nil, errors.Errorf("unknown upgrade variant %q", n)
+		}
+		ret = append(ret, v)
+	}
+	return ret, nil
+}
+
+// renderUpgradeHeaders will dump the request without any upgrade headers, and then add the raw
+// header lines verbatim
+func renderUpgradeHeaders(req *http.Request, lines []string, settings string) ([]byte, error) {
+	req = req.Clone(req.Context())
+	req.Header.Del("Upgrade")
+	req.Header.Del("Connection")
+	req.Header.Del("HTTP2-Settings")
+
+	dump, err := httputil.DumpRequestOut(req, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to dump http body")
+	}
+
+	end := bytes.Index(dump, []byte("\r\n\r\n"))
+	if end == -1 {
+		return nil, errors.New("failed to find end of headers")
+	}
+
+	var raw bytes.Buffer
+	raw.Write(dump[:end+2])
+	for _, l := range lines {
+		raw.WriteString(strings.Replace(l, "{{settings}}", settings, -1))
+		raw.WriteString("\r\n")
+	}
+	raw.Write(dump[end+2:])
+	return raw.Bytes(), nil
+}
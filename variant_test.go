@@ -0,0 +1,66 @@
+package h2csmuggler
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestFindUpgradeVariants(t *testing.T) {
+	variants := []UpgradeVariant{
+		{Name: "a"},
+		{Name: "b"},
+		{Name: "c"},
+	}
+
+	tests := []struct {
+		name    string
+		names   []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "ordered", names: []string{"c", "a"}, want: []string{"c", "a"}},
+		{name: "all", names: []string{"b", "all"}, want: []string{"a", "b", "c"}},
+		{name: "unknown", names: []string{"a", "d"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FindUpgradeVariants(variants, tt.names)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FindUpgradeVariants() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			names := []string{}
+			for _, v := range got {
+				names = append(names, v.Name)
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("FindUpgradeVariants() = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderUpgradeHeaders(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://example.com/foo", nil)
+	if err != nil {
+		t.Fatalf("NewRequest() error = %v", err)
+	}
+	req.Header.Add("Upgrade", "h2c")
+	req.Header.Add("X-Foo", "bar")
+
+	got, err := renderUpgradeHeaders(req, []string{"upgrade: h2c", "upgrade: h2c", "HTTP2-Settings: {{settings}}"}, "AAAA")
+	if err != nil {
+		t.Fatalf("renderUpgradeHeaders() error = %v", err)
+	}
+	want := "GET /foo HTTP/1.1\r\nHost: example.com\r\nUser-Agent: Go-http-client/1.1\r\nX-Foo: bar\r\nAccept-Encoding: gzip\r\n" +
+		"upgrade: h2c\r\nupgrade: h2c\r\nHTTP2-Settings: AAAA\r\n\r\n"
+	if string(got) != want {
+		t.Errorf("renderUpgradeHeaders() = %q, want %q", got, want)
+	}
+	if req.Header.Get("Upgrade") != "h2c" {
+		t.Errorf("renderUpgradeHeaders() modified the request headers")
+	}
+}
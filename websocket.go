@@ -0,0 +1,372 @@
+package h2csmuggler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/minight/h2csmuggler/http2"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	DefaultWebSocketVersion = "13"
+
+	// InvalidWebSocketVersion will be refused by the backend. Proxies which don't check the
+	// response to the upgrade will still keep the connection open as a tunnel
+	InvalidWebSocketVersion = "1337"
+)
+
+// WebSocketOption provides manipulation of the websocket upgrade request
+type WebSocketOption func(o *WebSocketOptions)
+
+// WebSocketOptions control the headers sent in the websocket upgrade request
+type WebSocketOptions struct {
+	// Version is the Sec-WebSocket-Version header. See InvalidWebSocketVersion
+	Version string
+
+	// Key is the Sec-WebSocket-Key header. If empty, a random key is used
+	Key string
+
+	// AllowRefused will keep the tunnel open when the upgrade is answered with any status other
+	// than 101, instead of failing with http2.UnexpectedStatusCodeError
+	AllowRefused bool
+}
+
+func SetWebSocketVersion(v string) WebSocketOption {
+	return func(o *WebSocketOptions) {
+		o.Version = v
+	}
+}
+
+func SetWebSocketKey(k string) WebSocketOption {
+	return func(o *WebSocketOptions) {
+		o.Key = k
+	}
+}
+
+// AllowRefusedWebSocketUpgrade will use the tunnel even when the upgrade is refused.
+// See WebSocketOptions.AllowRefused
+func AllowRefusedWebSocketUpgrade() WebSocketOption {
+	return func(o *WebSocketOptions) {
+		o.AllowRefused = true
+	}
+}
+
+// WebSocketConn is a HTTP/1.1 tunnel established with Upgrade: websocket. Proxies which allow
+// websocket upgrades will often relay the connection verbatim once the upgrade is sent, letting us
+// send HTTP/1.1 requests directly to the backend.
+// The upgrade must be answered with 101 unless AllowRefusedWebSocketUpgrade is used. A refused
+// upgrade with the connection still open is often the interesting case, and should be compared
+// against a request sent without the tunnel.
+// WebSocketConn is safe for concurrent use, but requests are sent one at a time. Use Pipeline to
+// send many requests at once
+type WebSocketConn struct {
+	c *Conn // used for the connection options and dialing
+
+	mu sync.Mutex // serializes use of the tunnel
+
+	conn    net.Conn
+	br      *bufio.Reader
+	upgrade *http2.UpgradeResponse
+	init    bool
+	initmu  sync.RWMutex
+}
+
+// NewWebSocketConn will return an unitialized websocket tunnel. All ConnectionOptions
+// apply, except for ConnectionMode and ConnectionUpgradeOptions.
+// The first Do will perform the upgrade with a GET request to the target
+func NewWebSocketConn(target string, opts ...ConnectionOption) (*WebSocketConn, error) {
+	c, err := NewConn(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &WebSocketConn{c: c}, nil
+}
+
+// Initialized will return whether the tunnel has been upgraded already
+func (w *WebSocketConn) Initialized() bool {
+	w.initmu.RLock()
+	defer w.initmu.RUnlock()
+	return w.init
+}
+
+// ConnectionState returns the negotiated tls details of the tunnel. nil is returned for http targets
+func (w *WebSocketConn) ConnectionState() *tls.ConnectionState {
+	return w.c.ConnectionState()
+}
+
+// Timing returns the timing breakdown of the tunnel. See ConnTiming and WithStreamTiming for the
+// timing of each request sent through it
+func (w *WebSocketConn) Timing() ConnTiming {
+	return w.c.Timing()
+}
+
+// UpgradeResponse returns the raw response to the websocket upgrade request
+func (w *WebSocketConn) UpgradeResponse() *http2.UpgradeResponse {
+	w.initmu.RLock()
+	defer w.initmu.RUnlock()
+	return w.upgrade
+}
+
+func (w *WebSocketConn) Close() {
+	w.initmu.RLock()
+	conn := w.conn
+	w.initmu.RUnlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// UpgradeContext will dial the target and send req as the websocket upgrade request.
+// Any status other than 101 fails with http2.UnexpectedStatusCodeError, unless the upgrade is
+// allowed to be refused, since proxies may keep the tunnel open even when the backend refuses it.
+// UpgradeResponse will return the response in either case
+func (w *WebSocketConn) UpgradeContext(ctx context.Context, req *http.Request, opts ...WebSocketOption) (*http2.UpgradeResponse, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.upgradeLocked(ctx, req, opts...)
+}
+
+func (w *WebSocketConn) upgradeLocked(ctx context.Context, req *http.Request, opts ...WebSocketOption) (*http2.UpgradeResponse, error) {
+	if w.Initialized() {
+		return nil, ErrAlreadyInitialized
+	}
+
+	o := &WebSocketOptions{
+		Version: DefaultWebSocketVersion,
+	}
+	for _, opt := range w.c.wsOpts {
+		opt(o)
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.Key == "" {
+		key := make([]byte, 16)
+		if _, err := rand.Read(key); err != nil {
+			return nil, errors.Wrap(err, "failed to generate websocket key")
+		}
+		o.Key = base64.StdEncoding.EncodeToString(key)
+	}
+
+	req = req.Clone(ctx)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", o.Version)
+	req.Header.Set("Sec-WebSocket-Key", o.Key)
+
+	log.WithFields(log.Fields{
+		"headers": req.Header,
+	}).Tracef("performing websocket upgrade request")
+
+	conn, err := w.c.dial(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "h2csmuggler: connection failed")
+	}
+
+	br := bufio.NewReader(conn)
+	trace := w.c.timer.upgradeTrace()
+	w.c.timer.startUpgrade()
+	stop := interruptAfter(ctx, conn, w.c.timeouts.Upgrade)
+	var raw bytes.Buffer
+	sent := time.Now()
+	err = req.Write(&raw)
+	if err == nil {
+		_, err = conn.Write(raw.Bytes())
+	}
+	trace.WroteRequest(httptrace.WroteRequestInfo{Err: err})
+	var upgrade *http2.UpgradeResponse
+	if err == nil {
+		upgrade, err = http2.ReadUpgradeResponse(br, sent)
+	}
+	stop()
+	if upgrade != nil && w.c.har != nil {
+		e := newUpgradeHAREntry(req, raw.Bytes(), upgrade, w.c.timer.timing(time.Time{}))
+		setHARConn(&e, conn)
+		w.c.har.Add(e)
+	}
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			return nil, ErrUpgradeTimeout
+		}
+		return nil, errors.Wrap(err, "h2csmuggler: websocket upgrade failed")
+	}
+
+	if upgrade.StatusCode >= 100 && upgrade.StatusCode < 200 {
+		trace.Got1xxResponse(upgrade.StatusCode, nil)
+	}
+	log.WithFields(log.Fields{
+		"status":  upgrade.StatusCode,
+		"headers": upgrade.Headers,
+	}).Tracef("websocket upgrade complete")
+
+	if upgrade.StatusCode != http.StatusSwitchingProtocols && !o.AllowRefused {
+		conn.Close()
+		w.initmu.Lock()
+		w.upgrade = upgrade
+		w.initmu.Unlock()
+		return nil, errors.Wrap(http2.UnexpectedStatusCodeError{Code: upgrade.StatusCode, Response: upgrade}, "h2csmuggler: websocket upgrade refused")
+	}
+
+	w.initmu.Lock()
+	w.conn = conn
+	w.br = br
+	w.upgrade = upgrade
+	w.init = true
+	w.initmu.Unlock()
+	return upgrade, nil
+}
+
+// Do will send the request through the tunnel, upgrading it first if needed
+func (w *WebSocketConn) Do(req *http.Request) (*http.Response, error) {
+	return w.DoContext(req.Context(), req)
+}
+
+// DoContext is Do with a context
+func (w *WebSocketConn) DoContext(ctx context.Context, req *http.Request) (*http.Response, error) {
+	res, err := w.Pipeline(ctx, []*http.Request{req})
+	if err != nil {
+		return nil, err
+	}
+	return res[0], nil
+}
+
+// Pipeline will write all of the requests through the tunnel at once, and then read each response
+// in order. The tunnel is upgraded first if needed. Response bodies are read in full before the next
+// response, and are returned as in memory readers.
+// If a response fails, the responses read so far are returned with the error and the tunnel is closed
+func (w *WebSocketConn) Pipeline(ctx context.Context, reqs []*http.Request) ([]*http.Response, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	begin := time.Now()
+	if !w.Initialized() {
+		req, err := http.NewRequestWithContext(ctx, "GET", w.c.url.String(), nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "request creation")
+		}
+		if _, err := w.upgradeLocked(ctx, req); err != nil {
+			w.recordErrors(nil, reqs, err, begin, 0)
+			return nil, err
+		}
+	}
+
+	w.initmu.RLock()
+	conn, br := w.conn, w.br
+	w.initmu.RUnlock()
+
+	var buf bytes.Buffer
+	if w.c.har != nil {
+		sent := make([]*http.Request, len(reqs))
+		for i, req := range reqs {
+			sent[i] = withSentBody(req)
+		}
+		reqs = sent
+	}
+	for _, req := range reqs {
+		if err := req.Write(&buf); err != nil {
+			return nil, errors.Wrap(err, "failed to write request")
+		}
+	}
+
+	start := time.Now()
+	stop := interruptAfter(ctx, conn, w.c.timeouts.ResponseHeader)
+	_, err := conn.Write(buf.Bytes())
+	stop()
+	wrote := time.Since(start)
+	if err != nil {
+		conn.Close()
+		err = tunnelErr(ctx, err, ErrResponseHeaderTimeout, "failed to send requests")
+		w.recordErrors(conn, reqs, err, start, wrote)
+		return nil, err
+	}
+
+	ret := make([]*http.Response, 0, len(reqs))
+	for _, req := range reqs {
+		stop := interruptAfter(ctx, conn, w.c.timeouts.ResponseHeader)
+		res, err := http.ReadResponse(br, req)
+		stop()
+		st := StreamTiming{
+			URL:          req.URL.String(),
+			Start:        start,
+			WroteRequest: wrote,
+			FirstByte:    time.Since(start),
+		}
+		reportStream(req.Context(), st)
+		if err != nil {
+			conn.Close()
+			err = tunnelErr(ctx, err, ErrResponseHeaderTimeout, "failed to read response")
+			w.recordErrors(conn, reqs[len(ret):], err, start, wrote)
+			return ret, err
+		}
+
+		stop = interruptAfter(ctx, conn, w.c.timeouts.ResponseBody)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		stop()
+		if err != nil {
+			conn.Close()
+			err = tunnelErr(ctx, err, ErrResponseBodyTimeout, "failed to read body")
+			w.recordErrors(conn, reqs[len(ret):], err, start, wrote)
+			return ret, err
+		}
+
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+		res.TLS = w.ConnectionState()
+		if w.c.har != nil {
+			e := NewHAREntry(TransportWebSocket, req, res, body, st, time.Now())
+			setHARConn(&e, conn)
+			w.c.har.Add(e)
+		}
+		ret = append(ret, res)
+	}
+	return ret, nil
+}
+
+// recordErrors will add the requests which failed with err to the HAR, if recording. start and
+// wrote are the pipeline's timing
+func (w *WebSocketConn) recordErrors(conn net.Conn, reqs []*http.Request, err error, start time.Time, wrote time.Duration) {
+	if w.c.har == nil {
+		return
+	}
+	done := time.Now()
+	for _, req := range reqs {
+		st := StreamTiming{
+			URL:          req.URL.String(),
+			Start:        start,
+			WroteRequest: wrote,
+		}
+		e := newErrorHAREntry(TransportWebSocket, req, err, st, done)
+		setHARConn(&e, conn)
+		w.c.har.Add(e)
+	}
+}
+
+// tunnelErr will map err to the context error or timeout if either caused it
+func tunnelErr(ctx context.Context, err error, timeout error, msg string) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return timeout
+	}
+	return errors.Wrap(err, "h2csmuggler: "+msg)
+}
@@ -0,0 +1,173 @@
+package h2csmuggler
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/minight/h2csmuggler/http2"
+)
+
+// newWebSocketProxy will create a proxy which blocks /private, and relays the connection to the
+// backend verbatim once a websocket upgrade is sent, regardless of the backend's response
+func newWebSocketProxy(t *testing.T, backend string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				if strings.HasPrefix(req.URL.Path, "/private") || req.Header.Get("Upgrade") != "websocket" {
+					io.WriteString(c, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+					return
+				}
+				b, err := net.Dial("tcp", backend)
+				if err != nil {
+					return
+				}
+				defer b.Close()
+				req.Write(b)
+				go io.Copy(b, br)
+				io.Copy(c, b)
+			}(c)
+		}
+	}()
+	return "http://" + l.Addr().String()
+}
+
+func TestWebSocketConn_Pipeline(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header.Get("Sec-WebSocket-Version"); v != "" && v != "13" {
+			w.Header().Set("Sec-WebSocket-Version", "13")
+			w.Header().Set("Transfer-Encoding", "chunked")
+			w.WriteHeader(http.StatusUpgradeRequired)
+			fmt.Fprint(w, "bad version")
+			return
+		}
+		fmt.Fprintf(w, "backend %s", r.URL.Path)
+	}))
+	defer backend.Close()
+	proxy := newWebSocketProxy(t, backend.Listener.Addr().String())
+
+	tests := []struct {
+		name       string
+		version    string
+		wantStatus int
+	}{
+		{name: "valid version", version: DefaultWebSocketVersion, wantStatus: 200},
+		{name: "invalid version", version: InvalidWebSocketVersion, wantStatus: 426},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewWebSocketConn(proxy+"/", ConnectionWebSocketOptions(SetWebSocketVersion(tt.version), AllowRefusedWebSocketUpgrade()))
+			if err != nil {
+				t.Fatalf("NewWebSocketConn() error = %v", err)
+			}
+			defer c.Close()
+
+			paths := []string{"/private", "/private/a", "/"}
+			reqs := []*http.Request{}
+			for _, p := range paths {
+				req, err := http.NewRequest("GET", proxy+p, nil)
+				if err != nil {
+					t.Fatalf("NewRequest() error = %v", err)
+				}
+				reqs = append(reqs, req)
+			}
+
+			res, err := c.Pipeline(context.Background(), reqs)
+			if err != nil {
+				t.Fatalf("WebSocketConn.Pipeline() error = %v", err)
+			}
+			if got := c.UpgradeResponse().StatusCode; got != tt.wantStatus {
+				t.Errorf("WebSocketConn.UpgradeResponse().StatusCode = %v, want %v", got, tt.wantStatus)
+			}
+			if len(res) != len(paths) {
+				t.Fatalf("WebSocketConn.Pipeline() returned %d responses, want %d", len(res), len(paths))
+			}
+			for i, r := range res {
+				body, _ := ioutil.ReadAll(r.Body)
+				if want := "backend " + paths[i]; string(body) != want {
+					t.Errorf("WebSocketConn.Pipeline() body = %q, want %q", body, want)
+				}
+			}
+
+			// the tunnel should remain usable after the pipeline
+			req, _ := http.NewRequest("GET", proxy+"/private/b", nil)
+			r, err := c.Do(req)
+			if err != nil {
+				t.Fatalf("WebSocketConn.Do() error = %v", err)
+			}
+			if body, _ := ioutil.ReadAll(r.Body); string(body) != "backend /private/b" {
+				t.Errorf("WebSocketConn.Do() body = %q, want %q", body, "backend /private/b")
+			}
+		})
+	}
+}
+
+func TestWebSocketConn_UpgradeContext(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "backend %s", r.URL.Path)
+	}))
+	defer backend.Close()
+	proxy := newWebSocketProxy(t, backend.Listener.Addr().String())
+
+	tests := []struct {
+		name    string
+		opts    []WebSocketOption
+		wantErr bool
+	}{
+		{name: "refused", wantErr: true},
+		{name: "allow refused", opts: []WebSocketOption{AllowRefusedWebSocketUpgrade()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewWebSocketConn(proxy + "/")
+			if err != nil {
+				t.Fatalf("NewWebSocketConn() error = %v", err)
+			}
+			defer c.Close()
+
+			req, err := http.NewRequest("GET", proxy+"/", nil)
+			if err != nil {
+				t.Fatalf("NewRequest() error = %v", err)
+			}
+			_, err = c.UpgradeContext(context.Background(), req, tt.opts...)
+			if tt.wantErr {
+				var uscErr http2.UnexpectedStatusCodeError
+				if !errors.As(err, &uscErr) || uscErr.Code != http.StatusOK {
+					t.Fatalf("WebSocketConn.UpgradeContext() error = %v, want unexpected status %v", err, http.StatusOK)
+				}
+				if c.Initialized() {
+					t.Errorf("WebSocketConn.Initialized() = true after a refused upgrade")
+				}
+			} else if err != nil {
+				t.Fatalf("WebSocketConn.UpgradeContext() error = %v", err)
+			}
+			if got := c.UpgradeResponse().StatusCode; got != http.StatusOK {
+				t.Errorf("WebSocketConn.UpgradeResponse().StatusCode = %v, want %v", got, http.StatusOK)
+			}
+		})
+	}
+}